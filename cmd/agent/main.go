@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
@@ -11,10 +12,14 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 
 	"github.com/v-starostin/go-metrics/internal/agent"
 	"github.com/v-starostin/go-metrics/internal/config"
 	"github.com/v-starostin/go-metrics/internal/crypto"
+	pb "github.com/v-starostin/go-metrics/proto"
 )
 
 var (
@@ -49,7 +54,49 @@ func main() {
 		}
 	}
 
-	a := agent.New(&logger, client, cfg.ServerAddress, cfg.Key, publicKey)
+	var tlsConfig *tls.Config
+	if cfg.TLSCA != "" || cfg.TLSCert != "" {
+		tlsConfig, err = crypto.ClientTLSConfig(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			logger.Error().Err(err).Msg("Error to load TLS config")
+			return
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	var grpcClient pb.MetricsServiceClient
+	if cfg.GRPCAddress != "" {
+		creds := insecure.NewCredentials()
+		if tlsConfig != nil {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		conn, err := grpc.NewClient(cfg.GRPCAddress, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			logger.Error().Err(err).Msg("Error to create gRPC client")
+			return
+		}
+		defer conn.Close()
+		grpcClient = pb.NewMetricsServiceClient(conn)
+	}
+
+	a := agent.New(&logger, client, grpcClient, cfg.ServerAddress, cfg.Key, publicKey)
+	if tlsConfig != nil {
+		a.SetTLS()
+	}
+	if cfg.GRPCAddress != "" {
+		a.SetGRPCAddress(cfg.GRPCAddress)
+	}
+	if cfg.KeyID != "" {
+		a.SetKeyID(cfg.KeyID)
+	}
+	if cfg.SpoolDir != "" {
+		spool, err := agent.NewSpool(cfg.SpoolDir, cfg.SpoolSize)
+		if err != nil {
+			logger.Error().Err(err).Msg("Error to open spool")
+			return
+		}
+		a.SetSpool(spool)
+	}
 
 	logger.Info().
 		Int("pollInterval", cfg.PollInterval).
@@ -61,19 +108,30 @@ func main() {
 
 	metrics := a.PrepareMetrics(ctx, time.Duration(cfg.ReportInterval)*time.Second)
 
-	for i := 0; i < cfg.RateLimit; i++ {
-		go a.Retry(ctx, 3, func(ctx context.Context) error {
+	pool := agent.NewPool(&logger, cfg.RateLimit, func(ctx context.Context) error {
+		return a.Retry(ctx, 3, func(ctx context.Context) error {
 			return a.SendMetrics(ctx, metrics)
 		}, 1*time.Second, 3*time.Second, 5*time.Second)
-	}
+	}, time.Second, time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+	go pool.ReportStatus(ctx, time.Duration(cfg.ReportInterval)*time.Second)
 
 	<-ctx.Done()
 	if ctx.Err() != nil {
 		logger.Info().Msgf("Received shutdown signal, stopping work: %v", ctx.Err())
 	}
 
-	logger.Info().Msg("Waiting 5 seconds to complete pending operations...")
-	time.Sleep(5 * time.Second)
+	logger.Info().Msg("Waiting up to 5 seconds to complete pending operations...")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		logger.Warn().Any("workers", pool.Status()).Msg("Workers did not stop in time")
+	}
 
 	logger.Info().Msg("Finished collecting metrics and shutting down gracefully.")
 }
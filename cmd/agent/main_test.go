@@ -1,22 +1,32 @@
 package main_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	mmock "github.com/stretchr/testify/mock"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/v-starostin/go-metrics/internal/agent"
+	"github.com/v-starostin/go-metrics/internal/crypto"
 	"github.com/v-starostin/go-metrics/internal/mock"
 	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/rpc"
+	pb "github.com/v-starostin/go-metrics/proto"
 )
 
 // Had to move it here from internal/agent since GHActions checks expect agent tests in cmd/agent
@@ -27,7 +37,7 @@ func TestSendMetrics(t *testing.T) {
 		{MType: "gauge", ID: "metric1", Value: float64(10)},
 	}
 
-	a := agent.New(&zerolog.Logger{}, client, "0.0.0.0:8080", "key", nil)
+	a := agent.New(&zerolog.Logger{}, client, nil, "0.0.0.0:8080", "key", nil)
 
 	t.Run("good case", func(t *testing.T) {
 		ch := make(chan []model.AgentMetric)
@@ -67,13 +77,170 @@ func TestSendMetrics(t *testing.T) {
 		err := a.SendMetrics(ctx, ch)
 		assert.EqualError(t, err, "err")
 	})
+
+	t.Run("server error", func(t *testing.T) {
+		ch := make(chan []model.AgentMetric, 1)
+		ch <- metrics
+		close(ch)
+
+		res := &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       io.NopCloser(strings.NewReader("")),
+		}
+		client.On("Do", mmock.Anything).Once().Return(res, nil)
+		err := a.SendMetrics(ctx, ch)
+		assert.EqualError(t, err, "server responded with status 503")
+	})
+}
+
+func TestSendMetricsTLS(t *testing.T) {
+	client := &mock.HTTPClient{}
+	a := agent.New(&zerolog.Logger{}, client, nil, "0.0.0.0:8080", "key", nil)
+	a.SetTLS()
+
+	ch := make(chan []model.AgentMetric, 1)
+	ch <- []model.AgentMetric{{MType: "gauge", ID: "metric1", Value: float64(10)}}
+	close(ch)
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	client.On("Do", mmock.MatchedBy(func(r *http.Request) bool {
+		return r.URL.String() == "https://0.0.0.0:8080/updates/"
+	})).Once().Return(res, nil)
+
+	err := a.SendMetrics(context.Background(), ch)
+	assert.NoError(t, err)
+	client.AssertExpectations(t)
+}
+
+func TestSendMetricsRealIP(t *testing.T) {
+	client := &mock.HTTPClient{}
+	a := agent.New(&zerolog.Logger{}, client, nil, "127.0.0.1:8080", "key", nil)
+
+	ch := make(chan []model.AgentMetric, 1)
+	ch <- []model.AgentMetric{{MType: "gauge", ID: "metric1", Value: float64(10)}}
+	close(ch)
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	client.On("Do", mmock.MatchedBy(func(r *http.Request) bool {
+		return r.Header.Get("X-Real-IP") == "127.0.0.1"
+	})).Once().Return(res, nil)
+
+	err := a.SendMetrics(context.Background(), ch)
+	assert.NoError(t, err)
+	client.AssertExpectations(t)
+}
+
+func TestSendMetricsRejected(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusInternalServerError} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			client := &mock.HTTPClient{}
+			a := agent.New(&zerolog.Logger{}, client, nil, "0.0.0.0:8080", "key", nil)
+
+			ch := make(chan []model.AgentMetric, 1)
+			ch <- []model.AgentMetric{{MType: "gauge", ID: "metric1", Value: float64(10)}}
+			close(ch)
+
+			res := &http.Response{
+				StatusCode: status,
+				Body:       io.NopCloser(strings.NewReader("")),
+			}
+			client.On("Do", mmock.Anything).Once().Return(res, nil)
+
+			err := a.SendMetrics(context.Background(), ch)
+			assert.EqualError(t, err, fmt.Sprintf("server responded with status %d", status))
+		})
+	}
+}
+
+func TestSendMetricsKeyID(t *testing.T) {
+	client := &mock.HTTPClient{}
+	a := agent.New(&zerolog.Logger{}, client, nil, "0.0.0.0:8080", "key", nil)
+	a.SetKeyID("k1")
+
+	ch := make(chan []model.AgentMetric, 1)
+	ch <- []model.AgentMetric{{MType: "gauge", ID: "metric1", Value: float64(10)}}
+	close(ch)
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+	}
+	client.On("Do", mmock.MatchedBy(func(r *http.Request) bool {
+		body, _ := io.ReadAll(r.Body)
+		hash := crypto.Signature("key", r.Header.Get("HashTimestamp"), r.Header.Get("HashNonce"), body)
+		return r.Header.Get("KeyID") == "k1" && r.Header.Get("HashNonce") != "" && r.Header.Get("HashSHA256") == hex.EncodeToString(hash)
+	})).Once().Return(res, nil)
+
+	err := a.SendMetrics(context.Background(), ch)
+	assert.NoError(t, err)
+	client.AssertExpectations(t)
+}
+
+func TestSendMetricsGRPC(t *testing.T) {
+	ctx := context.Background()
+	client := &mock.HTTPClient{}
+	grpcClient := &mock.MetricsServiceClient{}
+	metrics := []model.AgentMetric{
+		{MType: "gauge", ID: "metric1", Value: uint64(10)},
+		{MType: "counter", ID: "metric2", Delta: int64(2)},
+	}
+
+	a := agent.New(&zerolog.Logger{}, client, grpcClient, "0.0.0.0:8080", "key", nil)
+
+	send := func() error {
+		ch := make(chan []model.AgentMetric, 1)
+		ch <- metrics
+		close(ch)
+		return a.SendMetrics(ctx, ch)
+	}
+
+	t.Run("good case", func(t *testing.T) {
+		grpcClient.On("Update", mmock.Anything, mmock.MatchedBy(func(req *pb.UpdateRequest) bool {
+			return len(req.GetMetrics()) == 2 &&
+				req.GetMetrics()[0].GetValue() == 10 &&
+				req.GetMetrics()[1].GetDelta() == 2
+		})).Once().Return(&pb.UpdateResponse{}, nil)
+		assert.NoError(t, send())
+		client.AssertNotCalled(t, "Do", mmock.Anything)
+	})
+
+	t.Run("bad case", func(t *testing.T) {
+		grpcClient.On("Update", mmock.Anything, mmock.Anything).Once().Return(nil, fmt.Errorf("err"))
+		assert.EqualError(t, send(), "err")
+	})
+}
+
+func TestSendMetricsGRPCRealIP(t *testing.T) {
+	grpcClient := &mock.MetricsServiceClient{}
+	// the HTTP server address is not routable over IPv4, the outbound address is picked for the gRPC one
+	a := agent.New(&zerolog.Logger{}, &mock.HTTPClient{}, grpcClient, "[::1]:8080", "", nil)
+	a.SetGRPCAddress("127.0.0.1:3200")
+
+	grpcClient.On("Update", mmock.MatchedBy(func(ctx context.Context) bool {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		return slices.Equal(md.Get(rpc.RealIPHeader), []string{"127.0.0.1"})
+	}), mmock.Anything).Twice().Return(&pb.UpdateResponse{}, nil)
+
+	for i := 0; i < 2; i++ {
+		ch := make(chan []model.AgentMetric, 1)
+		ch <- []model.AgentMetric{{MType: "gauge", ID: "metric1", Value: float64(10)}}
+		close(ch)
+		assert.NoError(t, a.SendMetrics(context.Background(), ch))
+	}
+	grpcClient.AssertExpectations(t)
 }
 
 func TestRetry(t *testing.T) {
 	ctx := context.Background()
 	client := &mock.HTTPClient{}
 
-	a := agent.New(&zerolog.Logger{}, client, "0.0.0.0:8080", "key", nil)
+	a := agent.New(&zerolog.Logger{}, client, nil, "0.0.0.0:8080", "key", nil)
 
 	t.Run("good case", func(t *testing.T) {
 		err := a.Retry(ctx, 3, func(ctx context.Context) error {
@@ -133,7 +300,7 @@ func TestCollectGopsutilMetrics(t *testing.T) {
 	ctx := context.Background()
 	client := &mock.HTTPClient{}
 
-	a := agent.New(&zerolog.Logger{}, client, "0.0.0.0:8080", "key", nil)
+	a := agent.New(&zerolog.Logger{}, client, nil, "0.0.0.0:8080", "key", nil)
 
 	t.Run("context canceled", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(ctx)
@@ -168,7 +335,7 @@ func TestCollectRuntimeMetrics(t *testing.T) {
 	ctx := context.Background()
 	client := &mock.HTTPClient{}
 
-	a := agent.New(&zerolog.Logger{}, client, "0.0.0.0:8080", "key", nil)
+	a := agent.New(&zerolog.Logger{}, client, nil, "0.0.0.0:8080", "key", nil)
 
 	t.Run("context canceled", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(ctx)
@@ -198,3 +365,230 @@ func TestCollectRuntimeMetrics(t *testing.T) {
 		wg.Wait()
 	})
 }
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	batch := func(v float64) model.AgentMetrics {
+		return model.AgentMetrics{{MType: "gauge", ID: "metric1", Value: v}}
+	}
+
+	s, err := agent.NewSpool(dir, 2)
+	assert.NoError(t, err)
+	for _, v := range []float64{1, 2, 3} {
+		_, err := s.Push(batch(v))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, s.Len())
+
+	// the spool survives a restart
+	s, err = agent.NewSpool(dir, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+
+	var sent []any
+	err = s.Replay(func(m model.AgentMetrics) error {
+		if len(sent) == 1 {
+			return fmt.Errorf("err")
+		}
+		sent = append(sent, m[0].Value)
+		return nil
+	})
+	assert.EqualError(t, err, "err")
+	assert.Equal(t, []any{float64(2)}, sent)
+	assert.Equal(t, 1, s.Len())
+
+	_, err = s.Push(batch(4))
+	assert.NoError(t, err)
+	err = s.Replay(func(m model.AgentMetrics) error {
+		sent = append(sent, m[0].Value)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []any{float64(2), float64(3), float64(4)}, sent)
+	assert.Equal(t, 0, s.Len())
+
+	// a crash before a segment is renamed leaves a temporary file, which is removed
+	tmp := filepath.Join(dir, "segment-1.tmp")
+	assert.NoError(t, os.WriteFile(tmp, []byte("{"), 0o644))
+	s, err = agent.NewSpool(dir, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, s.Len())
+	assert.NoFileExists(t, tmp)
+}
+
+func TestSpoolPushDuringReplay(t *testing.T) {
+	s, err := agent.NewSpool(t.TempDir(), 10)
+	assert.NoError(t, err)
+	_, err = s.Push(model.AgentMetrics{{MType: "gauge", ID: "metric1", Value: float64(1)}})
+	assert.NoError(t, err)
+
+	sending, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- s.Replay(func(model.AgentMetrics) error {
+			close(sending)
+			<-release
+			return nil
+		})
+	}()
+
+	// the push completes while a slow send is in flight and is left for the next replay
+	<-sending
+	pushed := make(chan error)
+	go func() {
+		_, err := s.Push(model.AgentMetrics{{MType: "gauge", ID: "metric1", Value: float64(2)}})
+		pushed <- err
+	}()
+	select {
+	case err := <-pushed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Push is blocked by Replay")
+	}
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestSendMetricsSpool(t *testing.T) {
+	ctx := context.Background()
+	grpcClient := &mock.MetricsServiceClient{}
+	spool, err := agent.NewSpool(t.TempDir(), 10)
+	assert.NoError(t, err)
+
+	a := agent.New(&zerolog.Logger{}, &mock.HTTPClient{}, grpcClient, "0.0.0.0:8080", "", nil)
+	a.SetSpool(spool)
+
+	send := func(v float64) error {
+		ch := make(chan []model.AgentMetric, 1)
+		ch <- []model.AgentMetric{{MType: "gauge", ID: "metric1", Value: v}}
+		close(ch)
+		return a.SendMetrics(ctx, ch)
+	}
+	value := func(v float64) any {
+		return mmock.MatchedBy(func(req *pb.UpdateRequest) bool {
+			return req.GetMetrics()[0].GetValue() == v
+		})
+	}
+
+	grpcClient.On("Update", mmock.Anything, value(1)).Once().Return(nil, fmt.Errorf("err"))
+	assert.NoError(t, send(1))
+	assert.Equal(t, 1, spool.Len())
+
+	grpcClient.On("Update", mmock.Anything, value(1)).Once().Return(nil, fmt.Errorf("err"))
+	assert.NoError(t, send(2))
+	assert.Equal(t, 2, spool.Len())
+
+	var order []float64
+	grpcClient.On("Update", mmock.Anything, mmock.Anything).Times(3).
+		Run(func(args mmock.Arguments) {
+			order = append(order, args.Get(1).(*pb.UpdateRequest).GetMetrics()[0].GetValue())
+		}).
+		Return(&pb.UpdateResponse{}, nil)
+	assert.NoError(t, send(3))
+	assert.Equal(t, 0, spool.Len())
+	assert.Equal(t, []float64{1, 2, 3}, order)
+	grpcClient.AssertExpectations(t)
+}
+
+func TestPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	pool := agent.NewPool(&zerolog.Logger{}, 2, func(ctx context.Context) error {
+		if call := calls.Add(1); call <= 4 {
+			return fmt.Errorf("err %d", call)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}, 10*time.Millisecond, 40*time.Millisecond)
+
+	for _, w := range pool.Status() {
+		assert.Equal(t, agent.WorkerStopped, w.State)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		status := pool.Status()
+		return status[0].State == agent.WorkerRunning && status[1].State == agent.WorkerRunning &&
+			status[0].Restarts+status[1].Restarts == 4
+	}, time.Second, 5*time.Millisecond)
+	assert.NotEmpty(t, pool.Status()[0].LastError)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pool did not stop")
+	}
+	for _, w := range pool.Status() {
+		assert.Equal(t, agent.WorkerStopped, w.State)
+	}
+}
+
+// syncBuffer is a buffer safe for concurrent use by a logger and a test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPoolReportStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var logs syncBuffer
+	l := zerolog.New(&logs)
+	pool := agent.NewPool(&l, 1, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, time.Millisecond, time.Millisecond)
+	go pool.Run(ctx)
+	go pool.ReportStatus(ctx, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), `"running":1,"size":1,"workers":[{"id":0,"state":"running","restarts":0}]`)
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestPoolStopsDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := agent.NewPool(&zerolog.Logger{}, 1, func(ctx context.Context) error {
+		return fmt.Errorf("err")
+	}, time.Hour, time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return pool.Status()[0].State == agent.WorkerBackoff
+	}, time.Second, 5*time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pool did not stop")
+	}
+	assert.Equal(t, 1, pool.Status()[0].Restarts)
+}
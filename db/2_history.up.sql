@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS metrics_history (
+    id VARCHAR NOT NULL,
+    type VARCHAR NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    ts TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS metrics_history_type_id_ts_idx ON metrics_history (type, id, ts);
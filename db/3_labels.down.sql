@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS metrics_history_type_id_labels_ts_idx;
+DELETE FROM metrics_history WHERE labels <> '{}';
+ALTER TABLE metrics_history DROP COLUMN IF EXISTS labels;
+CREATE INDEX IF NOT EXISTS metrics_history_type_id_ts_idx ON metrics_history (type, id, ts);
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_id_type_labels_key;
+DELETE FROM metrics WHERE labels <> '{}';
+ALTER TABLE metrics DROP COLUMN IF EXISTS labels;
+ALTER TABLE metrics ADD CONSTRAINT metrics_id_type_key UNIQUE (id, type);
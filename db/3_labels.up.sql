@@ -0,0 +1,6 @@
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_id_type_key;
+ALTER TABLE metrics ADD CONSTRAINT metrics_id_type_labels_key UNIQUE (id, type, labels);
+ALTER TABLE metrics_history ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+DROP INDEX IF EXISTS metrics_history_type_id_ts_idx;
+CREATE INDEX IF NOT EXISTS metrics_history_type_id_labels_ts_idx ON metrics_history (type, id, labels, ts);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS agent_keys (
+    id VARCHAR PRIMARY KEY,
+    secret VARCHAR NOT NULL,
+    agent VARCHAR NOT NULL DEFAULT '',
+    not_before TIMESTAMPTZ,
+    not_after TIMESTAMPTZ,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE
+);
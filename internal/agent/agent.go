@@ -4,26 +4,29 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/hmac"
 	"crypto/rsa"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"reflect"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/shirou/gopsutil/v3/mem"
-	"github.com/v-starostin/go-metrics/internal/crypto"
+	"google.golang.org/grpc/metadata"
 
+	"github.com/v-starostin/go-metrics/internal/crypto"
 	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/rpc"
 	"github.com/v-starostin/go-metrics/internal/service"
+	pb "github.com/v-starostin/go-metrics/proto"
 )
 
 // HTTPClient defines a method for making HTTP requests.
@@ -33,36 +36,78 @@ type HTTPClient interface {
 
 // Agent represents an agent that collects and sends metrics.
 type Agent struct {
-	mu        sync.Mutex
-	logger    *zerolog.Logger
-	client    HTTPClient
-	Metrics   []model.AgentMetric
-	address   string
-	key       string
-	counter   *int64
-	gw        *gzip.Writer
-	publicKey *rsa.PublicKey
+	mu         sync.Mutex
+	logger     *zerolog.Logger
+	client     HTTPClient
+	grpcClient pb.MetricsServiceClient
+	Metrics    []model.AgentMetric
+	address    string
+	scheme     string
+	key        string
+	keyID      string
+	counter    *int64
+	gw         *gzip.Writer
+	publicKey  *rsa.PublicKey
+	spool      *Spool
+	// grpcAddress is the address of the gRPC server, if it differs from the HTTP one
+	grpcAddress string
+	// ipMu guards the outbound address cached for ipTTL
+	ipMu       sync.Mutex
+	ip         string
+	ipResolved time.Time
 }
 
+// ipTTL is how long the outbound address is cached before it is resolved again, e.g. after a route change.
+const ipTTL = time.Minute
+
 // New creates a new Agent with the provided logger, HTTP client, address, and key.
-func New(logger *zerolog.Logger, client HTTPClient, address, key string, publicKey *rsa.PublicKey) *Agent {
+// When grpcClient is not nil, metrics are sent over gRPC instead of HTTP.
+func New(logger *zerolog.Logger, client HTTPClient, grpcClient pb.MetricsServiceClient, address, key string, publicKey *rsa.PublicKey) *Agent {
 	counter := new(int64)
 	*counter = 0
 	return &Agent{
-		logger:    logger,
-		client:    client,
-		address:   address,
-		key:       key,
-		counter:   counter,
-		gw:        gzip.NewWriter(io.Discard),
-		Metrics:   make([]model.AgentMetric, len(model.GaugeMetrics)+5),
-		publicKey: publicKey,
+		logger:     logger,
+		client:     client,
+		grpcClient: grpcClient,
+		address:    address,
+		scheme:     "http",
+		key:        key,
+		counter:    counter,
+		gw:         gzip.NewWriter(io.Discard),
+		Metrics:    make([]model.AgentMetric, len(model.GaugeMetrics)+5),
+		publicKey:  publicKey,
 	}
 }
 
+// SetTLS makes the agent send metrics over HTTPS.
+// The TLS settings themselves belong to the HTTP client.
+func (a *Agent) SetTLS() {
+	a.scheme = "https"
+}
+
+// SetKeyID sets the ID of the key, sent along with the signature so the server
+// can pick the key of this agent.
+func (a *Agent) SetKeyID(id string) {
+	a.keyID = id
+}
+
+// SetGRPCAddress sets the address of the gRPC server, which is used to pick the outbound address
+// sent in x-real-ip when it differs from the HTTP server address.
+func (a *Agent) SetGRPCAddress(address string) {
+	a.grpcAddress = address
+}
+
+// SetSpool sets the spool that keeps the batches which failed to be sent.
+func (a *Agent) SetSpool(s *Spool) {
+	a.spool = s
+}
+
 // SendMetrics sends the collected metrics to the configured address.
-// It reads metrics from the provided channel and sends them in a compressed JSON format.
+// It reads metrics from the provided channel and sends them over gRPC when a gRPC client is set,
+// or in a compressed JSON format over HTTP otherwise.
 // If an error occurs during the process, it is logged and returned.
+// When a spool is set, a batch that fails to be sent is spooled instead, and the spooled
+// batches are replayed in order before the next batch is sent.
 func (a *Agent) SendMetrics(ctx context.Context, metrics <-chan []model.AgentMetric) error {
 	for {
 		var m model.AgentMetrics
@@ -70,71 +115,252 @@ func (a *Agent) SendMetrics(ctx context.Context, metrics <-chan []model.AgentMet
 		m, ok = <-metrics
 		if !ok {
 			return nil
-		} else {
-			//b, err := json.Marshal(m)
-			b, err := m.MarshalJSON()
-			if err != nil {
-				a.logger.Error().Err(err).Msg("Marshalling error")
-				return err
-			}
-			a.logger.Info().Any("json", string(b)).Msg("Marshalled")
+		}
 
-			buf := &bytes.Buffer{}
-			a.gw.Reset(buf)
-			n, err := a.gw.Write(b)
-			if err != nil {
-				a.logger.Error().Err(err).Msg("gw.Write error")
-				return err
-			}
-			a.gw.Close()
-
-			a.logger.Info().
-				Int("len of b", len(b)).
-				Int("written bytes", n).
-				Int("len of buf", len(buf.Bytes())).
-				Send()
-
-			var req *http.Request
-			if a.publicKey != nil {
-				encrypted, err := crypto.RSAEncrypt(a.publicKey, buf.Bytes())
-				if err != nil {
-					a.logger.Error().Err(err).Msg("Error to encrypt data")
-					return err
-				}
-				req, err = http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/updates/", a.address), bytes.NewReader(encrypted))
-				if err != nil {
-					a.logger.Error().Err(err).Msg("http.NewRequestWithContext method error")
-					return err
-				}
-			} else {
-				req, err = http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("http://%s/updates/", a.address), buf)
-				if err != nil {
-					a.logger.Error().Err(err).Msg("http.NewRequestWithContext method error")
-					return err
-				}
-			}
+		if a.spool != nil {
+			a.sendSpooled(ctx, m)
+			continue
+		}
 
-			if a.key != "" {
-				buf2 := *buf
-				h := hmac.New(sha256.New, []byte(a.key))
-				if _, err = h.Write(buf2.Bytes()); err != nil {
-					return err
-				}
-				d := h.Sum(nil)
-				a.logger.Info().Msgf("hash: %x", d)
-				req.Header.Add("HashSHA256", hex.EncodeToString(d))
-			}
-			req.Header.Add("Content-Type", "application/json")
-			req.Header.Add("Content-Encoding", "gzip")
+		if err := a.send(ctx, m); err != nil {
+			return err
+		}
+		a.logger.Info().Any("metric", m).Msg("Metrics are sent")
+	}
+}
 
-			res, err := a.client.Do(req)
-			if err != nil {
-				a.logger.Error().Err(err).Msg("client.Do method error")
-				return err
-			}
-			res.Body.Close()
+func (a *Agent) send(ctx context.Context, m model.AgentMetrics) error {
+	if a.grpcClient != nil {
+		return a.sendGRPC(ctx, m)
+	}
+	return a.sendHTTP(ctx, m)
+}
+
+func (a *Agent) sendSpooled(ctx context.Context, m model.AgentMetrics) {
+	if a.spool.Len() == 0 {
+		err := a.send(ctx, m)
+		if err == nil {
 			a.logger.Info().Any("metric", m).Msg("Metrics are sent")
+			return
 		}
+		a.logger.Error().Err(err).Msg("Failed to send metrics, spooling the batch")
+		a.push(m)
+		return
+	}
+
+	// the batch goes after the spooled ones to keep the order
+	a.push(m)
+	err := a.spool.Replay(func(m model.AgentMetrics) error {
+		return a.send(ctx, m)
+	})
+	if err != nil {
+		a.logger.Error().Err(err).Int("spooled", a.spool.Len()).Msg("Failed to replay spooled metrics")
+		return
+	}
+	a.logger.Info().Msg("Spooled metrics are sent")
+}
+
+func (a *Agent) push(m model.AgentMetrics) {
+	dropped, err := a.spool.Push(m)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Failed to spool metrics")
+		return
+	}
+	if dropped > 0 {
+		a.logger.Warn().Int("dropped", dropped).Msg("Spool is full, the oldest batches are dropped")
+	}
+}
+
+func (a *Agent) sendHTTP(ctx context.Context, m model.AgentMetrics) error {
+	//b, err := json.Marshal(m)
+	b, err := m.MarshalJSON()
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Marshalling error")
+		return err
+	}
+	a.logger.Info().Any("json", string(b)).Msg("Marshalled")
+
+	buf := &bytes.Buffer{}
+	a.gw.Reset(buf)
+	n, err := a.gw.Write(b)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("gw.Write error")
+		return err
+	}
+	a.gw.Close()
+
+	a.logger.Info().
+		Int("len of b", len(b)).
+		Int("written bytes", n).
+		Int("len of buf", len(buf.Bytes())).
+		Send()
+
+	body := buf.Bytes()
+	if a.publicKey != nil {
+		body, err = crypto.Encrypt(a.publicKey, body)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Error to encrypt data")
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s://%s/updates/", a.scheme, a.address), bytes.NewReader(body))
+	if err != nil {
+		a.logger.Error().Err(err).Msg("http.NewRequestWithContext method error")
+		return err
+	}
+
+	if a.key != "" {
+		nonce, err := crypto.Nonce()
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		// the hash is checked against the body as it is received, i.e. after encryption
+		d := crypto.Signature(a.key, timestamp, nonce, body)
+		a.logger.Info().Msgf("hash: %x", d)
+		req.Header.Add("HashSHA256", hex.EncodeToString(d))
+		req.Header.Add("HashTimestamp", timestamp)
+		req.Header.Add("HashNonce", nonce)
+		if a.keyID != "" {
+			req.Header.Add("KeyID", a.keyID)
+		}
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Encoding", "gzip")
+	if ip := a.outboundIP(a.address); ip != "" {
+		req.Header.Add("X-Real-IP", ip)
+	}
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("client.Do method error")
+		return err
+	}
+	res.Body.Close()
+	// a rejected batch, e.g. for a bad signature, is not delivered either
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("server responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// outboundIP returns the address of the interface used to reach the server at address.
+// Dialing UDP does not send any packets, it only picks the route. The result is cached for ipTTL,
+// the agent sends to a single server.
+func (a *Agent) outboundIP(address string) string {
+	a.ipMu.Lock()
+	defer a.ipMu.Unlock()
+
+	if a.ip != "" && time.Since(a.ipResolved) < ipTTL {
+		return a.ip
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Failed to get outbound IP")
+		return ""
+	}
+	defer conn.Close()
+
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return ""
+	}
+	a.ip = addr.IP.String()
+	a.ipResolved = time.Now()
+	return a.ip
+}
+
+func (a *Agent) sendGRPC(ctx context.Context, m model.AgentMetrics) error {
+	req := &pb.UpdateRequest{Metrics: make([]*pb.Metric, 0, len(m))}
+	for _, metric := range m {
+		pm, err := toProto(metric)
+		if err != nil {
+			a.logger.Error().Err(err).Msg("Converting metric error")
+			return err
+		}
+		req.Metrics = append(req.Metrics, pm)
+	}
+
+	if a.key != "" {
+		nonce, err := crypto.Nonce()
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		hash, err := rpc.Sign(req, a.key, timestamp, nonce)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, rpc.HashHeader, hash, rpc.TimestampHeader, timestamp, rpc.NonceHeader, nonce)
+		if a.keyID != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, rpc.KeyIDHeader, a.keyID)
+		}
+	}
+	address := a.grpcAddress
+	if address == "" {
+		address = a.address
+	}
+	if ip := a.outboundIP(address); ip != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpc.RealIPHeader, ip)
+	}
+
+	if _, err := a.grpcClient.Update(ctx, req); err != nil {
+		a.logger.Error().Err(err).Msg("grpcClient.Update method error")
+		return err
+	}
+	return nil
+}
+
+func toProto(m model.AgentMetric) (*pb.Metric, error) {
+	pm := &pb.Metric{Id: m.ID, Type: m.MType}
+	switch m.MType {
+	case service.TypeGauge:
+		v, err := toFloat64(m.Value)
+		if err != nil {
+			return nil, err
+		}
+		pm.Value = &v
+	case service.TypeCounter:
+		d, err := toInt64(m.Delta)
+		if err != nil {
+			return nil, err
+		}
+		pm.Delta = &d
+	}
+	return pm, nil
+}
+
+func toFloat64(v any) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	default:
+		return 0, fmt.Errorf("unexpected gauge value type: %T", v)
+	}
+}
+
+func toInt64(v any) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float64:
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("unexpected counter delta type: %T", v)
 	}
 }
 
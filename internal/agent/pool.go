@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Worker states.
+const (
+	WorkerRunning = "running"
+	WorkerBackoff = "backoff"
+	WorkerStopped = "stopped"
+)
+
+// WorkerStatus describes the state of a worker in the pool.
+type WorkerStatus struct {
+	ID        int    `json:"id"`
+	State     string `json:"state"`
+	Restarts  int    `json:"restarts"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// Pool runs a fixed number of workers and restarts the ones that fail.
+// A failed worker is restarted after an exponential backoff with jitter, capped at maxBackoff.
+// The backoff is reset once a worker has been running for longer than maxBackoff.
+// A worker stops when its function returns nil or the context is done.
+type Pool struct {
+	logger     *zerolog.Logger
+	work       func(ctx context.Context) error
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu      sync.Mutex
+	workers []WorkerStatus
+}
+
+// NewPool creates a new Pool of size workers running work.
+func NewPool(logger *zerolog.Logger, size int, work func(ctx context.Context) error, minBackoff, maxBackoff time.Duration) *Pool {
+	workers := make([]WorkerStatus, size)
+	for i := range workers {
+		workers[i] = WorkerStatus{ID: i, State: WorkerStopped}
+	}
+	return &Pool{
+		logger:     logger,
+		work:       work,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		workers:    workers,
+	}
+}
+
+// Run starts the workers and blocks until all of them stop.
+func (p *Pool) Run(ctx context.Context) {
+	wg := &sync.WaitGroup{}
+	for i := range p.workers {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			p.supervise(ctx, id)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Status returns the state of every worker.
+func (p *Pool) Status() []WorkerStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := make([]WorkerStatus, len(p.workers))
+	copy(status, p.workers)
+	return status
+}
+
+// ReportStatus logs the state of every worker each interval until ctx is done,
+// so that the restarting workers can be seen while the agent runs.
+func (p *Pool) ReportStatus(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			status := p.Status()
+			running := 0
+			for _, w := range status {
+				if w.State == WorkerRunning {
+					running++
+				}
+			}
+			p.logger.Info().Int("running", running).Int("size", len(status)).Any("workers", status).Msg("Workers status")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Pool) supervise(ctx context.Context, id int) {
+	defer p.setState(id, WorkerStopped, nil)
+
+	backoff := p.minBackoff
+	for {
+		p.setState(id, WorkerRunning, nil)
+		started := time.Now()
+		err := p.work(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(started) > p.maxBackoff {
+			backoff = p.minBackoff
+		}
+		delay := jitter(backoff)
+		p.setState(id, WorkerBackoff, err)
+		p.logger.Error().Err(err).Int("worker", id).Str("backoff", delay.String()).Msg("Worker failed, restarting")
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+func (p *Pool) setState(id int, state string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w := &p.workers[id]
+	if state == WorkerBackoff {
+		w.Restarts++
+	}
+	if err != nil {
+		w.LastError = err.Error()
+	}
+	w.State = state
+}
+
+// jitter returns a random duration in [d/2, d).
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
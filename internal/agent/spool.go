@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+const segmentExt = ".json"
+
+// Spool is a bounded on-disk queue of batches that failed to be sent.
+// Every batch is stored in its own segment file named by a sequence number,
+// so the queue survives restarts and is replayed in the order batches were pushed.
+// When the queue is full, the oldest segments are dropped.
+type Spool struct {
+	mu sync.Mutex
+	// replayMu serializes the replays, which send without holding mu so that Push is not blocked by the server
+	replayMu    sync.Mutex
+	dir         string
+	maxSegments int
+	segments    []uint64
+	next        uint64
+}
+
+// NewSpool opens the spool in dir, creating the directory when needed.
+func NewSpool(dir string, maxSegments int) (*Spool, error) {
+	if maxSegments <= 0 {
+		return nil, fmt.Errorf("spool size must be positive: %d", maxSegments)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxSegments: maxSegments}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasSuffix(name, ".tmp") {
+			// left by a crash before the segment was renamed
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	return s, nil
+}
+
+// Len returns the number of spooled batches.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments)
+}
+
+// Push appends a batch to the spool and drops the oldest batches beyond the limit.
+// It returns the number of dropped batches.
+func (s *Spool) Push(m model.AgentMetrics) (int, error) {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq := s.next
+	if err := writeSegment(s.dir, s.path(seq), b); err != nil {
+		return 0, err
+	}
+	s.next++
+	s.segments = append(s.segments, seq)
+
+	dropped := 0
+	for len(s.segments) > s.maxSegments {
+		if err := os.Remove(s.path(s.segments[0])); err != nil && !os.IsNotExist(err) {
+			return dropped, err
+		}
+		s.segments = s.segments[1:]
+		dropped++
+	}
+	return dropped, nil
+}
+
+// Replay sends the spooled batches in order, removing each one after send succeeds.
+// It stops at the first failed send and returns its error, the batch stays in the spool.
+// Segments that cannot be decoded are dropped. The batches pushed meanwhile are left for the next replay.
+func (s *Spool) Replay(send func(model.AgentMetrics) error) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	s.mu.Lock()
+	segments := slices.Clone(s.segments)
+	s.mu.Unlock()
+
+	for _, seq := range segments {
+		// the segment is gone when Push has dropped it meanwhile
+		b, err := os.ReadFile(s.path(seq))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		var m model.AgentMetrics
+		if err == nil && m.UnmarshalJSON(b) == nil {
+			if err := send(m); err != nil {
+				return err
+			}
+		}
+
+		if err := s.remove(seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove removes the oldest segment if it is still seq.
+func (s *Spool) remove(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 || s.segments[0] != seq {
+		return nil
+	}
+	if err := os.Remove(s.path(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.segments = s.segments[1:]
+	return nil
+}
+
+// writeSegment writes b to a temporary file in dir, syncs it and renames it to path,
+// then syncs dir so the segment survives a crash.
+func writeSegment(dir, path string, b []byte) error {
+	f, err := os.CreateTemp(dir, "segment-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
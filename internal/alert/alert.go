@@ -0,0 +1,243 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+// Alert states.
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+const funcRate = "rate"
+
+var ErrParseRule = errors.New("failed to parse alert rule")
+
+// ruleRe matches expressions like `gauge HeapAlloc > 500e6 for 2m`
+// and `rate(counter PollCount) == 0 for 1m`.
+var ruleRe = regexp.MustCompile(`^\s*(?:(rate)\(\s*(counter|gauge)\s+([^\s()]+)\s*\)|(counter|gauge)\s+(\S+))\s*(>=|<=|==|!=|>|<)\s*(\S+)(?:\s+for\s+(\S+))?\s*$`)
+
+// Rule is a condition on a single metric that has to hold for some time before the alert fires.
+type Rule struct {
+	Expr      string
+	Func      string
+	MType     string
+	Metric    string
+	Op        string
+	Threshold float64
+	For       time.Duration
+}
+
+// Alert is the state of a rule whose condition holds or held recently.
+type Alert struct {
+	Rule       string     `json:"rule"`
+	Metric     string     `json:"metric"`
+	State      string     `json:"state"`
+	Value      float64    `json:"value"`
+	ActiveAt   time.Time  `json:"activeAt"`
+	FiredAt    *time.Time `json:"firedAt,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// ParseRule parses an alert rule expression.
+func ParseRule(expr string) (Rule, error) {
+	match := ruleRe.FindStringSubmatch(expr)
+	if match == nil {
+		return Rule{}, fmt.Errorf("%w: %q", ErrParseRule, expr)
+	}
+
+	rule := Rule{
+		Expr:   expr,
+		Func:   match[1],
+		MType:  match[2],
+		Metric: match[3],
+		Op:     match[6],
+	}
+	if rule.Func == "" {
+		rule.MType = match[4]
+		rule.Metric = match[5]
+	}
+
+	threshold, err := strconv.ParseFloat(match[7], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w: %q: bad threshold", ErrParseRule, expr)
+	}
+	rule.Threshold = threshold
+
+	if match[8] != "" {
+		rule.For, err = time.ParseDuration(match[8])
+		if err != nil || rule.For < 0 {
+			return Rule{}, fmt.Errorf("%w: %q: bad duration", ErrParseRule, expr)
+		}
+	}
+
+	return rule, nil
+}
+
+// ParseRules parses a list of alert rule expressions.
+func ParseRules(exprs []string) ([]Rule, error) {
+	rules := make([]Rule, 0, len(exprs))
+	for _, expr := range exprs {
+		rule, err := ParseRule(expr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r Rule) holds(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	case "==":
+		return v == r.Threshold
+	case "!=":
+		return v != r.Threshold
+	}
+	return false
+}
+
+type sample struct {
+	value float64
+	ts    time.Time
+}
+
+// Evaluator tracks the state of alerts produced by a set of rules.
+type Evaluator struct {
+	mu     sync.Mutex
+	rules  []Rule
+	active map[string]*Alert
+	last   map[string]sample
+}
+
+// NewEvaluator creates a new Evaluator for the given rules.
+func NewEvaluator(rules []Rule) *Evaluator {
+	return &Evaluator{
+		rules:  rules,
+		active: make(map[string]*Alert),
+		last:   make(map[string]sample),
+	}
+}
+
+// SetRules replaces the rules and drops the state of the previous ones.
+func (e *Evaluator) SetRules(rules []Rule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = rules
+	e.active = make(map[string]*Alert)
+	e.last = make(map[string]sample)
+}
+
+// Eval evaluates the rules against the metrics at the moment now
+// and returns the alerts that became pending, firing or resolved.
+func (e *Evaluator) Eval(now time.Time, data model.Data) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	changed := make([]Alert, 0)
+	for _, rule := range e.rules {
+		v, ok := e.value(rule, now, data)
+		a, active := e.active[rule.Expr]
+
+		switch {
+		case ok && rule.holds(v):
+			if !active {
+				a = &Alert{Rule: rule.Expr, Metric: rule.Metric, State: StatePending, Value: v, ActiveAt: now}
+				e.active[rule.Expr] = a
+				if rule.For > 0 {
+					changed = append(changed, *a)
+				}
+			}
+			a.Value = v
+			if a.State == StatePending && now.Sub(a.ActiveAt) >= rule.For {
+				firedAt := now
+				a.State = StateFiring
+				a.FiredAt = &firedAt
+				changed = append(changed, *a)
+			}
+		case active:
+			delete(e.active, rule.Expr)
+			if a.State == StateFiring {
+				resolvedAt := now
+				a.State = StateResolved
+				a.ResolvedAt = &resolvedAt
+				if ok {
+					a.Value = v
+				}
+				changed = append(changed, *a)
+			}
+		}
+	}
+
+	return changed
+}
+
+// Active returns the pending and firing alerts ordered by rule.
+func (e *Evaluator) Active() []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(e.active))
+	for _, a := range e.active {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Rule < alerts[j].Rule
+	})
+	return alerts
+}
+
+// value returns the value the rule is compared with.
+// It reports false when the metric is unknown or, for rate rules, there is no previous sample yet.
+func (e *Evaluator) value(rule Rule, now time.Time, data model.Data) (float64, bool) {
+	m, ok := data[rule.MType][rule.Metric]
+	if !ok {
+		return 0, false
+	}
+
+	var v float64
+	switch {
+	case m.Value != nil:
+		v = *m.Value
+	case m.Delta != nil:
+		v = float64(*m.Delta)
+	default:
+		return 0, false
+	}
+
+	if rule.Func != funcRate {
+		return v, true
+	}
+
+	prev, ok := e.last[rule.Expr]
+	e.last[rule.Expr] = sample{value: v, ts: now}
+	elapsed := now.Sub(prev.ts).Seconds()
+	if !ok || elapsed <= 0 {
+		return 0, false
+	}
+	delta := v - prev.value
+	if delta < 0 {
+		// the counter has been reset
+		delta = v
+	}
+	return delta / elapsed, true
+}
@@ -0,0 +1,115 @@
+package alert_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v-starostin/go-metrics/internal/alert"
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := alert.ParseRule("gauge HeapAlloc > 500e6 for 2m")
+	require.NoError(t, err)
+	assert.Equal(t, alert.Rule{
+		Expr:      "gauge HeapAlloc > 500e6 for 2m",
+		MType:     "gauge",
+		Metric:    "HeapAlloc",
+		Op:        ">",
+		Threshold: 500e6,
+		For:       2 * time.Minute,
+	}, rule)
+
+	rule, err = alert.ParseRule("rate(counter PollCount) == 0 for 1m")
+	require.NoError(t, err)
+	assert.Equal(t, "rate", rule.Func)
+	assert.Equal(t, "counter", rule.MType)
+	assert.Equal(t, "PollCount", rule.Metric)
+	assert.Equal(t, "==", rule.Op)
+	assert.Equal(t, time.Minute, rule.For)
+
+	for _, expr := range []string{
+		"",
+		"histogram Latency > 1",
+		"gauge HeapAlloc >> 1",
+		"gauge HeapAlloc > lots",
+		"gauge HeapAlloc > 1 for ever",
+		"rate(counter PollCount == 0",
+	} {
+		_, err := alert.ParseRule(expr)
+		assert.ErrorIs(t, err, alert.ErrParseRule, expr)
+	}
+}
+
+func TestEvaluator(t *testing.T) {
+	rule, err := alert.ParseRule("gauge HeapAlloc > 100 for 2m")
+	require.NoError(t, err)
+	e := alert.NewEvaluator([]alert.Rule{rule})
+
+	gauge := func(v float64) model.Data {
+		return model.Data{"gauge": {"HeapAlloc": {ID: "HeapAlloc", MType: "gauge", Value: &v}}}
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	changed := e.Eval(start, gauge(50))
+	assert.Empty(t, changed)
+
+	changed = e.Eval(start.Add(time.Minute), gauge(150))
+	require.Len(t, changed, 1)
+	assert.Equal(t, alert.StatePending, changed[0].State)
+
+	changed = e.Eval(start.Add(2*time.Minute), gauge(160))
+	assert.Empty(t, changed)
+	require.Len(t, e.Active(), 1)
+	assert.Equal(t, 160.0, e.Active()[0].Value)
+
+	changed = e.Eval(start.Add(3*time.Minute), gauge(170))
+	require.Len(t, changed, 1)
+	assert.Equal(t, alert.StateFiring, changed[0].State)
+	assert.Equal(t, start.Add(time.Minute), changed[0].ActiveAt)
+
+	changed = e.Eval(start.Add(4*time.Minute), gauge(10))
+	require.Len(t, changed, 1)
+	assert.Equal(t, alert.StateResolved, changed[0].State)
+	assert.Empty(t, e.Active())
+}
+
+func TestEvaluatorPendingDropped(t *testing.T) {
+	rule, err := alert.ParseRule("gauge HeapAlloc > 100 for 2m")
+	require.NoError(t, err)
+	e := alert.NewEvaluator([]alert.Rule{rule})
+
+	v := 150.0
+	e.Eval(time.Now(), model.Data{"gauge": {"HeapAlloc": {Value: &v}}})
+	require.Len(t, e.Active(), 1)
+
+	changed := e.Eval(time.Now(), model.Data{})
+	assert.Empty(t, changed)
+	assert.Empty(t, e.Active())
+}
+
+func TestEvaluatorRate(t *testing.T) {
+	rule, err := alert.ParseRule("rate(counter PollCount) == 0")
+	require.NoError(t, err)
+	e := alert.NewEvaluator([]alert.Rule{rule})
+
+	counter := func(d int64) model.Data {
+		return model.Data{"counter": {"PollCount": {ID: "PollCount", MType: "counter", Delta: &d}}}
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Empty(t, e.Eval(start, counter(10)))
+	assert.Empty(t, e.Eval(start.Add(10*time.Second), counter(20)))
+
+	changed := e.Eval(start.Add(20*time.Second), counter(20))
+	require.Len(t, changed, 1)
+	assert.Equal(t, alert.StateFiring, changed[0].State)
+
+	changed = e.Eval(start.Add(30*time.Second), counter(25))
+	require.Len(t, changed, 1)
+	assert.Equal(t, alert.StateResolved, changed[0].State)
+	assert.Equal(t, 0.5, changed[0].Value)
+}
@@ -0,0 +1,149 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receiver is a webhook that gets alert notifications.
+// When Key is set, the payload is signed with it and the signature is sent in the HashSHA256 header.
+type Receiver struct {
+	URL string
+	Key string
+}
+
+// Notification is the payload posted to the receivers.
+type Notification struct {
+	Status string  `json:"status"`
+	Alerts []Alert `json:"alerts"`
+}
+
+type delivery struct {
+	state string
+	at    time.Time
+}
+
+// Notifier delivers firing and resolved alerts to webhooks.
+// A notification for a rule in the state it has already been reported in
+// is suppressed until the group interval passes.
+type Notifier struct {
+	client        *http.Client
+	receivers     []Receiver
+	groupInterval time.Duration
+
+	mu   sync.Mutex
+	sent map[string]delivery
+}
+
+// NewNotifier creates a new Notifier.
+func NewNotifier(client *http.Client, receivers []Receiver, groupInterval time.Duration) *Notifier {
+	return &Notifier{
+		client:        client,
+		receivers:     receivers,
+		groupInterval: groupInterval,
+		sent:          make(map[string]delivery),
+	}
+}
+
+// ParseReceiver parses a receiver written as the webhook URL optionally followed by a space and the signing key.
+func ParseReceiver(s string) (Receiver, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return Receiver{}, fmt.Errorf("bad alert receiver: %q", s)
+	}
+	r := Receiver{URL: fields[0]}
+	if len(fields) == 2 {
+		r.Key = fields[1]
+	}
+	return r, nil
+}
+
+// ParseReceivers parses a list of receivers.
+func ParseReceivers(list []string) ([]Receiver, error) {
+	receivers := make([]Receiver, 0, len(list))
+	for _, s := range list {
+		r, err := ParseReceiver(s)
+		if err != nil {
+			return nil, err
+		}
+		receivers = append(receivers, r)
+	}
+	return receivers, nil
+}
+
+// Receivers returns the configured receivers.
+func (n *Notifier) Receivers() []Receiver {
+	return n.receivers
+}
+
+// Dedup returns the alerts that should be delivered at the moment now.
+// Pending alerts are never delivered.
+func (n *Notifier) Dedup(now time.Time, alerts []Alert) []Alert {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	result := make([]Alert, 0, len(alerts))
+	for _, a := range alerts {
+		if a.State == StatePending {
+			continue
+		}
+		last, ok := n.sent[a.Rule]
+		if ok && last.state == a.State && now.Sub(last.at) < n.groupInterval {
+			continue
+		}
+		n.sent[a.Rule] = delivery{state: a.State, at: now}
+		result = append(result, a)
+	}
+	return result
+}
+
+// Send posts the alerts to the receiver.
+func (n *Notifier) Send(ctx context.Context, r Receiver, alerts []Alert) error {
+	status := StateResolved
+	for _, a := range alerts {
+		if a.State == StateFiring {
+			status = StateFiring
+			break
+		}
+	}
+
+	body, err := json.Marshal(Notification{Status: status, Alerts: alerts})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Key != "" {
+		req.Header.Set("HashSHA256", sign(body, r.Key))
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver %s responded with status %d", r.URL, res.StatusCode)
+	}
+	return nil
+}
+
+func sign(b []byte, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
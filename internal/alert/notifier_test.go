@@ -0,0 +1,89 @@
+package alert_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v-starostin/go-metrics/internal/alert"
+)
+
+func TestParseReceiver(t *testing.T) {
+	r, err := alert.ParseReceiver("http://localhost:9093/hook secret")
+	require.NoError(t, err)
+	assert.Equal(t, alert.Receiver{URL: "http://localhost:9093/hook", Key: "secret"}, r)
+
+	r, err = alert.ParseReceiver("http://localhost:9093/hook")
+	require.NoError(t, err)
+	assert.Empty(t, r.Key)
+
+	_, err = alert.ParseReceiver("http://localhost:9093/hook secret extra")
+	assert.Error(t, err)
+}
+
+func TestNotifierDedup(t *testing.T) {
+	n := alert.NewNotifier(http.DefaultClient, nil, 5*time.Minute)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	pending := alert.Alert{Rule: "gauge HeapAlloc > 1", State: alert.StatePending}
+	firing := alert.Alert{Rule: "gauge HeapAlloc > 1", State: alert.StateFiring}
+	resolved := alert.Alert{Rule: "gauge HeapAlloc > 1", State: alert.StateResolved}
+
+	assert.Empty(t, n.Dedup(now, []alert.Alert{pending}))
+	assert.Equal(t, []alert.Alert{firing}, n.Dedup(now, []alert.Alert{firing}))
+	assert.Empty(t, n.Dedup(now.Add(time.Minute), []alert.Alert{firing}))
+	assert.Equal(t, []alert.Alert{resolved}, n.Dedup(now.Add(2*time.Minute), []alert.Alert{resolved}))
+	assert.Equal(t, []alert.Alert{firing}, n.Dedup(now.Add(3*time.Minute), []alert.Alert{firing}))
+	assert.Equal(t, []alert.Alert{firing}, n.Dedup(now.Add(9*time.Minute), []alert.Alert{firing}))
+}
+
+func TestNotifierSend(t *testing.T) {
+	var body []byte
+	var hash string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		hash = r.Header.Get("HashSHA256")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	n := alert.NewNotifier(srv.Client(), nil, time.Minute)
+	alerts := []alert.Alert{{Rule: "gauge HeapAlloc > 1", Metric: "HeapAlloc", State: alert.StateFiring, Value: 2}}
+
+	err := n.Send(context.Background(), alert.Receiver{URL: srv.URL, Key: "secret"}, alerts)
+	require.NoError(t, err)
+
+	var notification alert.Notification
+	require.NoError(t, json.Unmarshal(body, &notification))
+	assert.Equal(t, alert.StateFiring, notification.Status)
+	assert.Len(t, notification.Alerts, 1)
+
+	h := hmac.New(sha256.New, []byte("secret"))
+	h.Write(body)
+	assert.Equal(t, hex.EncodeToString(h.Sum(nil)), hash)
+
+	err = n.Send(context.Background(), alert.Receiver{URL: srv.URL + "/hook"}, alerts)
+	require.NoError(t, err)
+	assert.Empty(t, hash)
+}
+
+func TestNotifierSendError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	n := alert.NewNotifier(srv.Client(), nil, time.Minute)
+	err := n.Send(context.Background(), alert.Receiver{URL: srv.URL}, []alert.Alert{{State: alert.StateResolved}})
+	assert.Error(t, err)
+}
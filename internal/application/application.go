@@ -3,12 +3,15 @@ package application
 import (
 	"context"
 	"crypto/rsa"
+	"crypto/tls"
 	"database/sql"
 	"errors"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -20,12 +23,20 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"github.com/v-starostin/go-metrics/internal/alert"
 	"github.com/v-starostin/go-metrics/internal/config"
 	"github.com/v-starostin/go-metrics/internal/crypto"
 	"github.com/v-starostin/go-metrics/internal/handler"
+	"github.com/v-starostin/go-metrics/internal/keys"
 	"github.com/v-starostin/go-metrics/internal/repository"
+	"github.com/v-starostin/go-metrics/internal/rpc"
+	"github.com/v-starostin/go-metrics/internal/selfmetrics"
 	"github.com/v-starostin/go-metrics/internal/service"
+	"github.com/v-starostin/go-metrics/internal/statsd"
+	pb "github.com/v-starostin/go-metrics/proto"
 )
 
 var (
@@ -34,9 +45,17 @@ var (
 	BuildCommit  string
 )
 
+// Database DSN schemes selecting the embedded storages, any other DSN is used to connect to Postgres.
+const (
+	sqliteScheme = "sqlite://"
+	boltScheme   = "bolt://"
+)
+
 type Server struct {
-	srv    *http.Server
-	logger *zerolog.Logger
+	srv       *http.Server
+	grpcSrv   *grpc.Server
+	logger    *zerolog.Logger
+	tlsConfig *tls.Config
 }
 
 func NewServer(l *zerolog.Logger, addr string) *Server {
@@ -46,34 +65,99 @@ func NewServer(l *zerolog.Logger, addr string) *Server {
 	}
 }
 
-func (s *Server) RegisterHandlers(ctx context.Context, srv handler.Service, key string, privateKey *rsa.PrivateKey) {
+// RegisterHandlers sets up the routes.
+// When strict is set, all the write routes, remote write included, require a valid signature.
+func (s *Server) RegisterHandlers(ctx context.Context, srv handler.Service, key string, checker *handler.HashChecker, strict bool, privateKey *rsa.PrivateKey, trustedSubnet *net.IPNet, metrics *selfmetrics.Registry, streamBuffer int) {
 	getMetricHandler := handler.NewGetMetric(ctx, s.logger, srv, key)
 	getMetricsHandler := handler.NewGetMetrics(ctx, s.logger, srv, key)
 	getMetricV2Handler := handler.NewGetMetricV2(ctx, s.logger, srv, key)
 	postMetricHandler := handler.NewPostMetric(ctx, s.logger, srv)
 	postMetricV2Handler := handler.NewPostMetricV2(ctx, s.logger, srv)
-	postMetrics := handler.NewPostMetrics(ctx, s.logger, srv, privateKey)
+	postMetrics := handler.NewPostMetrics(ctx, s.logger, srv, privateKey, metrics)
 	pingStorage := handler.NewPingStorage(ctx, s.logger, srv)
+	getHistory := handler.NewGetHistory(ctx, s.logger, srv)
+	getAlerts := handler.NewGetAlerts(ctx, s.logger, srv)
+	getSeries := handler.NewGetSeries(ctx, s.logger, srv)
+	getPrometheusMetrics := handler.NewGetPrometheusMetrics(ctx, s.logger, srv)
+	postRemoteWrite := handler.NewPostRemoteWrite(ctx, s.logger, srv)
+	getSelfMetrics := handler.NewGetSelfMetrics(metrics)
+	listMetrics := handler.NewListMetrics(ctx, s.logger, srv)
+	getMetricValues := handler.NewGetMetricValues(ctx, s.logger, srv, key)
+	getStream := handler.NewGetStream(ctx, s.logger, srv, streamBuffer, metrics)
+
+	// the hash is checked before decompression since the body is signed as it is sent
+	common := []func(http.Handler) http.Handler{
+		middleware.Compress(5, "text/html", "application/json"),
+		handler.Decompress(s.logger),
+		middleware.Recoverer,
+	}
 
 	r := chi.NewRouter()
 	r.Route("/", func(r chi.Router) {
 		r.Use(middleware.RequestLogger(&handler.LogFormatter{Logger: s.logger}))
-		r.Use(handler.CheckHash(key))
-		r.Use(middleware.Compress(5, "text/html", "application/json"))
-		r.Use(handler.Decompress(s.logger))
-		r.Use(middleware.Recoverer)
-		r.Method(http.MethodPost, "/update/{type}/{name}/{value}", postMetricHandler)
-		r.Method(http.MethodGet, "/value/{type}/{name}", getMetricHandler)
-		r.Method(http.MethodGet, "/", getMetricsHandler)
-		r.Method(http.MethodPost, "/updates/", postMetrics)
-		r.Method(http.MethodPost, "/update/", postMetricV2Handler)
-		r.Method(http.MethodPost, "/value/", getMetricV2Handler)
-		r.Method(http.MethodGet, "/ping", pingStorage)
+		r.Use(handler.Instrument(metrics))
+		r.Group(func(r chi.Router) {
+			r.Use(handler.TrustedSubnet(trustedSubnet))
+			r.Use(checker.Check(strict))
+			r.Use(common...)
+			r.Method(http.MethodPost, "/update/{type}/{name}/{value}", postMetricHandler)
+			r.Method(http.MethodPost, "/updates/", postMetrics)
+			r.Method(http.MethodPost, "/update/", postMetricV2Handler)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(handler.TrustedSubnet(trustedSubnet))
+			r.Use(checker.Check(strict))
+			r.Use(common...)
+			r.Method(http.MethodPost, "/api/v1/write", postRemoteWrite)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(checker.Check(false))
+			r.Use(common...)
+			r.Method(http.MethodGet, "/value/{type}/{name}", getMetricHandler)
+			r.Method(http.MethodGet, "/", getMetricsHandler)
+			r.Method(http.MethodPost, "/value/", getMetricV2Handler)
+			r.Method(http.MethodPost, "/values/", getMetricValues)
+			r.Method(http.MethodGet, "/ping", pingStorage)
+			r.Method(http.MethodGet, "/history/{type}/{name}", getHistory)
+			r.Method(http.MethodGet, "/alerts", getAlerts)
+			r.Method(http.MethodGet, "/series/{type}/{name}", getSeries)
+			r.Method(http.MethodGet, "/metrics", getPrometheusMetrics)
+			r.Method(http.MethodGet, "/admin/metrics", getSelfMetrics)
+			r.Method(http.MethodGet, "/api/metrics", listMetrics)
+		})
+		// the events are flushed as they come, so the stream is neither compressed nor buffered
+		r.Group(func(r chi.Router) {
+			r.Use(checker.Check(false))
+			r.Use(middleware.Recoverer)
+			r.Method(http.MethodGet, "/stream", getStream)
+		})
 	})
 
 	s.srv.Handler = r
 }
 
+// SetTLS makes the servers accept TLS connections only.
+// It must be called before RegisterGRPC.
+func (s *Server) SetTLS(cfg *tls.Config) {
+	s.srv.TLSConfig = cfg
+	s.tlsConfig = cfg
+}
+
+// RegisterGRPC sets up the gRPC server.
+// When strict is set, the Update calls require a valid signature, as the HTTP write routes do.
+func (s *Server) RegisterGRPC(srv rpc.Service, checker *handler.HashChecker, strict bool, trustedSubnet *net.IPNet) {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(
+		rpc.LogRequests(s.logger),
+		rpc.TrustedSubnet(trustedSubnet, pb.MetricsService_Update_FullMethodName),
+		rpc.CheckHash(checker, strict, pb.MetricsService_Update_FullMethodName),
+	)}
+	if s.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+	s.grpcSrv = grpc.NewServer(opts...)
+	pb.RegisterMetricsServiceServer(s.grpcSrv, rpc.NewMetricsServer(s.logger, srv))
+}
+
 func ConnectDB(cfg *config.Config) (*sql.DB, error) {
 	db, err := sql.Open("pgx", cfg.DatabaseDNS)
 	if err != nil {
@@ -113,9 +197,42 @@ func Run() {
 		return
 	}
 
+	rules, err := alert.ParseRules(cfg.AlertRules)
+	if err != nil {
+		logger.Error().Err(err).Msg("Alert rules error")
+		return
+	}
+	receivers, err := alert.ParseReceivers(cfg.AlertWebhooks)
+	if err != nil {
+		logger.Error().Err(err).Msg("Alert receivers error")
+		return
+	}
+	var notifier *alert.Notifier
+	if len(receivers) > 0 {
+		client := &http.Client{Timeout: 10 * time.Second}
+		notifier = alert.NewNotifier(client, receivers, time.Duration(cfg.AlertGroupInterval)*time.Second)
+	}
+
 	var repo service.Repository
 	var db *sql.DB
-	if cfg.DatabaseDNS != "" {
+	switch {
+	case strings.HasPrefix(cfg.DatabaseDNS, sqliteScheme):
+		s, err := repository.NewSQLiteStorage(&logger, strings.TrimPrefix(cfg.DatabaseDNS, sqliteScheme))
+		if err != nil {
+			logger.Error().Err(err).Msg("SQLite initializing error")
+			return
+		}
+		defer s.Close()
+		repo = s
+	case strings.HasPrefix(cfg.DatabaseDNS, boltScheme):
+		s, err := repository.NewBoltStorage(&logger, strings.TrimPrefix(cfg.DatabaseDNS, boltScheme))
+		if err != nil {
+			logger.Error().Err(err).Msg("bbolt initializing error")
+			return
+		}
+		defer s.Close()
+		repo = s
+	case cfg.DatabaseDNS != "":
 		db, err = ConnectDB(&cfg)
 		if err != nil {
 			logger.Error().Err(err).Msg("DB initializing error")
@@ -123,8 +240,16 @@ func Run() {
 		}
 		defer db.Close()
 		repo = repository.NewStorage(&logger, db)
-	} else {
-		repo = repository.NewMemStorage(&logger, *cfg.StoreInterval, cfg.FileStoragePath)
+	default:
+		s := repository.NewMemStorage(&logger, *cfg.StoreInterval, cfg.FileStoragePath)
+		if cfg.WALFsync != "" {
+			if err := s.SetFsync(cfg.WALFsync); err != nil {
+				logger.Error().Err(err).Msg("Storage initializing error")
+				return
+			}
+		}
+		defer s.Close()
+		repo = s
 	}
 	var privateKey *rsa.PrivateKey
 	if cfg.CryptoKey != "" {
@@ -135,22 +260,82 @@ func Run() {
 		}
 	}
 
+	var trustedSubnet *net.IPNet
+	if cfg.TrustedSubnet != "" {
+		_, trustedSubnet, err = net.ParseCIDR(cfg.TrustedSubnet)
+		if err != nil {
+			logger.Error().Err(err).Msg("Invalid trusted subnet")
+			return
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCert != "" {
+		tlsConfig, err = crypto.ServerTLSConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			logger.Error().Err(err).Msg("Error to load TLS config")
+			return
+		}
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	defer stop()
 
 	svc := service.New(&logger, repo)
 	server := NewServer(&logger, cfg.ServerAddress)
-	server.RegisterHandlers(ctx, svc, cfg.Key, privateKey)
+	if tlsConfig != nil {
+		server.SetTLS(tlsConfig)
+	}
+	loadKeys := func(ctx context.Context) ([]keys.Key, error) {
+		var result []keys.Key
+		if cfg.KeysFile != "" {
+			k, err := keys.LoadFile(cfg.KeysFile)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, k...)
+		}
+		if db != nil {
+			k, err := keys.LoadDB(ctx, db)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, k...)
+		}
+		return result, nil
+	}
+	agentKeys, err := loadKeys(ctx)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error to load agent keys")
+		return
+	}
+	registry := keys.NewRegistry(agentKeys)
+	go registry.Watch(ctx, &logger, loadKeys, time.Minute)
+
+	selfMetrics := selfmetrics.NewRegistry()
+	checker := handler.NewHashChecker(cfg.Key, registry, handler.NewReplayGuard(time.Duration(cfg.ReplayWindow)*time.Second), selfMetrics)
+	strict := cfg.StrictHash && (cfg.Key != "" || registry.Len() > 0)
+
+	svc.SetRetryCounter(selfMetrics.Counter("storage_retries", nil))
+
+	server.RegisterHandlers(ctx, svc, cfg.Key, checker, strict, privateKey, trustedSubnet, selfMetrics, cfg.StreamBuffer)
+	if cfg.GRPCAddress != "" {
+		server.RegisterGRPC(svc, checker, strict, trustedSubnet)
+	}
 
 	f := handler.NewFile1(svc)
 
 	if *cfg.Restore {
 		if err := f.RestoreFromFile(); err != nil {
 			logger.Error().Err(err).Msg("Failed to restore storage from file")
+		} else {
+			logger.Info().Msg("Storage has been restored from file")
 		}
-		logger.Info().Msg("Storage has been restored from file")
 	}
 
+	// started after the restore, so that it does not overwrite the server metrics flushed already
+	go selfmetrics.Run(ctx, &logger, selfMetrics, svc, time.Duration(cfg.SelfMetricsInterval)*time.Second)
+
 	if *cfg.StoreInterval > 0 {
 		ticker := time.NewTicker(time.Duration(*cfg.StoreInterval) * time.Second)
 
@@ -170,10 +355,26 @@ func Run() {
 		}()
 	}
 
+	if len(rules) > 0 {
+		go svc.RunAlerts(ctx, rules, notifier, time.Duration(cfg.AlertInterval)*time.Second)
+	}
+
+	if cfg.StatsdAddress != "" {
+		listener := statsd.NewListener(&logger, svc, cfg.StatsdAddress, time.Duration(cfg.StatsdFlushInterval)*time.Second)
+		if err := listener.Listen(); err != nil {
+			logger.Error().Err(err).Msg("StatsD listen error")
+			return
+		}
+		go listener.Serve(ctx)
+	}
+
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 
 	go server.ListenAndServe(&cfg)
+	if cfg.GRPCAddress != "" {
+		go server.ListenAndServeGRPC(&cfg)
+	}
 	go server.HandleShutdown(ctx, wg, f, cfg.DatabaseDNS != "")
 
 	wg.Wait()
@@ -181,12 +382,31 @@ func Run() {
 
 func (s *Server) ListenAndServe(cfg *config.Config) {
 	s.logger.Info().Msgf("Server is listerning on %s", cfg.ServerAddress)
-	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	var err error
+	if s.srv.TLSConfig != nil {
+		// the certificate is already loaded into TLSConfig
+		err = s.srv.ListenAndServeTLS("", "")
+	} else {
+		err = s.srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		s.logger.Error().Err(err).Msg("Server error")
 		return
 	}
 }
 
+func (s *Server) ListenAndServeGRPC(cfg *config.Config) {
+	listen, err := net.Listen("tcp", cfg.GRPCAddress)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("gRPC listen error")
+		return
+	}
+	s.logger.Info().Msgf("gRPC server is listerning on %s", cfg.GRPCAddress)
+	if err := s.grpcSrv.Serve(listen); err != nil {
+		s.logger.Error().Err(err).Msg("gRPC server error")
+	}
+}
+
 func (s *Server) HandleShutdown(ctx context.Context, wg *sync.WaitGroup, f *handler.File, dbEnabled bool) {
 	defer wg.Done()
 
@@ -202,6 +422,10 @@ func (s *Server) HandleShutdown(ctx context.Context, wg *sync.WaitGroup, f *hand
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	if s.grpcSrv != nil {
+		s.grpcSrv.GracefulStop()
+	}
+
 	if err := s.srv.Shutdown(ctx); err != nil {
 		s.logger.Error().Err(err).Msg("Shutdown server error")
 		return
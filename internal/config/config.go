@@ -9,17 +9,38 @@ import (
 )
 
 type Config struct {
-	ServerAddress   string `env:"ADDRESS"`
-	ReportInterval  int    `env:"REPORT_INTERVAL"`
-	PollInterval    int    `env:"POLL_INTERVAL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	Restore         *bool  `env:"RESTORE"`
-	StoreInterval   *int   `env:"STORE_INTERVAL"`
-	DatabaseDNS     string `env:"DATABASE_DSN"`
-	Key             string `env:"KEY"`
-	RateLimit       int    `env:"RATE_LIMIT"`
-	CryptoKey       string `env:"CRYPTO_KEY"`
-	JSONConfigPath  string `env:"CONFIG"`
+	ServerAddress       string   `env:"ADDRESS"`
+	ReportInterval      int      `env:"REPORT_INTERVAL"`
+	PollInterval        int      `env:"POLL_INTERVAL"`
+	FileStoragePath     string   `env:"FILE_STORAGE_PATH"`
+	Restore             *bool    `env:"RESTORE"`
+	StoreInterval       *int     `env:"STORE_INTERVAL"`
+	DatabaseDNS         string   `env:"DATABASE_DSN"`
+	Key                 string   `env:"KEY"`
+	RateLimit           int      `env:"RATE_LIMIT"`
+	CryptoKey           string   `env:"CRYPTO_KEY"`
+	JSONConfigPath      string   `env:"CONFIG"`
+	GRPCAddress         string   `env:"GRPC_ADDRESS"`
+	AlertRules          []string `env:"ALERT_RULES" envSeparator:";"`
+	AlertInterval       int      `env:"ALERT_INTERVAL"`
+	AlertWebhooks       []string `env:"ALERT_WEBHOOKS" envSeparator:";"`
+	AlertGroupInterval  int      `env:"ALERT_GROUP_INTERVAL"`
+	StatsdAddress       string   `env:"STATSD_ADDRESS"`
+	StatsdFlushInterval int      `env:"STATSD_FLUSH_INTERVAL"`
+	SpoolDir            string   `env:"SPOOL_DIR"`
+	SpoolSize           int      `env:"SPOOL_SIZE"`
+	TLSCert             string   `env:"TLS_CERT"`
+	TLSKey              string   `env:"TLS_KEY"`
+	TLSCA               string   `env:"TLS_CA"`
+	TLSClientCA         string   `env:"TLS_CLIENT_CA"`
+	TrustedSubnet       string   `env:"TRUSTED_SUBNET" json:"trusted_subnet"`
+	KeyID               string   `env:"KEY_ID"`
+	KeysFile            string   `env:"KEYS_FILE"`
+	StrictHash          bool     `env:"STRICT_HASH"`
+	ReplayWindow        int      `env:"REPLAY_WINDOW"`
+	SelfMetricsInterval int      `env:"SELF_METRICS_INTERVAL"`
+	StreamBuffer        int      `env:"STREAM_BUFFER"`
+	WALFsync            string   `env:"WAL_FSYNC"`
 }
 
 func NewAgent() (Config, error) {
@@ -78,6 +99,13 @@ func parseAgentFlags() Config {
 	rateLimit := flag.Int("l", 0, "rate limit")
 	cryptoKey := flag.String("crypto-key", "", "Path to the public key")
 	cfg := flag.String("config", "", "Path to JSON config file")
+	grpcAddress := flag.String("g", "", "gRPC server endpoint address (sends metrics over gRPC when set)")
+	spoolDir := flag.String("spool-dir", "", "directory to keep the metrics that failed to be sent")
+	spoolSize := flag.Int("spool-size", 0, "max number of batches kept in the spool")
+	tlsCert := flag.String("tls-cert", "", "Path to the client certificate (mutual TLS)")
+	tlsKey := flag.String("tls-key", "", "Path to the client certificate key (mutual TLS)")
+	tlsCA := flag.String("tls-ca", "", "Path to the CA bundle to verify the server certificate")
+	keyID := flag.String("key-id", "", "ID of the key (sent along with the signature)")
 	flag.Parse()
 
 	return Config{
@@ -88,29 +116,64 @@ func parseAgentFlags() Config {
 		RateLimit:      *rateLimit,
 		CryptoKey:      *cryptoKey,
 		JSONConfigPath: *cfg,
+		GRPCAddress:    *grpcAddress,
+		SpoolDir:       *spoolDir,
+		SpoolSize:      *spoolSize,
+		TLSCert:        *tlsCert,
+		TLSKey:         *tlsKey,
+		TLSCA:          *tlsCA,
+		KeyID:          *keyID,
 	}
 }
 
 func parseServerFlags() Config {
 	serverAddress := flag.String("a", "", "address and port to run server")
 	fileStoragePath := flag.String("f", "", "file storage path")
-	databaseDSN := flag.String("d", "", "database DSN")
+	databaseDSN := flag.String("d", "", "database DSN: sqlite:///path, bolt:///path or a Postgres DSN")
 	restore := flag.Bool("r", false, "restore")
 	storeInterval := flag.Int("i", 0, "interval")
 	key := flag.String("k", "", "")
 	cryptoKey := flag.String("crypto-key", "", "Path to the private key")
 	cfg := flag.String("config", "", "Path to JSON config file")
+	grpcAddress := flag.String("g", "", "address and port to run gRPC server")
+	alertInterval := flag.Int("alert-interval", 0, "interval to evaluate alert rules (in seconds)")
+	statsdAddress := flag.String("s", "", "address and port to receive StatsD metrics over UDP")
+	statsdFlushInterval := flag.Int("statsd-flush", 0, "interval to flush StatsD metrics to the storage (in seconds)")
+	tlsCert := flag.String("tls-cert", "", "Path to the server certificate (serves HTTPS when set)")
+	tlsKey := flag.String("tls-key", "", "Path to the server certificate key")
+	tlsClientCA := flag.String("tls-client-ca", "", "Path to the CA bundle to verify client certificates (mutual TLS)")
+	trustedSubnet := flag.String("t", "", "CIDR of the agents allowed to write metrics")
+	keysFile := flag.String("keys-file", "", "Path to JSON file with the agent keys")
+	strictHash := flag.Bool("strict-hash", false, "require a valid signature on every write once a key is set")
+	replayWindow := flag.Int("replay-window", 0, "max age of a signed request (in seconds)")
+	selfMetricsInterval := flag.Int("self-metrics-interval", 0, "interval to save the server metrics to the storage (in seconds)")
+	streamBuffer := flag.Int("stream-buffer", 0, "number of updates buffered for every /stream subscriber")
+	walFsync := flag.String("wal-fsync", "", "fsync policy of the storage write-ahead log: always, interval or never (always when store interval is 0, interval otherwise)")
 	flag.Parse()
 
 	return Config{
-		ServerAddress:   *serverAddress,
-		FileStoragePath: *fileStoragePath,
-		DatabaseDNS:     *databaseDSN,
-		Restore:         restore,
-		StoreInterval:   storeInterval,
-		Key:             *key,
-		CryptoKey:       *cryptoKey,
-		JSONConfigPath:  *cfg,
+		ServerAddress:       *serverAddress,
+		FileStoragePath:     *fileStoragePath,
+		DatabaseDNS:         *databaseDSN,
+		Restore:             restore,
+		StoreInterval:       storeInterval,
+		Key:                 *key,
+		CryptoKey:           *cryptoKey,
+		JSONConfigPath:      *cfg,
+		GRPCAddress:         *grpcAddress,
+		AlertInterval:       *alertInterval,
+		StatsdAddress:       *statsdAddress,
+		StatsdFlushInterval: *statsdFlushInterval,
+		TLSCert:             *tlsCert,
+		TLSKey:              *tlsKey,
+		TLSClientCA:         *tlsClientCA,
+		TrustedSubnet:       *trustedSubnet,
+		KeysFile:            *keysFile,
+		StrictHash:          *strictHash,
+		ReplayWindow:        *replayWindow,
+		SelfMetricsInterval: *selfMetricsInterval,
+		StreamBuffer:        *streamBuffer,
+		WALFsync:            *walFsync,
 	}
 }
 
@@ -158,6 +221,69 @@ func mergeConfigs(target, source *Config) {
 	if target.CryptoKey == "" && source.CryptoKey != "" {
 		target.CryptoKey = source.CryptoKey
 	}
+	if target.GRPCAddress == "" && source.GRPCAddress != "" {
+		target.GRPCAddress = source.GRPCAddress
+	}
+	if len(target.AlertRules) == 0 && len(source.AlertRules) != 0 {
+		target.AlertRules = source.AlertRules
+	}
+	if target.AlertInterval == 0 && source.AlertInterval != 0 {
+		target.AlertInterval = source.AlertInterval
+	}
+	if len(target.AlertWebhooks) == 0 && len(source.AlertWebhooks) != 0 {
+		target.AlertWebhooks = source.AlertWebhooks
+	}
+	if target.AlertGroupInterval == 0 && source.AlertGroupInterval != 0 {
+		target.AlertGroupInterval = source.AlertGroupInterval
+	}
+	if target.StatsdAddress == "" && source.StatsdAddress != "" {
+		target.StatsdAddress = source.StatsdAddress
+	}
+	if target.StatsdFlushInterval == 0 && source.StatsdFlushInterval != 0 {
+		target.StatsdFlushInterval = source.StatsdFlushInterval
+	}
+	if target.SpoolDir == "" && source.SpoolDir != "" {
+		target.SpoolDir = source.SpoolDir
+	}
+	if target.SpoolSize == 0 && source.SpoolSize != 0 {
+		target.SpoolSize = source.SpoolSize
+	}
+	if target.TLSCert == "" && source.TLSCert != "" {
+		target.TLSCert = source.TLSCert
+	}
+	if target.TLSKey == "" && source.TLSKey != "" {
+		target.TLSKey = source.TLSKey
+	}
+	if target.TLSCA == "" && source.TLSCA != "" {
+		target.TLSCA = source.TLSCA
+	}
+	if target.TLSClientCA == "" && source.TLSClientCA != "" {
+		target.TLSClientCA = source.TLSClientCA
+	}
+	if target.TrustedSubnet == "" && source.TrustedSubnet != "" {
+		target.TrustedSubnet = source.TrustedSubnet
+	}
+	if target.KeyID == "" && source.KeyID != "" {
+		target.KeyID = source.KeyID
+	}
+	if target.KeysFile == "" && source.KeysFile != "" {
+		target.KeysFile = source.KeysFile
+	}
+	if !target.StrictHash && source.StrictHash {
+		target.StrictHash = source.StrictHash
+	}
+	if target.ReplayWindow == 0 && source.ReplayWindow != 0 {
+		target.ReplayWindow = source.ReplayWindow
+	}
+	if target.SelfMetricsInterval == 0 && source.SelfMetricsInterval != 0 {
+		target.SelfMetricsInterval = source.SelfMetricsInterval
+	}
+	if target.StreamBuffer == 0 && source.StreamBuffer != 0 {
+		target.StreamBuffer = source.StreamBuffer
+	}
+	if target.WALFsync == "" && source.WALFsync != "" {
+		target.WALFsync = source.WALFsync
+	}
 }
 
 func setDefaultValues(config *Config) {
@@ -184,4 +310,25 @@ func setDefaultValues(config *Config) {
 	if config.RateLimit == 0 {
 		config.RateLimit = 1
 	}
+	if config.AlertInterval == 0 {
+		config.AlertInterval = 10
+	}
+	if config.AlertGroupInterval == 0 {
+		config.AlertGroupInterval = 300
+	}
+	if config.StatsdFlushInterval == 0 {
+		config.StatsdFlushInterval = 10
+	}
+	if config.SpoolSize == 0 {
+		config.SpoolSize = 1000
+	}
+	if config.ReplayWindow == 0 {
+		config.ReplayWindow = 300
+	}
+	if config.SelfMetricsInterval == 0 {
+		config.SelfMetricsInterval = 10
+	}
+	if config.StreamBuffer == 0 {
+		config.StreamBuffer = 100
+	}
 }
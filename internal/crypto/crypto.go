@@ -1,12 +1,18 @@
 package crypto
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -56,3 +62,100 @@ func RSAEncrypt(pub *rsa.PublicKey, data []byte) ([]byte, error) {
 func RSADecrypt(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
 	return rsa.DecryptOAEP(sha256.New(), nil, priv, data, nil)
 }
+
+// Envelope format, version 1:
+//
+//	magic (4 bytes) | version (1 byte) | wrapped key length (2 bytes, big endian) |
+//	wrapped key | nonce (12 bytes) | AES-256-GCM ciphertext with tag
+//
+// The data key is random for every payload and is wrapped with RSA-OAEP (SHA-256).
+var envelopeMagic = []byte("GMEV")
+
+const (
+	envelopeVersion = 1
+	dataKeySize     = 32
+)
+
+var ErrEnvelope = errors.New("invalid envelope")
+
+// Encrypt encrypts data of any size with a random AES-GCM data key wrapped by the RSA public key.
+func Encrypt(pub *rsa.PublicKey, data []byte) ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := RSAEncrypt(pub, key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(envelopeMagic)+3+len(wrapped)+len(nonce))
+	header = append(header, envelopeMagic...)
+	header = append(header, envelopeVersion)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+	header = append(header, nonce...)
+
+	// the header is authenticated as additional data
+	return gcm.Seal(header, nonce, data, header), nil
+}
+
+// Decrypt decrypts an envelope produced by Encrypt.
+// Payloads without the envelope header are decrypted as legacy RSA-OAEP payloads.
+func Decrypt(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
+	if !IsEnvelope(data) {
+		return RSADecrypt(priv, data)
+	}
+
+	rest := data[len(envelopeMagic):]
+	if len(rest) < 3 {
+		return nil, ErrEnvelope
+	}
+	if rest[0] != envelopeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrEnvelope, rest[0])
+	}
+	size := int(binary.BigEndian.Uint16(rest[1:3]))
+	rest = rest[3:]
+	if len(rest) < size {
+		return nil, ErrEnvelope
+	}
+
+	key, err := RSADecrypt(priv, rest[:size])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	rest = rest[size:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, ErrEnvelope
+	}
+
+	headerSize := len(data) - len(rest) + gcm.NonceSize()
+	return gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], data[:headerSize])
+}
+
+// IsEnvelope reports whether data starts with the envelope header.
+func IsEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, envelopeMagic)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
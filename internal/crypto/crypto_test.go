@@ -1,10 +1,12 @@
 package crypto_test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"os"
 	"testing"
 
@@ -96,6 +98,72 @@ func TestLoadPublicKey(t *testing.T) {
 	})
 }
 
+func TestEncrypt(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+
+	t.Run("large payload", func(t *testing.T) {
+		data := bytes.Repeat([]byte("metric"), 100000)
+		encrypted, err := crypto.Encrypt(&privateKey.PublicKey, data)
+		if err != nil {
+			t.Fatalf("Expected nil err, got %v", err)
+		}
+		if !crypto.IsEnvelope(encrypted) {
+			t.Fatal("Expected envelope header")
+		}
+
+		decrypted, err := crypto.Decrypt(privateKey, encrypted)
+		if err != nil {
+			t.Fatalf("Expected nil err, got %v", err)
+		}
+		if !bytes.Equal(data, decrypted) {
+			t.Error("Decrypted data does not match")
+		}
+	})
+
+	t.Run("legacy payload", func(t *testing.T) {
+		encrypted, err := crypto.RSAEncrypt(&privateKey.PublicKey, []byte("test"))
+		if err != nil {
+			t.Fatalf("Expected nil err, got %v", err)
+		}
+
+		decrypted, err := crypto.Decrypt(privateKey, encrypted)
+		if err != nil {
+			t.Fatalf("Expected nil err, got %v", err)
+		}
+		if string(decrypted) != "test" {
+			t.Errorf("Expected test, got %s", decrypted)
+		}
+	})
+
+	t.Run("tampered payload", func(t *testing.T) {
+		encrypted, err := crypto.Encrypt(&privateKey.PublicKey, []byte("test"))
+		if err != nil {
+			t.Fatalf("Expected nil err, got %v", err)
+		}
+		encrypted[len(encrypted)-1] ^= 0xff
+
+		if _, err := crypto.Decrypt(privateKey, encrypted); err == nil {
+			t.Fatal("Expected error, but got nil")
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		encrypted, err := crypto.Encrypt(&privateKey.PublicKey, []byte("test"))
+		if err != nil {
+			t.Fatalf("Expected nil err, got %v", err)
+		}
+		encrypted[4] = 2
+
+		_, err = crypto.Decrypt(privateKey, encrypted)
+		if !errors.Is(err, crypto.ErrEnvelope) {
+			t.Fatalf("Expected ErrEnvelope, got %v", err)
+		}
+	})
+}
+
 // Helper function to create a temporary file for testing
 func createTempFile(t *testing.T, content []byte) *os.File {
 	tempFile, err := os.CreateTemp("", "test-private-key-*.pem")
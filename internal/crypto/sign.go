@@ -0,0 +1,29 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Signature returns the HMAC-SHA256 of body.
+// When timestamp or nonce is set, the signed message is `timestamp\nnonce\nbody`, so neither
+// can be changed without breaking the signature.
+func Signature(key, timestamp, nonce string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	if timestamp != "" || nonce != "" {
+		h.Write([]byte(timestamp + "\n" + nonce + "\n"))
+	}
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Nonce returns a random hex string to be signed along with a request.
+func Nonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -28,7 +28,7 @@ func setupRouter() (*chi.Mux, *mock.Service) {
 	getMetricHandler := handler.NewGetMetric(ctx, &l, srv, key)
 	getMetricsHandler := handler.NewGetMetrics(ctx, &l, srv, key)
 	postMetricHandler := handler.NewPostMetric(ctx, &l, srv)
-	postMetricsHandler := handler.NewPostMetrics(ctx, &l, srv, nil)
+	postMetricsHandler := handler.NewPostMetrics(ctx, &l, srv, nil, nil)
 	getMetricV2Handler := handler.NewGetMetricV2(ctx, &l, srv, key)
 	postMetricV2Handler := handler.NewPostMetricV2(ctx, &l, srv)
 	pingStorageHandler := handler.NewPingStorage(ctx, &l, srv)
@@ -245,7 +245,7 @@ func ExampleGetMetric_ServeHTTP_getGaugeMetric_ok() {
 	f := new(float64)
 	*f = 1.23
 	m := &model.Metric{MType: "gauge", ID: "metric1", Value: f}
-	srv.On("GetMetric", ctx, m.MType, m.ID).Once().Return(m, nil)
+	srv.On("GetMetric", ctx, m.MType, m.ID, m.Labels).Once().Return(m, nil)
 
 	r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -268,7 +268,7 @@ func ExampleGetMetric_ServeHTTP_getCounterMetric_ok() {
 	f := new(int64)
 	*f = 1
 	m := &model.Metric{MType: "counter", ID: "metric1", Delta: f}
-	srv.On("GetMetric", ctx, m.MType, m.ID).Once().Return(m, nil)
+	srv.On("GetMetric", ctx, m.MType, m.ID, m.Labels).Once().Return(m, nil)
 
 	r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -291,7 +291,7 @@ func ExampleGetMetric_ServeHTTP_notFound() {
 	f := new(float64)
 	*f = 1.23
 	m := &model.Metric{MType: "gauge", ID: "metric1"}
-	srv.On("GetMetric", ctx, m.MType, m.ID).Once().Return(nil, errors.New("err"))
+	srv.On("GetMetric", ctx, m.MType, m.ID, m.Labels).Once().Return(nil, errors.New("err"))
 
 	r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -362,7 +362,7 @@ func ExampleGetMetricV2_ServeHTTP_ok() {
 	*f = 1.25
 
 	m := &model.Metric{MType: "gauge", ID: "metric1", Value: f}
-	srv.On("GetMetric", ctx, m.MType, m.ID).Once().Return(m, nil)
+	srv.On("GetMetric", ctx, m.MType, m.ID, m.Labels).Once().Return(m, nil)
 
 	r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -400,7 +400,7 @@ func ExampleGetMetricV2_ServeHTTP_notFound() {
 	b := []byte(`{"id": "metric2", "type":"gauge"}`)
 	req, _ := http.NewRequest(http.MethodPost, address+"/value/", bytes.NewReader(b))
 	rr := httptest.NewRecorder()
-	srv.On("GetMetric", ctx, "gauge", "metric2").Once().Return(nil, errors.New("err"))
+	srv.On("GetMetric", ctx, "gauge", "metric2", model.Labels(nil)).Once().Return(nil, errors.New("err"))
 	r.ServeHTTP(rr, req)
 	res := rr.Result()
 	defer res.Body.Close()
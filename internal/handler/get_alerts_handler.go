@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+// GetAlerts is a struct that handles HTTP requests for retrieving active alerts.
+type GetAlerts struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+}
+
+// NewGetAlerts creates a new handler.
+func NewGetAlerts(ctx context.Context, l *zerolog.Logger, srv Service) *GetAlerts {
+	return &GetAlerts{
+		ctx:     ctx,
+		logger:  l,
+		service: srv,
+	}
+}
+
+// ServeHTTP handles HTTP requests for retrieving the pending and firing alerts.
+func (h *GetAlerts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	alerts := h.service.GetAlerts(h.ctx)
+	h.logger.Info().Int("count", len(alerts)).Msg("Active alerts")
+
+	writeResponse(w, http.StatusOK, alerts)
+}
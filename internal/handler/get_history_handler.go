@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// defaultHistoryRange is the range of history returned when the query does not set `from`.
+const defaultHistoryRange = time.Hour
+
+// GetHistory is a struct that handles HTTP requests for retrieving the history of a metric.
+type GetHistory struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+}
+
+// NewGetHistory creates a new handler.
+func NewGetHistory(ctx context.Context, l *zerolog.Logger, srv Service) *GetHistory {
+	return &GetHistory{
+		ctx:     ctx,
+		logger:  l,
+		service: srv,
+	}
+}
+
+// ServeHTTP handles HTTP requests for retrieving the samples of a metric within a time range.
+// The range is set by the `from` and `to` query parameters (RFC 3339 or unix seconds),
+// the optional `step` parameter (Go duration or seconds) downsamples the result, and the optional
+// `labels` parameter (like `{host="a"}`) selects the labelled series.
+func (h *GetHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mtype := chi.URLParam(r, "type")
+	mname := chi.URLParam(r, "name")
+
+	if mtype != service.TypeCounter && mtype != service.TypeGauge {
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	query := r.URL.Query()
+	to, err := parseTime(query.Get("to"), time.Now())
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+	from, err := parseTime(query.Get("from"), to.Add(-defaultHistoryRange))
+	if err != nil || from.After(to) {
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+	step, err := parseStep(query.Get("step"))
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+	labels, err := model.ParseLabels(query.Get("labels"))
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	points, err := h.service.GetHistory(h.ctx, mtype, mname, labels, from, to, step)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("GetHistory method error")
+		writeResponse(w, http.StatusNotFound, model.Error{Error: "Not found"})
+		return
+	}
+
+	writeResponse(w, http.StatusOK, points)
+}
+
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseStep(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
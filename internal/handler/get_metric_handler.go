@@ -3,11 +3,14 @@ package handler
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
 
+	"github.com/v-starostin/go-metrics/internal/alert"
 	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/pubsub"
 	"github.com/v-starostin/go-metrics/internal/service"
 )
 
@@ -15,8 +18,14 @@ import (
 type Service interface {
 	SaveMetric(ctx context.Context, m model.Metric) error
 	SaveMetrics(ctx context.Context, m []model.Metric) error
-	GetMetric(ctx context.Context, mtype, mname string) (*model.Metric, error)
+	GetMetric(ctx context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error)
+	FindMetrics(ctx context.Context, mtype, mname string, matchers []model.Matcher) ([]model.Metric, error)
 	GetMetrics(ctx context.Context) (model.Data, error)
+	GetMetricValues(ctx context.Context, keys []model.Metric) ([]model.MetricValue, error)
+	ListMetrics(ctx context.Context, f model.Filter) ([]model.Metric, int, error)
+	Subscribe(f model.Filter, size int) *pubsub.Subscription
+	GetHistory(ctx context.Context, mtype, mname string, labels model.Labels, from, to time.Time, step time.Duration) ([]model.Point, error)
+	GetAlerts(ctx context.Context) []alert.Alert
 	PingStorage(ctx context.Context) error
 	WriteToFile() error
 	RestoreFromFile() error
@@ -45,7 +54,7 @@ func (h *GetMetric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mtype := chi.URLParam(r, "type")
 	mname := chi.URLParam(r, "name")
 
-	metric, err := h.service.GetMetric(h.ctx, mtype, mname)
+	metric, err := h.service.GetMetric(h.ctx, mtype, mname, nil)
 	if err != nil {
 		writeResponse(w, http.StatusNotFound, model.Error{Error: "Not found"})
 		return
@@ -61,5 +70,7 @@ func (h *GetMetric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeResponse(w, http.StatusOK, *metric.Value)
 	case service.TypeCounter:
 		writeResponse(w, http.StatusOK, *metric.Delta)
+	case service.TypeHistogram:
+		writeResponse(w, http.StatusOK, metric.Histogram)
 	}
 }
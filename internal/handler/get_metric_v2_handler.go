@@ -40,7 +40,7 @@ func (h *GetMetricV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	h.logger.Info().Any("req", req).Msg("Decoded request body")
 
-	res, err := h.service.GetMetric(h.ctx, req.MType, req.ID)
+	res, err := h.service.GetMetric(h.ctx, req.MType, req.ID, req.Labels)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("GetMetric method error")
 		writeResponse(w, http.StatusNotFound, model.Error{Error: "Not found"})
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// maxMetricValues caps the metrics requested at once.
+const maxMetricValues = 1000
+
+// GetMetricValues is a struct that handles HTTP requests for retrieving several metrics at once.
+type GetMetricValues struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+	key     string
+}
+
+// NewGetMetricValues creates a new handler.
+func NewGetMetricValues(ctx context.Context, l *zerolog.Logger, s Service, k string) *GetMetricValues {
+	return &GetMetricValues{
+		ctx:     ctx,
+		logger:  l,
+		service: s,
+		key:     k,
+	}
+}
+
+// ServeHTTP handles HTTP requests with a list of metrics identified by type, name and labels.
+// It responds with an item per requested metric in the same order, the ones that do not exist
+// are marked with `"found": false`. Requests with more than maxMetricValues metrics are rejected.
+func (h *GetMetricValues) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req []model.Metric
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.logger.Error().Err(err).Msg("Invalid incoming data")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+	h.logger.Info().Int("count", len(req)).Msg("Decoded request body")
+	if len(req) > maxMetricValues {
+		h.logger.Error().Int("count", len(req)).Int("max", maxMetricValues).Msg("Too many metrics requested")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	res, err := h.service.GetMetricValues(h.ctx, req)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("GetMetricValues method error")
+		if errors.Is(err, service.ErrParseMetric) {
+			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+			return
+		}
+		writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
+		return
+	}
+
+	if h.key != "" {
+		w.Header().Add("HashSHA256", sign(res, h.key))
+	}
+
+	writeResponse(w, http.StatusOK, res)
+}
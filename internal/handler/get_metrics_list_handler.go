@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// TotalCountHeader is the header carrying the number of metrics satisfying the filter of a paginated list.
+const TotalCountHeader = "X-Total-Count"
+
+// ListMetrics is a struct that handles HTTP requests for listing metrics as JSON.
+type ListMetrics struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+}
+
+// NewListMetrics creates a new handler.
+func NewListMetrics(ctx context.Context, l *zerolog.Logger, srv Service) *ListMetrics {
+	return &ListMetrics{
+		ctx:     ctx,
+		logger:  l,
+		service: srv,
+	}
+}
+
+// ServeHTTP handles HTTP requests for listing the metrics selected by the query parameters:
+// `type` (comma separated), `prefix` and `regex` for the name, `match` for the labels,
+// and `offset` and `limit` for the page. The number of all selected metrics is set in X-Total-Count.
+func (h *ListMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Invalid filter")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	metrics, total, err := h.service.ListMetrics(h.ctx, f)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("ListMetrics method error")
+		writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
+		return
+	}
+
+	w.Header().Set(TotalCountHeader, strconv.Itoa(total))
+	writeResponse(w, http.StatusOK, metrics)
+}
+
+func parseFilter(r *http.Request) (model.Filter, error) {
+	q := r.URL.Query()
+	f := model.Filter{Prefix: q.Get("prefix")}
+
+	if types := q.Get("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			if t != service.TypeGauge && t != service.TypeCounter && t != service.TypeHistogram {
+				return model.Filter{}, service.ErrParseMetric
+			}
+			f.Types = append(f.Types, t)
+		}
+	}
+
+	if expr := q.Get("regex"); expr != "" {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return model.Filter{}, err
+		}
+		f.Regex = re
+	}
+
+	matchers, err := model.ParseMatchers(q.Get("match"))
+	if err != nil {
+		return model.Filter{}, err
+	}
+	f.Matchers = matchers
+
+	if f.Offset, err = parseNonNegative(q.Get("offset")); err != nil {
+		return model.Filter{}, err
+	}
+	if f.Limit, err = parseNonNegative(q.Get("limit")); err != nil {
+		return model.Filter{}, err
+	}
+
+	return f, nil
+}
+
+func parseNonNegative(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, strconv.ErrRange
+	}
+	return n, nil
+}
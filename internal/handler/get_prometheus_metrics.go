@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+const (
+	contentTypeText        = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// GetPrometheusMetrics is a struct that handles Prometheus scrape requests.
+type GetPrometheusMetrics struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+}
+
+// NewGetPrometheusMetrics creates a new handler.
+func NewGetPrometheusMetrics(ctx context.Context, l *zerolog.Logger, srv Service) *GetPrometheusMetrics {
+	return &GetPrometheusMetrics{
+		ctx:     ctx,
+		logger:  l,
+		service: srv,
+	}
+}
+
+// ServeHTTP writes all stored metrics in the Prometheus text exposition format,
+// or in the OpenMetrics format when the client accepts it.
+// The metrics left out because their names collide with others once sanitized are logged.
+func (h *GetPrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := h.service.GetMetrics(h.ctx)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("GetMetrics method error")
+		writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
+		return
+	}
+
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	b, skipped := encodeExposition(data, openMetrics)
+	for _, m := range skipped {
+		h.logger.Warn().
+			Str("type", m.MType).
+			Str("name", m.Key()).
+			Str("family", metricName(m.ID)).
+			Msg("Metric collides with another one in the exposition and is skipped")
+	}
+
+	if openMetrics {
+		w.Header().Add("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Add("Content-Type", contentTypeText)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// typeOrder ranks the types for the metrics with the same ID.
+var typeOrder = map[string]int{service.TypeCounter: 0, service.TypeGauge: 1, service.TypeHistogram: 2}
+
+// encodeExposition writes the metrics grouped into families ordered by name and returns the skipped metrics.
+// Counter samples get the `_total` suffix, histograms are written as cumulative buckets.
+// Different IDs may share a family name once sanitized, e.g. `a.b` and `a_b`. A family then holds
+// the metrics of a single type and a single metric per labels: the ID equal to the family name goes first,
+// then the IDs in lexical order, then the types in typeOrder, and the metrics that do not fit are skipped.
+// The families whose sample names, suffixes included, are taken by a family ordered before them are skipped too.
+func encodeExposition(data model.Data, openMetrics bool) ([]byte, []model.Metric) {
+	type entry struct {
+		name string
+		m    model.Metric
+	}
+	entries := make([]entry, 0)
+	for _, mtype := range []string{service.TypeCounter, service.TypeGauge, service.TypeHistogram} {
+		for _, m := range data[mtype] {
+			entries = append(entries, entry{name: metricName(m.ID), m: m})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if exactA, exactB := a.m.ID == a.name, b.m.ID == b.name; exactA != exactB {
+			return exactA
+		}
+		if a.m.ID != b.m.ID {
+			return a.m.ID < b.m.ID
+		}
+		if a.m.MType != b.m.MType {
+			return typeOrder[a.m.MType] < typeOrder[b.m.MType]
+		}
+		return a.m.Labels.String() < b.m.Labels.String()
+	})
+
+	families := make(map[string][]model.Metric)
+	types := make(map[string]string)
+	series := make(map[string]bool)
+	skipped := make([]model.Metric, 0)
+	for _, e := range entries {
+		if t, ok := types[e.name]; ok && t != e.m.MType {
+			// a family name can only have one type
+			skipped = append(skipped, e.m)
+			continue
+		}
+		key := e.name + e.m.Labels.String()
+		if series[key] {
+			skipped = append(skipped, e.m)
+			continue
+		}
+		series[key] = true
+		types[e.name] = e.m.MType
+		families[e.name] = append(families[e.name], e.m)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the families must not share the names of their samples either, e.g. a counter `a` and a gauge `a_total`,
+	// the family that comes first keeps them and the other one is skipped
+	reserved := make(map[string]bool)
+	kept := names[:0]
+	for _, name := range names {
+		generated := sampleNames(name, types[name])
+		if slices.ContainsFunc(generated, func(n string) bool { return reserved[n] }) {
+			skipped = append(skipped, families[name]...)
+			continue
+		}
+		for _, n := range generated {
+			reserved[n] = true
+		}
+		kept = append(kept, name)
+	}
+	names = kept
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		metrics := families[name]
+		sort.Slice(metrics, func(i, j int) bool {
+			return metrics[i].Labels.String() < metrics[j].Labels.String()
+		})
+
+		mtype := types[name]
+		family := name
+		if mtype == service.TypeCounter && !openMetrics {
+			family = name + "_total"
+		}
+		buf.WriteString("# TYPE " + family + " " + mtype + "\n")
+
+		for _, m := range metrics {
+			switch mtype {
+			case service.TypeCounter:
+				if m.Delta != nil {
+					writeSample(&buf, name+"_total", m.Labels, "", "", float64(*m.Delta))
+				}
+			case service.TypeGauge:
+				if m.Value != nil {
+					writeSample(&buf, name, m.Labels, "", "", *m.Value)
+				}
+			case service.TypeHistogram:
+				if m.Histogram != nil {
+					writeHistogram(&buf, name, m.Labels, m.Histogram)
+				}
+			}
+		}
+	}
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+
+	return buf.Bytes(), skipped
+}
+
+// sampleNames returns the family name along with the names of the samples written for a family of mtype.
+func sampleNames(name, mtype string) []string {
+	switch mtype {
+	case service.TypeCounter:
+		return []string{name, name + "_total"}
+	case service.TypeHistogram:
+		return []string{name, name + "_bucket", name + "_sum", name + "_count"}
+	}
+	return []string{name}
+}
+
+func writeHistogram(buf *bytes.Buffer, name string, labels model.Labels, h *model.Histogram) {
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		writeSample(buf, name+"_bucket", labels, "le", formatFloat(bound), float64(cumulative))
+	}
+	writeSample(buf, name+"_bucket", labels, "le", "+Inf", float64(h.Count))
+	writeSample(buf, name+"_sum", labels, "", "", h.Sum)
+	writeSample(buf, name+"_count", labels, "", "", float64(h.Count))
+}
+
+// writeSample writes a sample line, the extra label (e.g. `le`) is appended after the metric labels.
+func writeSample(buf *bytes.Buffer, name string, labels model.Labels, extraName, extraValue string, v float64) {
+	names := make([]string, 0, len(labels))
+	for l := range labels {
+		if l != extraName {
+			names = append(names, l)
+		}
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names)+1)
+	for _, l := range names {
+		pairs = append(pairs, l+`="`+escapeLabelValue(labels[l])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+
+	buf.WriteString(name)
+	if len(pairs) > 0 {
+		buf.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	buf.WriteString(" " + formatFloat(v) + "\n")
+}
+
+// metricName replaces the characters that are not allowed in Prometheus metric names with underscores.
+func metricName(id string) string {
+	var b strings.Builder
+	for i, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/v-starostin/go-metrics/internal/selfmetrics"
+)
+
+// GetSelfMetrics is a struct that handles scrape requests for the metrics of the server itself.
+type GetSelfMetrics struct {
+	metrics *selfmetrics.Registry
+}
+
+// NewGetSelfMetrics creates a new handler.
+func NewGetSelfMetrics(metrics *selfmetrics.Registry) *GetSelfMetrics {
+	return &GetSelfMetrics{metrics: metrics}
+}
+
+// ServeHTTP writes the server metrics in the same formats as GetPrometheusMetrics.
+func (h *GetSelfMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	b, _ := encodeExposition(h.metrics.Snapshot(), openMetrics)
+
+	if openMetrics {
+		w.Header().Add("Content-Type", contentTypeOpenMetrics)
+	} else {
+		w.Header().Add("Content-Type", contentTypeText)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
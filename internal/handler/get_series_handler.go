@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+// GetSeries is a struct that handles HTTP requests for retrieving the labelled series of a metric.
+type GetSeries struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+}
+
+// NewGetSeries creates a new handler.
+func NewGetSeries(ctx context.Context, l *zerolog.Logger, srv Service) *GetSeries {
+	return &GetSeries{
+		ctx:     ctx,
+		logger:  l,
+		service: srv,
+	}
+}
+
+// ServeHTTP handles HTTP requests for retrieving the series of a metric whose labels satisfy
+// the matchers passed in the `match` query parameter, e.g. `{host="a",env=~"prod|stage"}`.
+func (h *GetSeries) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mtype := chi.URLParam(r, "type")
+	mname := chi.URLParam(r, "name")
+
+	matchers, err := model.ParseMatchers(r.URL.Query().Get("match"))
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Invalid label matchers")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	metrics, err := h.service.FindMetrics(h.ctx, mtype, mname, matchers)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("FindMetrics method error")
+		writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
+		return
+	}
+
+	writeResponse(w, http.StatusOK, metrics)
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/selfmetrics"
+)
+
+const streamKeepAlive = 15 * time.Second
+
+// GetStream is a struct that handles HTTP requests streaming the stored metric updates as Server-Sent Events.
+type GetStream struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+	size    int
+	metrics *selfmetrics.Registry
+}
+
+// NewGetStream creates a new handler.
+// Every subscriber buffers up to size updates, the ones beyond it are dropped and counted in metrics when it is not nil.
+func NewGetStream(ctx context.Context, l *zerolog.Logger, srv Service, size int, metrics *selfmetrics.Registry) *GetStream {
+	return &GetStream{
+		ctx:     ctx,
+		logger:  l,
+		service: srv,
+		size:    size,
+		metrics: metrics,
+	}
+}
+
+// ServeHTTP streams the stored metric updates selected by the query parameters until the client disconnects:
+// `type` (comma separated), `name` for the exact name, `prefix` and `regex` for the name, and `match` for the labels.
+// `name` and `regex` can't be set together.
+// Every update is sent as a `metric` event with the metric as JSON. When updates were dropped because
+// the client is too slow, a `dropped` event with the total number of dropped updates is sent before the next one.
+func (h *GetStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Invalid filter")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		if f.Regex != nil {
+			h.logger.Error().Msg("Invalid filter: both name and regex are set")
+			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+			return
+		}
+		f.Regex = regexp.MustCompile("^" + regexp.QuoteMeta(name) + "$")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.logger.Error().Msg("Streaming is not supported")
+		writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
+		return
+	}
+
+	sub := h.service.Subscribe(f, h.size)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+
+	var reported int64
+	for {
+		select {
+		case m, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if dropped := sub.Dropped(); dropped > reported {
+				if h.metrics != nil {
+					h.metrics.Counter("stream_dropped", nil).Add(dropped - reported)
+				}
+				reported = dropped
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			b, err := json.Marshal(m)
+			if err != nil {
+				h.logger.Error().Err(err).Msg("Failed to marshal metric")
+				continue
+			}
+			fmt.Fprintf(w, "event: metric\ndata: %s\n\n", b)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
@@ -1,24 +1,38 @@
 package handler_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang/snappy"
 	"github.com/rs/zerolog"
 	mmock "github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/v-starostin/go-metrics/internal/alert"
 	"github.com/v-starostin/go-metrics/internal/handler"
 	"github.com/v-starostin/go-metrics/internal/mock"
 	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/pubsub"
 	"github.com/v-starostin/go-metrics/internal/service"
+	"github.com/v-starostin/go-metrics/proto/prompb"
 )
 
 const (
@@ -50,6 +64,14 @@ func (suite *handlerTestSuite) SetupTest() {
 	postMetricHandler := handler.NewPostMetric(ctx, &l, srv)
 	getMetricV2Handler := handler.NewGetMetricV2(ctx, &l, srv, key)
 	postMetricV2Handler := handler.NewPostMetricV2(ctx, &l, srv)
+	getHistoryHandler := handler.NewGetHistory(ctx, &l, srv)
+	getAlertsHandler := handler.NewGetAlerts(ctx, &l, srv)
+	getSeriesHandler := handler.NewGetSeries(ctx, &l, srv)
+	getPrometheusMetricsHandler := handler.NewGetPrometheusMetrics(ctx, &l, srv)
+	postRemoteWriteHandler := handler.NewPostRemoteWrite(ctx, &l, srv)
+	listMetricsHandler := handler.NewListMetrics(ctx, &l, srv)
+	getMetricValuesHandler := handler.NewGetMetricValues(ctx, &l, srv, "")
+	getStreamHandler := handler.NewGetStream(ctx, &l, srv, 1, nil)
 
 	r := chi.NewRouter()
 	r.Get("/", getMetricsHandler.ServeHTTP)
@@ -57,6 +79,14 @@ func (suite *handlerTestSuite) SetupTest() {
 	r.Post("/update/{type}/{name}/{value}", postMetricHandler.ServeHTTP)
 	r.Post("/value/", getMetricV2Handler.ServeHTTP)
 	r.Post("/update/", postMetricV2Handler.ServeHTTP)
+	r.Get("/history/{type}/{name}", getHistoryHandler.ServeHTTP)
+	r.Get("/alerts", getAlertsHandler.ServeHTTP)
+	r.Get("/series/{type}/{name}", getSeriesHandler.ServeHTTP)
+	r.Get("/metrics", getPrometheusMetricsHandler.ServeHTTP)
+	r.Get("/api/metrics", listMetricsHandler.ServeHTTP)
+	r.Post("/values/", getMetricValuesHandler.ServeHTTP)
+	r.Get("/stream", getStreamHandler.ServeHTTP)
+	r.With(handler.CheckHash(key, nil)).Post("/api/v1/write", postRemoteWriteHandler.ServeHTTP)
 
 	suite.r = r
 	suite.service = srv
@@ -144,6 +174,43 @@ func (suite *handlerTestSuite) TestHandlerWrongMetricType() {
 	suite.Equal(`{"error":"Bad request"}`, string(resBody))
 }
 
+func (suite *handlerTestSuite) TestHandlerPostHistogramOK() {
+	req, err := http.NewRequest(http.MethodPost, address+"/update/histogram/latency/0.3", nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	f := 0.3
+	m := model.Metric{MType: "histogram", ID: "latency", Value: &f}
+	suite.service.On("SaveMetric", context.Background(), m).Once().Return(nil)
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+}
+
+func (suite *handlerTestSuite) TestHandlerGetHistogramOK() {
+	req, err := http.NewRequest(http.MethodGet, address+"/value/histogram/latency", nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	m := &model.Metric{MType: "histogram", ID: "latency", Histogram: &model.Histogram{
+		Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.3, Count: 1,
+	}}
+	suite.service.On("GetMetric", context.Background(), m.MType, m.ID, m.Labels).Once().Return(m, nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal(`{"bounds":[1],"counts":[1,0],"sum":0.3,"count":1}`, string(resBody))
+}
+
 func (suite *handlerTestSuite) TestHandlerGetGaugeOK() {
 	req, err := http.NewRequest(http.MethodGet, address+getGaugePath, nil)
 	suite.NoError(err)
@@ -154,7 +221,7 @@ func (suite *handlerTestSuite) TestHandlerGetGaugeOK() {
 	*f = 1.23
 
 	m := &model.Metric{MType: "gauge", ID: "metric1", Value: f}
-	suite.service.On("GetMetric", context.Background(), m.MType, m.ID).Once().Return(m, nil)
+	suite.service.On("GetMetric", context.Background(), m.MType, m.ID, m.Labels).Once().Return(m, nil)
 
 	suite.r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -176,7 +243,7 @@ func (suite *handlerTestSuite) TestHandlerGetCounterOK() {
 	*i = 10
 
 	m := &model.Metric{MType: "counter", ID: "metric1", Delta: i}
-	suite.service.On("GetMetric", context.Background(), m.MType, m.ID).Once().Return(m, nil)
+	suite.service.On("GetMetric", context.Background(), m.MType, m.ID, m.Labels).Once().Return(m, nil)
 
 	suite.r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -194,7 +261,7 @@ func (suite *handlerTestSuite) TestHandlerGetMetricNotFound() {
 
 	rr := httptest.NewRecorder()
 
-	suite.service.On("GetMetric", context.Background(), "counter", "metric1").Once().Return(nil, errors.New("not found"))
+	suite.service.On("GetMetric", context.Background(), "counter", "metric1", model.Labels(nil)).Once().Return(nil, errors.New("not found"))
 	suite.r.ServeHTTP(rr, req)
 	res := rr.Result()
 	defer res.Body.Close()
@@ -263,7 +330,7 @@ func (suite *handlerTestSuite) TestHandlerGetMetricOK() {
 	*f = 1.25
 
 	m := &model.Metric{MType: "gauge", ID: "metric1", Value: f}
-	suite.service.On("GetMetric", context.Background(), m.MType, m.ID).Once().Return(m, nil)
+	suite.service.On("GetMetric", context.Background(), m.MType, m.ID, m.Labels).Once().Return(m, nil)
 
 	suite.r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -299,7 +366,7 @@ func (suite *handlerTestSuite) TestHandlerMetricNotFound() {
 
 	rr := httptest.NewRecorder()
 
-	suite.service.On("GetMetric", context.Background(), "gauge", "metric2").Once().Return(nil, errors.New("err"))
+	suite.service.On("GetMetric", context.Background(), "gauge", "metric2", model.Labels(nil)).Once().Return(nil, errors.New("err"))
 
 	suite.r.ServeHTTP(rr, req)
 	res := rr.Result()
@@ -370,6 +437,583 @@ func (suite *handlerTestSuite) TestHandlerPostMetricInternalServerError() {
 	suite.Equal(`{"error":"Internal server error"}`, string(resBody))
 }
 
+func (suite *handlerTestSuite) TestHandlerPostMetricHistogramBoundsMismatch() {
+	b := []byte(`{"id": "latency", "type": "histogram", "histogram": {"bounds": [1], "counts": [1, 0], "sum": 0.3, "count": 1}}`)
+	req, err := http.NewRequest(http.MethodPost, address+"/update/", bytes.NewReader(b))
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	suite.service.On("SaveMetric", context.Background(), mmock.Anything).Once().
+		Return(fmt.Errorf("failed to store data: %w", model.ErrHistogramBounds))
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusBadRequest, res.StatusCode)
+	suite.Equal(`{"error":"Bad request"}`, string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerGetHistoryOK() {
+	req, err := http.NewRequest(http.MethodGet, address+`/history/gauge/metric1?from=1704067200&to=2024-01-01T01:00:00Z&step=1m&labels={host="a"}`, nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	from := time.Unix(1704067200, 0)
+	to := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	points := []model.Point{{Timestamp: to, Value: 1.5}}
+	suite.service.On("GetHistory", context.Background(), "gauge", "metric1", model.Labels{"host": "a"}, from, to, time.Minute).Once().Return(points, nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal(`[{"timestamp":"2024-01-01T01:00:00Z","value":1.5}]`, string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerGetHistoryBadRequest() {
+	for _, path := range []string{
+		"/history/gauges/metric1",
+		"/history/gauge/metric1?from=yesterday",
+		"/history/gauge/metric1?step=often",
+		"/history/gauge/metric1?from=1704067200&to=1704063600",
+		`/history/gauge/metric1?labels={host=~"a"}`,
+	} {
+		req, err := http.NewRequest(http.MethodGet, address+path, nil)
+		suite.NoError(err)
+
+		rr := httptest.NewRecorder()
+		suite.r.ServeHTTP(rr, req)
+		res := rr.Result()
+		res.Body.Close()
+
+		suite.Equal(http.StatusBadRequest, res.StatusCode, path)
+	}
+}
+
+func (suite *handlerTestSuite) TestHandlerGetHistoryNotFound() {
+	req, err := http.NewRequest(http.MethodGet, address+"/history/counter/metric2", nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	suite.service.On("GetHistory", context.Background(), "counter", "metric2", model.Labels(nil), mmock.Anything, mmock.Anything, time.Duration(0)).Once().
+		Return(nil, errors.New("err"))
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+
+	suite.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func (suite *handlerTestSuite) TestHandlerGetAlerts() {
+	req, err := http.NewRequest(http.MethodGet, address+"/alerts", nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	activeAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	alerts := []alert.Alert{{Rule: "rate(counter PollCount) == 0 for 1m", Metric: "PollCount", State: alert.StatePending, ActiveAt: activeAt}}
+	suite.service.On("GetAlerts", context.Background()).Once().Return(alerts)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal(`[{"rule":"rate(counter PollCount) == 0 for 1m","metric":"PollCount","state":"pending","value":0,"activeAt":"2024-01-01T00:00:00Z"}]`, string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerGetSeries() {
+	req, err := http.NewRequest(http.MethodGet, address+`/series/gauge/metric1?match={host=~"a|b"}`, nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	f := 1.5
+	metrics := []model.Metric{{ID: "metric1", MType: "gauge", Value: &f, Labels: model.Labels{"host": "a"}}}
+	suite.service.On("FindMetrics", context.Background(), "gauge", "metric1", mmock.MatchedBy(func(m []model.Matcher) bool {
+		return len(m) == 1 && m[0].Name == "host" && m[0].Op == model.MatchRegexp && m[0].Value == "a|b"
+	})).Once().Return(metrics, nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal(`[{"id":"metric1","type":"gauge","value":1.5,"labels":{"host":"a"}}]`, string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerGetSeriesBadMatcher() {
+	req, err := http.NewRequest(http.MethodGet, address+`/series/gauge/metric1?match={host}`, nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+
+	suite.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func (suite *handlerTestSuite) TestHandlerListMetrics() {
+	req, err := http.NewRequest(http.MethodGet, address+`/api/metrics?type=gauge,counter&prefix=cpu&regex=cpu_.*&match={host="a"}&offset=10&limit=5`, nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	f := 1.5
+	metrics := []model.Metric{{ID: "cpu_usage", MType: "gauge", Value: &f, Labels: model.Labels{"host": "a"}}}
+	suite.service.On("ListMetrics", context.Background(), mmock.MatchedBy(func(f model.Filter) bool {
+		return len(f.Types) == 2 && f.Types[0] == "gauge" && f.Types[1] == "counter" &&
+			f.Prefix == "cpu" &&
+			f.Regex.MatchString("cpu_usage") && !f.Regex.MatchString("x_cpu_usage") &&
+			len(f.Matchers) == 1 && f.Matchers[0].Name == "host" &&
+			f.Offset == 10 && f.Limit == 5
+	})).Once().Return(metrics, 11, nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal("11", res.Header.Get("X-Total-Count"))
+	suite.Equal(`[{"id":"cpu_usage","type":"gauge","value":1.5,"labels":{"host":"a"}}]`, string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerListMetricsBadRequest() {
+	for _, query := range []string{"type=gauges", "regex=(", "match={host}", "limit=-1", "offset=a"} {
+		req, err := http.NewRequest(http.MethodGet, address+"/api/metrics?"+query, nil)
+		suite.NoError(err)
+
+		rr := httptest.NewRecorder()
+		suite.r.ServeHTTP(rr, req)
+		res := rr.Result()
+		res.Body.Close()
+
+		suite.Equal(http.StatusBadRequest, res.StatusCode, query)
+	}
+}
+
+func (suite *handlerTestSuite) TestHandlerGetMetricValues() {
+	body := `[{"id":"metric1","type":"gauge"},{"id":"metric2","type":"counter","labels":{"host":"a"}}]`
+	req, err := http.NewRequest(http.MethodPost, address+"/values/", strings.NewReader(body))
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	f := 1.5
+	keys := []model.Metric{{ID: "metric1", MType: "gauge"}, {ID: "metric2", MType: "counter", Labels: model.Labels{"host": "a"}}}
+	values := []model.MetricValue{
+		{Metric: model.Metric{ID: "metric1", MType: "gauge", Value: &f}, Found: true},
+		{Metric: model.Metric{ID: "metric2", MType: "counter", Labels: model.Labels{"host": "a"}}},
+	}
+	suite.service.On("GetMetricValues", context.Background(), keys).Once().Return(values, nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal(`[{"id":"metric1","type":"gauge","value":1.5,"found":true},{"id":"metric2","type":"counter","labels":{"host":"a"},"found":false}]`, string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerGetMetricValuesBadRequest() {
+	keys := []model.Metric{{ID: "metric1", MType: "gauges"}}
+	suite.service.On("GetMetricValues", context.Background(), keys).Once().Return(nil, service.ErrParseMetric)
+
+	for _, body := range []string{`{"id":"metric1"}`, `[{"id":"metric1","type":"gauges"}]`} {
+		req, err := http.NewRequest(http.MethodPost, address+"/values/", strings.NewReader(body))
+		suite.NoError(err)
+
+		rr := httptest.NewRecorder()
+		suite.r.ServeHTTP(rr, req)
+		res := rr.Result()
+		res.Body.Close()
+
+		suite.Equal(http.StatusBadRequest, res.StatusCode, body)
+	}
+}
+
+func (suite *handlerTestSuite) TestHandlerGetMetricValuesTooMany() {
+	body := "[" + strings.Repeat(`{"id":"metric1","type":"gauge"},`, 1000) + `{"id":"metric1","type":"gauge"}]`
+	req, err := http.NewRequest(http.MethodPost, address+"/values/", strings.NewReader(body))
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	res.Body.Close()
+
+	suite.Equal(http.StatusBadRequest, res.StatusCode)
+	suite.service.AssertNotCalled(suite.T(), "GetMetricValues", mmock.Anything, mmock.Anything)
+}
+
+func (suite *handlerTestSuite) TestHandlerGetMetricV2Labels() {
+	reqBody := `{"id":"metric1","type":"gauge","labels":{"host":"a"}}`
+	req, err := http.NewRequest(http.MethodPost, address+"/value/", bytes.NewReader([]byte(reqBody)))
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+
+	f := 2.5
+	m := &model.Metric{ID: "metric1", MType: "gauge", Value: &f, Labels: model.Labels{"host": "a"}}
+	suite.service.On("GetMetric", context.Background(), "gauge", "metric1", model.Labels{"host": "a"}).Once().Return(m, nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal(`{"id":"metric1","type":"gauge","value":2.5,"labels":{"host":"a"}}`, string(resBody))
+}
+
+func prometheusTestData() model.Data {
+	alloc, heap, pollCount := 1.5, 2e9, int64(7)
+	sys := 3.0
+	return model.Data{
+		"gauge": {
+			"Alloc":            {ID: "Alloc", MType: "gauge", Value: &alloc},
+			"HeapAlloc":        {ID: "HeapAlloc", MType: "gauge", Value: &heap},
+			`Sys{host="a\\b"}`: {ID: "Sys", MType: "gauge", Value: &sys, Labels: model.Labels{"host": `a\b`}},
+		},
+		"counter": {
+			"PollCount": {ID: "PollCount", MType: "counter", Delta: &pollCount},
+		},
+		"histogram": {
+			"latency.seconds": {ID: "latency.seconds", MType: "histogram", Histogram: &model.Histogram{
+				Bounds: []float64{0.1, 1}, Counts: []uint64{1, 2, 1}, Sum: 4.2, Count: 4,
+			}},
+		},
+	}
+}
+
+func (suite *handlerTestSuite) TestHandlerGetPrometheusMetrics() {
+	req, err := http.NewRequest(http.MethodGet, address+"/metrics", nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+	suite.service.On("GetMetrics", context.Background()).Once().Return(prometheusTestData(), nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal("text/plain; version=0.0.4; charset=utf-8", res.Header.Get("Content-Type"))
+	suite.Equal(`# TYPE Alloc gauge
+Alloc 1.5
+# TYPE HeapAlloc gauge
+HeapAlloc 2e+09
+# TYPE PollCount_total counter
+PollCount_total 7
+# TYPE Sys gauge
+Sys{host="a\\b"} 3
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 4.2
+latency_seconds_count 4
+`, string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerGetPrometheusMetricsOpenMetrics() {
+	req, err := http.NewRequest(http.MethodGet, address+"/metrics", nil)
+	suite.NoError(err)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+
+	rr := httptest.NewRecorder()
+	data := prometheusTestData()
+	delete(data, "gauge")
+	delete(data, "histogram")
+	suite.service.On("GetMetrics", context.Background()).Once().Return(data, nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	suite.NoError(err)
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal("application/openmetrics-text; version=1.0.0; charset=utf-8", res.Header.Get("Content-Type"))
+	suite.Equal("# TYPE PollCount counter\nPollCount_total 7\n# EOF\n", string(resBody))
+}
+
+func (suite *handlerTestSuite) TestHandlerGetPrometheusMetricsCollisions() {
+	g1, g2, g3, d := 1.0, 2.0, 3.0, int64(4)
+	data := model.Data{
+		service.TypeGauge: {
+			"a.b":           {ID: "a.b", MType: service.TypeGauge, Value: &g1},
+			"a_b":           {ID: "a_b", MType: service.TypeGauge, Value: &g2},
+			`a-b{host="x"}`: {ID: "a-b", MType: service.TypeGauge, Value: &g3, Labels: model.Labels{"host": "x"}},
+		},
+		service.TypeCounter: {
+			"a:b": {ID: "a:b", MType: service.TypeCounter, Delta: &d},
+			"a.b": {ID: "a.b", MType: service.TypeCounter, Delta: &d},
+		},
+	}
+	suite.service.On("GetMetrics", context.Background()).Return(data, nil)
+	defer suite.service.AssertExpectations(suite.T())
+
+	// the metrics are held in maps, so the result is checked to be the same on every run
+	for i := 0; i < 10; i++ {
+		var logs bytes.Buffer
+		l := zerolog.New(&logs)
+		h := handler.NewGetPrometheusMetrics(context.Background(), &l, suite.service)
+
+		req, err := http.NewRequest(http.MethodGet, address+"/metrics", nil)
+		suite.NoError(err)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		suite.Equal(http.StatusOK, rr.Code)
+		suite.Equal(`# TYPE a:b_total counter
+a:b_total 4
+# TYPE a_b gauge
+a_b 2
+a_b{host="x"} 3
+`, rr.Body.String())
+		suite.Contains(logs.String(), `"type":"gauge","name":"a.b","family":"a_b"`)
+		suite.Contains(logs.String(), `"type":"counter","name":"a.b","family":"a_b"`)
+	}
+}
+
+func (suite *handlerTestSuite) TestHandlerGetPrometheusMetricsSuffixCollisions() {
+	g1, g2, d := 1.0, 2.0, int64(4)
+	h := &model.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1}
+	tt := []struct {
+		name     string
+		data     model.Data
+		expected string
+		log      string
+	}{
+		{
+			name: "counter and gauge with the _total suffix",
+			data: model.Data{
+				service.TypeCounter: {"foo": {ID: "foo", MType: service.TypeCounter, Delta: &d}},
+				service.TypeGauge:   {"foo_total": {ID: "foo_total", MType: service.TypeGauge, Value: &g1}},
+			},
+			expected: "# TYPE foo_total counter\nfoo_total 4\n",
+			log:      `"type":"gauge","name":"foo_total","family":"foo_total"`,
+		},
+		{
+			name: "histogram and gauge with the _sum suffix",
+			data: model.Data{
+				service.TypeHistogram: {"bar": {ID: "bar", MType: service.TypeHistogram, Histogram: h}},
+				service.TypeGauge:     {"bar_sum": {ID: "bar_sum", MType: service.TypeGauge, Value: &g2}},
+			},
+			expected: "# TYPE bar histogram\nbar_bucket{le=\"1\"} 1\nbar_bucket{le=\"+Inf\"} 1\nbar_sum 0.5\nbar_count 1\n",
+			log:      `"type":"gauge","name":"bar_sum","family":"bar_sum"`,
+		},
+	}
+
+	for _, test := range tt {
+		suite.Run(test.name, func() {
+			srv := &mock.Service{}
+			srv.On("GetMetrics", context.Background()).Return(test.data, nil)
+			var logs bytes.Buffer
+			l := zerolog.New(&logs)
+			h := handler.NewGetPrometheusMetrics(context.Background(), &l, srv)
+
+			req, err := http.NewRequest(http.MethodGet, address+"/metrics", nil)
+			suite.NoError(err)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			suite.Equal(http.StatusOK, rr.Code)
+			suite.Equal(test.expected, rr.Body.String())
+			suite.Contains(logs.String(), test.log)
+		})
+	}
+}
+
+func (suite *handlerTestSuite) TestHandlerGetPrometheusMetricsError() {
+	req, err := http.NewRequest(http.MethodGet, address+"/metrics", nil)
+	suite.NoError(err)
+
+	rr := httptest.NewRecorder()
+	suite.service.On("GetMetrics", context.Background()).Once().Return(nil, errors.New("err"))
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+
+	suite.Equal(http.StatusInternalServerError, res.StatusCode)
+}
+
+func sign(b []byte, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func remoteWriteBody(t require.TestingT) []byte {
+	req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		{
+			Labels: []*prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+			Samples: []*prompb.Sample{
+				{Value: 1, Timestamp: 2000},
+				{Value: 0, Timestamp: 1000},
+			},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "process_cpu_seconds_total"}},
+			Samples: []*prompb.Sample{{Value: 12.5, Timestamp: 1000}},
+		},
+		{
+			Labels:  []*prompb.Label{{Name: "job", Value: "nameless"}},
+			Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}},
+		},
+		{
+			Labels: []*prompb.Label{{Name: "__name__", Value: "empty"}},
+		},
+	}}
+	b, err := proto.Marshal(req)
+	require.NoError(t, err)
+	return snappy.Encode(nil, b)
+}
+
+func (suite *handlerTestSuite) TestHandlerPostRemoteWrite() {
+	body := remoteWriteBody(suite.T())
+	req, err := http.NewRequest(http.MethodPost, address+"/api/v1/write", bytes.NewReader(body))
+	suite.NoError(err)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("HashSHA256", sign(body, key))
+
+	rr := httptest.NewRecorder()
+
+	up, cpu := 1.0, 12.5
+	metrics := []model.Metric{
+		{ID: "up", MType: "gauge", Value: &up, Labels: model.Labels{"job": "node"}},
+		{ID: "process_cpu_seconds_total", MType: "gauge", Value: &cpu},
+	}
+	suite.service.On("SaveMetrics", context.Background(), metrics).Once().Return(nil)
+
+	suite.r.ServeHTTP(rr, req)
+	res := rr.Result()
+	defer res.Body.Close()
+
+	suite.Equal(http.StatusNoContent, res.StatusCode)
+	suite.service.AssertExpectations(suite.T())
+}
+
+func (suite *handlerTestSuite) TestHandlerPostRemoteWriteNonFinite() {
+	// staleMarker is the NaN Prometheus sends once a series is gone
+	staleMarker := math.Float64frombits(0x7ff0000000000002)
+	two, three := 2.0, 3.0
+
+	tt := []struct {
+		name    string
+		samples []*prompb.Sample
+		stored  *float64
+	}{
+		{name: "stale marker", samples: []*prompb.Sample{{Value: staleMarker, Timestamp: 1000}}},
+		{name: "stale marker after a sample", samples: []*prompb.Sample{{Value: 2, Timestamp: 1000}, {Value: staleMarker, Timestamp: 2000}}, stored: &two},
+		{name: "NaN", samples: []*prompb.Sample{{Value: math.NaN(), Timestamp: 1000}}},
+		{name: "Inf", samples: []*prompb.Sample{{Value: math.Inf(1), Timestamp: 1000}}},
+		{name: "negative Inf", samples: []*prompb.Sample{{Value: math.Inf(-1), Timestamp: 2000}, {Value: 3, Timestamp: 1000}}, stored: &three},
+	}
+
+	for _, test := range tt {
+		suite.Run(test.name, func() {
+			req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+				{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}}},
+				{Labels: []*prompb.Label{{Name: "__name__", Value: "x"}}, Samples: test.samples},
+			}}
+			b, err := proto.Marshal(req)
+			suite.Require().NoError(err)
+			body := snappy.Encode(nil, b)
+
+			up := 1.0
+			metrics := []model.Metric{{ID: "up", MType: "gauge", Value: &up}}
+			if test.stored != nil {
+				metrics = append(metrics, model.Metric{ID: "x", MType: "gauge", Value: test.stored})
+			}
+			call := suite.service.On("SaveMetrics", context.Background(), metrics).Once().Return(nil)
+			defer call.Unset()
+
+			r, err := http.NewRequest(http.MethodPost, address+"/api/v1/write", bytes.NewReader(body))
+			suite.NoError(err)
+			rr := httptest.NewRecorder()
+			suite.r.ServeHTTP(rr, r)
+
+			suite.Equal(http.StatusNoContent, rr.Code)
+			suite.service.AssertExpectations(suite.T())
+		})
+	}
+}
+
+func (suite *handlerTestSuite) TestHandlerPostRemoteWriteReservedName() {
+	req := &prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "up"}}, Samples: []*prompb.Sample{{Value: 1, Timestamp: 1000}}},
+		{Labels: []*prompb.Label{{Name: "__name__", Value: "gometrics_server_http_requests"}}, Samples: []*prompb.Sample{{Value: 5, Timestamp: 1000}}},
+	}}
+	b, err := proto.Marshal(req)
+	suite.Require().NoError(err)
+
+	up := 1.0
+	call := suite.service.On("SaveMetrics", context.Background(), []model.Metric{{ID: "up", MType: "gauge", Value: &up}}).Once().Return(nil)
+	defer call.Unset()
+
+	r, err := http.NewRequest(http.MethodPost, address+"/api/v1/write", bytes.NewReader(snappy.Encode(nil, b)))
+	suite.NoError(err)
+	rr := httptest.NewRecorder()
+	suite.r.ServeHTTP(rr, r)
+
+	suite.Equal(http.StatusNoContent, rr.Code)
+	suite.service.AssertExpectations(suite.T())
+}
+
+func (suite *handlerTestSuite) TestHandlerPostRemoteWriteBadRequest() {
+	tt := []struct {
+		name string
+		body []byte
+		hash string
+	}{
+		{name: "not snappy", body: []byte("metrics")},
+		{name: "not protobuf", body: snappy.Encode(nil, []byte("metrics"))},
+		{name: "hash mismatch", body: remoteWriteBody(suite.T()), hash: sign([]byte("other"), key)},
+	}
+
+	for _, test := range tt {
+		suite.Run(test.name, func() {
+			req, err := http.NewRequest(http.MethodPost, address+"/api/v1/write", bytes.NewReader(test.body))
+			suite.NoError(err)
+			if test.hash != "" {
+				req.Header.Set("HashSHA256", test.hash)
+			}
+
+			rr := httptest.NewRecorder()
+			suite.r.ServeHTTP(rr, req)
+			res := rr.Result()
+			defer res.Body.Close()
+
+			suite.Equal(http.StatusBadRequest, res.StatusCode)
+		})
+	}
+}
+
 var expectedHTML = `
 <!DOCTYPE html>
 <html>
@@ -390,3 +1034,74 @@ var expectedHTML = `
 </body>
 </html>
 `
+
+func (suite *handlerTestSuite) TestHandlerStream() {
+	ts := httptest.NewServer(suite.r)
+	defer ts.Close()
+
+	v1, v2, v3 := 1.5, 2.5, 3.5
+	bus := pubsub.NewBus()
+	suite.service.On("Subscribe", mmock.MatchedBy(func(f model.Filter) bool {
+		return len(f.Types) == 1 && f.Types[0] == "gauge" &&
+			f.Regex.MatchString("m.1") && !f.Regex.MatchString("mx1")
+	}), 1).Once().Return(func(f model.Filter, size int) *pubsub.Subscription {
+		sub := bus.Subscribe(f, size)
+		// the second update overflows the buffer before the stream is read
+		bus.Publish(
+			model.Metric{ID: "m.1", MType: "gauge", Value: &v1},
+			model.Metric{ID: "m.1", MType: "gauge", Value: &v2},
+		)
+		return sub
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/stream?type=gauge&name=m.1", nil)
+	suite.NoError(err)
+	res, err := http.DefaultClient.Do(req)
+	suite.NoError(err)
+	defer res.Body.Close()
+
+	suite.Equal(http.StatusOK, res.StatusCode)
+	suite.Equal("text/event-stream", res.Header.Get("Content-Type"))
+
+	lines := make([]string, 0, 9)
+	sc := bufio.NewScanner(res.Body)
+	for len(lines) < 6 && sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	bus.Publish(
+		model.Metric{ID: "m.1", MType: "counter", Delta: new(int64)},
+		model.Metric{ID: "mx1", MType: "gauge", Value: &v1},
+		model.Metric{ID: "m.1", MType: "gauge", Value: &v3},
+	)
+	for len(lines) < 9 && sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+
+	suite.Equal([]string{
+		"event: dropped",
+		`data: {"dropped":1}`,
+		"",
+		"event: metric",
+		`data: {"id":"m.1","type":"gauge","value":1.5}`,
+		"",
+		"event: metric",
+		`data: {"id":"m.1","type":"gauge","value":3.5}`,
+		"",
+	}, lines)
+}
+
+func (suite *handlerTestSuite) TestHandlerStreamBadFilter() {
+	for _, query := range []string{"type=gauges", "name=metric1&regex=metric.*"} {
+		req, err := http.NewRequest(http.MethodGet, address+"/stream?"+query, nil)
+		suite.NoError(err)
+
+		rr := httptest.NewRecorder()
+		suite.r.ServeHTTP(rr, req)
+		res := rr.Result()
+		res.Body.Close()
+
+		suite.Equal(http.StatusBadRequest, res.StatusCode, query)
+	}
+}
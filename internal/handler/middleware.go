@@ -4,17 +4,23 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"slices"
+	"strconv"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
 
+	"github.com/v-starostin/go-metrics/internal/crypto"
+	"github.com/v-starostin/go-metrics/internal/keys"
 	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/selfmetrics"
 )
 
 type LogFormatter struct {
@@ -22,10 +28,13 @@ type LogFormatter struct {
 }
 
 func (l *LogFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
-	logger := l.With().
+	c := l.With().
 		Str("URI", r.RequestURI).
-		Str("method", r.Method).
-		Logger()
+		Str("method", r.Method)
+	if cn := crypto.PeerCommonName(r.TLS); cn != "" {
+		c = c.Str("client", cn)
+	}
+	logger := c.Logger()
 
 	return &LogEntry{&logger}
 }
@@ -49,9 +58,10 @@ func (l *LogEntry) Panic(v any, stack []byte) {
 		Msg("Panic handled")
 }
 
+// Decompress unpacks gzip request bodies.
+// A body that is not gzip despite the header, e.g. an encrypted one, is passed through unchanged
+// for the handler to decrypt and unpack it.
 func Decompress(l *zerolog.Logger) func(next http.Handler) http.Handler {
-	gr := new(gzip.Reader)
-
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			encodingHeaders := r.Header.Values("Content-Encoding")
@@ -60,47 +70,248 @@ func Decompress(l *zerolog.Logger) func(next http.Handler) http.Handler {
 				return
 			}
 
-			if err := gr.Reset(r.Body); err != nil {
-				l.Error().Err(err).Msg("Reset gzip reader error")
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad Request"})
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(b))
+
+			if isGzip(b) {
+				gr, err := gzip.NewReader(bytes.NewReader(b))
+				if err != nil {
+					l.Error().Err(err).Msg("gzip reader error")
+				} else {
+					defer gr.Close()
+					r.Body = gr
+				}
 			}
-			defer gr.Close()
 
-			r.Body = gr
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-func CheckHash(key string) func(next http.Handler) http.Handler {
+func isGzip(b []byte) bool {
+	return len(b) > 1 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// gunzip unpacks b when it is gzip and returns it unchanged otherwise.
+func gunzip(b []byte) ([]byte, error) {
+	if !isGzip(b) {
+		return b, nil
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return io.ReadAll(gr)
+}
+
+// Signature headers.
+const (
+	// KeyIDHeader carries the ID of the key the request is signed with.
+	KeyIDHeader = "KeyID"
+	// TimestampHeader carries the unix time the request was signed at.
+	TimestampHeader = "HashTimestamp"
+	// NonceHeader carries a random value unique to the request.
+	NonceHeader = "HashNonce"
+)
+
+var (
+	errMissingSignature = errors.New("missing signature")
+	errInvalidSignature = errors.New("invalid signature")
+	errUnknownKey       = errors.New("unknown or revoked key")
+	errMissingNonce     = errors.New("missing timestamp or nonce")
+)
+
+// KeyStore looks up the per-agent signing keys.
+type KeyStore interface {
+	Lookup(id string, now time.Time) (keys.Key, error)
+}
+
+// HashChecker verifies the HashSHA256 signatures of the requests.
+type HashChecker struct {
+	key     string
+	keys    KeyStore
+	replay  *ReplayGuard
+	metrics *selfmetrics.Registry
+}
+
+// NewHashChecker creates a new HashChecker.
+// Requests with a KeyID header are verified with that key from ks, others with the shared key.
+// The timestamp and nonce are checked against replay when it is not nil, and the failed checks
+// are counted in metrics when it is not nil.
+func NewHashChecker(key string, ks KeyStore, replay *ReplayGuard, metrics *selfmetrics.Registry) *HashChecker {
+	return &HashChecker{
+		key:     key,
+		keys:    ks,
+		replay:  replay,
+		metrics: metrics,
+	}
+}
+
+// Check returns a middleware verifying the signature of the request body.
+// In strict mode every request must be signed along with a timestamp and nonce, and failures
+// get 401. Otherwise unsigned requests are passed through and failures get 400.
+// The identity of the agent, taken from the key or else from the client certificate,
+// is put into the request context.
+func (c *HashChecker) Check(strict bool) func(next http.Handler) http.Handler {
+	status := http.StatusBadRequest
+	if strict {
+		status = http.StatusUnauthorized
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			hashSHA256 := r.Header.Get("HashSHA256")
-			if hashSHA256 == "" {
-				next.ServeHTTP(w, r)
+			agent := crypto.PeerCommonName(r.TLS)
+			if r.Header.Get("HashSHA256") == "" && !strict {
+				next.ServeHTTP(w, withAgent(r, agent))
 				return
 			}
-			h := hmac.New(sha256.New, []byte(key))
+
 			b, err := io.ReadAll(r.Body)
 			if err != nil {
 				writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad Request"})
 				return
 			}
-			if _, err = h.Write(b); err != nil {
-				writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal Server Error"})
+			r.Body = io.NopCloser(bytes.NewReader(b))
+
+			keyAgent, err := c.Verify(r.Header.Get("HashSHA256"), r.Header.Get(KeyIDHeader),
+				r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader), b, strict)
+			if err != nil {
+				writeResponse(w, status, model.Error{Error: err.Error()})
 				return
 			}
-			d := h.Sum(nil)
-			hh, err := hex.DecodeString(hashSHA256)
-			if err != nil {
-				writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal Server Error"})
+			if keyAgent != "" {
+				agent = keyAgent
+			}
+			next.ServeHTTP(w, withAgent(r, agent))
+		})
+	}
+}
+
+// Verify checks the hex encoded signature of body and returns the agent the key belongs to, if any.
+// It is shared by the HTTP middleware and the gRPC interceptor, the failures are counted in metrics.
+func (c *HashChecker) Verify(hash, keyID, timestamp, nonce string, body []byte, strict bool) (string, error) {
+	agent, err := c.verify(hash, keyID, timestamp, nonce, body, strict)
+	if err != nil && c.metrics != nil {
+		c.metrics.Counter("hash_check_failures", model.Labels{"reason": err.Error()}).Inc()
+	}
+	return agent, err
+}
+
+func (c *HashChecker) verify(hash, keyID, timestamp, nonce string, body []byte, strict bool) (string, error) {
+	if hash == "" {
+		return "", errMissingSignature
+	}
+
+	secret, agent := c.key, ""
+	// without a shared key anyone could sign with the empty one
+	if keyID == "" && c.key == "" {
+		return "", errUnknownKey
+	}
+	if keyID != "" {
+		if c.keys == nil {
+			return "", errUnknownKey
+		}
+		k, err := c.keys.Lookup(keyID, time.Now())
+		if err != nil {
+			return "", errUnknownKey
+		}
+		secret = k.Secret
+		agent = k.Agent
+		if agent == "" {
+			agent = k.ID
+		}
+	}
+
+	if strict && (timestamp == "" || nonce == "") {
+		return "", errMissingNonce
+	}
+
+	hh, err := hex.DecodeString(hash)
+	if err != nil || !hmac.Equal(crypto.Signature(secret, timestamp, nonce, body), hh) {
+		return "", errInvalidSignature
+	}
+
+	// the nonce is recorded only once the signature is known to be valid
+	if c.replay != nil && (timestamp != "" || nonce != "") {
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || nonce == "" {
+			return "", errMissingNonce
+		}
+		if err := c.replay.Check(time.Unix(sec, 0), nonce, time.Now()); err != nil {
+			return "", err
+		}
+	}
+
+	return agent, nil
+}
+
+// CheckHash verifies the HashSHA256 signature of the request body, passing unsigned requests through.
+func CheckHash(key string, ks KeyStore) func(next http.Handler) http.Handler {
+	return NewHashChecker(key, ks, nil, nil).Check(false)
+}
+
+func withAgent(r *http.Request, agent string) *http.Request {
+	if agent == "" {
+		return r
+	}
+	return r.WithContext(keys.NewContext(r.Context(), agent))
+}
+
+// RealIPHeader is the header carrying the address of the host that sent the request.
+const RealIPHeader = "X-Real-IP"
+
+// TrustedSubnet rejects the requests whose X-Real-IP is not within subnet.
+// All requests are passed through when subnet is nil.
+func TrustedSubnet(subnet *net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if subnet == nil {
+				next.ServeHTTP(w, r)
 				return
 			}
-			if !hmac.Equal(d, hh) {
-				writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad Request"})
+			ip := net.ParseIP(r.Header.Get(RealIPHeader))
+			if ip == nil || !subnet.Contains(ip) {
+				writeResponse(w, http.StatusForbidden, model.Error{Error: "Forbidden"})
 				return
 			}
-			r.Body = io.NopCloser(bytes.NewReader(b))
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// Instrument counts the handled requests by route, method and status code,
+// and observes their duration by route.
+func Instrument(metrics *selfmetrics.Registry) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.RoutePatterns) > 0 {
+				// the trailing slash is trimmed from the pattern, including the root one
+				route = rctx.RoutePattern()
+				if route == "" {
+					route = "/"
+				}
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			metrics.Counter("http_requests", model.Labels{
+				"route":  route,
+				"method": r.Method,
+				"code":   strconv.Itoa(status),
+			}).Inc()
+			metrics.Histogram("http_request_duration_seconds", model.Labels{"route": route}, model.DefaultBuckets).
+				Observe(time.Since(start).Seconds())
+		})
+	}
+}
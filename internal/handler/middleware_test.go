@@ -7,15 +7,23 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/v-starostin/go-metrics/internal/crypto"
 	"github.com/v-starostin/go-metrics/internal/handler"
+	"github.com/v-starostin/go-metrics/internal/keys"
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/selfmetrics"
 )
 
 func TestDecompress(t *testing.T) {
@@ -52,6 +60,23 @@ func TestDecompress(t *testing.T) {
 		assert.Equal(t, http.StatusOK, res.StatusCode)
 		assert.Equal(t, []byte("test"), resBody)
 	})
+
+	t.Run("content encoding gzip with encrypted body", func(t *testing.T) {
+		echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			w.Write(b)
+		})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("GMEV-encrypted")))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		handler.Decompress(&l)(echo).ServeHTTP(rr, req)
+		res := rr.Result()
+		defer res.Body.Close()
+		resBody, err := io.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []byte("GMEV-encrypted"), resBody)
+	})
 }
 
 func TestCheckHash(t *testing.T) {
@@ -62,7 +87,7 @@ func TestCheckHash(t *testing.T) {
 	t.Run("no HashSHA256 header", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("test")))
 		rr := httptest.NewRecorder()
-		handler.CheckHash("key")(testHandler).ServeHTTP(rr, req)
+		handler.CheckHash("key", nil)(testHandler).ServeHTTP(rr, req)
 		res := rr.Result()
 		defer res.Body.Close()
 		assert.Equal(t, http.StatusOK, res.StatusCode)
@@ -79,7 +104,7 @@ func TestCheckHash(t *testing.T) {
 		d := h.Sum(nil)
 		req.Header.Add("HashSHA256", hex.EncodeToString(d))
 		rr := httptest.NewRecorder()
-		handler.CheckHash("key")(testHandler).ServeHTTP(rr, req)
+		handler.CheckHash("key", nil)(testHandler).ServeHTTP(rr, req)
 		res := rr.Result()
 		defer res.Body.Close()
 		assert.Equal(t, http.StatusOK, res.StatusCode)
@@ -95,9 +120,228 @@ func TestCheckHash(t *testing.T) {
 		d := h.Sum(nil)
 		req.Header.Add("HashSHA256", hex.EncodeToString(d))
 		rr := httptest.NewRecorder()
-		handler.CheckHash("key")(testHandler).ServeHTTP(rr, req)
+		handler.CheckHash("key", nil)(testHandler).ServeHTTP(rr, req)
 		res := rr.Result()
 		defer res.Body.Close()
 		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
 	})
 }
+
+func TestCheckHashKeyID(t *testing.T) {
+	var agent string
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent = keys.FromContext(r.Context())
+		w.Write([]byte("test"))
+	})
+	ks := keys.NewRegistry([]keys.Key{
+		{ID: "k1", Secret: "secret1", Agent: "agent1"},
+		{ID: "k2", Secret: "secret2", Agent: "agent2", Revoked: true},
+	})
+	sign := func(secret string) string {
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write([]byte("test"))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	tests := []struct {
+		name   string
+		keyID  string
+		secret string
+		status int
+		agent  string
+	}{
+		{name: "valid key", keyID: "k1", secret: "secret1", status: http.StatusOK, agent: "agent1"},
+		{name: "signed with another key", keyID: "k1", secret: "key", status: http.StatusBadRequest},
+		{name: "revoked key", keyID: "k2", secret: "secret2", status: http.StatusBadRequest},
+		{name: "unknown key", keyID: "k3", secret: "secret1", status: http.StatusBadRequest},
+		{name: "shared key", keyID: "", secret: "key", status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent = ""
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("test")))
+			req.Header.Set("HashSHA256", sign(tt.secret))
+			if tt.keyID != "" {
+				req.Header.Set("KeyID", tt.keyID)
+			}
+			rr := httptest.NewRecorder()
+			handler.CheckHash("key", ks)(testHandler).ServeHTTP(rr, req)
+			res := rr.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.agent, agent)
+		})
+	}
+
+	t.Run("empty key without shared key", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("test")))
+		req.Header.Set("HashSHA256", sign(""))
+		rr := httptest.NewRecorder()
+		handler.CheckHash("", ks)(testHandler).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestCheckHashStrict(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("test"))
+	})
+	metrics := selfmetrics.NewRegistry()
+	checker := handler.NewHashChecker("key", nil, handler.NewReplayGuard(time.Minute), metrics)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		signed    bool
+		timestamp string
+		nonce     string
+		status    int
+		error     string
+	}{
+		{name: "signed", signed: true, timestamp: now, nonce: "n1", status: http.StatusOK},
+		{name: "replayed nonce", signed: true, timestamp: now, nonce: "n1", status: http.StatusUnauthorized, error: "nonce has already been used"},
+		{name: "stale timestamp", signed: true, timestamp: stale, nonce: "n2", status: http.StatusUnauthorized, error: "timestamp is outside of the allowed window"},
+		{name: "no nonce", signed: true, timestamp: now, status: http.StatusUnauthorized, error: "missing timestamp or nonce"},
+		{name: "unsigned", timestamp: now, nonce: "n3", status: http.StatusUnauthorized, error: "missing signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("test")))
+			if tt.signed {
+				req.Header.Set("HashSHA256", hex.EncodeToString(crypto.Signature("key", tt.timestamp, tt.nonce, []byte("test"))))
+			}
+			req.Header.Set("HashTimestamp", tt.timestamp)
+			req.Header.Set("HashNonce", tt.nonce)
+			rr := httptest.NewRecorder()
+			checker.Check(true)(testHandler).ServeHTTP(rr, req)
+			res := rr.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.status, res.StatusCode)
+			if tt.error != "" {
+				b, _ := io.ReadAll(res.Body)
+				assert.JSONEq(t, `{"error":"`+tt.error+`"}`, string(b))
+				assert.Equal(t, int64(1), metrics.Counter("hash_check_failures", model.Labels{"reason": tt.error}).Value())
+			}
+		})
+	}
+
+	t.Run("tampered timestamp", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("test")))
+		req.Header.Set("HashSHA256", hex.EncodeToString(crypto.Signature("key", now, "n4", []byte("test"))))
+		req.Header.Set("HashTimestamp", strconv.FormatInt(time.Now().Unix()+1, 10))
+		req.Header.Set("HashNonce", "n4")
+		rr := httptest.NewRecorder()
+		checker.Check(true)(testHandler).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	})
+
+	t.Run("unsigned, not strict", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("test")))
+		rr := httptest.NewRecorder()
+		checker.Check(false)(testHandler).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+}
+
+func TestCheckHashStrictRegistryOnly(t *testing.T) {
+	var agent string
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent = keys.FromContext(r.Context())
+		w.Write([]byte("test"))
+	})
+	ks := keys.NewRegistry([]keys.Key{{ID: "k1", Secret: "secret1", Agent: "agent1"}})
+	checker := handler.NewHashChecker("", ks, handler.NewReplayGuard(time.Minute), nil)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		name   string
+		keyID  string
+		secret string
+		nonce  string
+		signed bool
+		status int
+		agent  string
+	}{
+		{name: "agent key", keyID: "k1", secret: "secret1", nonce: "n1", signed: true, status: http.StatusOK, agent: "agent1"},
+		{name: "replayed nonce", keyID: "k1", secret: "secret1", nonce: "n1", signed: true, status: http.StatusUnauthorized},
+		{name: "empty key without key ID", nonce: "n2", signed: true, status: http.StatusUnauthorized},
+		{name: "unsigned", nonce: "n3", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent = ""
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte("test")))
+			if tt.signed {
+				req.Header.Set("HashSHA256", hex.EncodeToString(crypto.Signature(tt.secret, now, tt.nonce, []byte("test"))))
+			}
+			if tt.keyID != "" {
+				req.Header.Set("KeyID", tt.keyID)
+			}
+			req.Header.Set("HashTimestamp", now)
+			req.Header.Set("HashNonce", tt.nonce)
+			rr := httptest.NewRecorder()
+			checker.Check(true)(testHandler).ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, tt.agent, agent)
+		})
+	}
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("test"))
+	})
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		subnet *net.IPNet
+		ip     string
+		status int
+	}{
+		{name: "no trusted subnet", subnet: nil, ip: "", status: http.StatusOK},
+		{name: "IP within subnet", subnet: subnet, ip: "192.168.1.10", status: http.StatusOK},
+		{name: "IP outside subnet", subnet: subnet, ip: "10.0.0.1", status: http.StatusForbidden},
+		{name: "no X-Real-IP header", subnet: subnet, ip: "", status: http.StatusForbidden},
+		{name: "invalid X-Real-IP header", subnet: subnet, ip: "invalid", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.ip != "" {
+				req.Header.Set("X-Real-IP", tt.ip)
+			}
+			rr := httptest.NewRecorder()
+			handler.TrustedSubnet(tt.subnet)(testHandler).ServeHTTP(rr, req)
+			res := rr.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.status, res.StatusCode)
+		})
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	metrics := selfmetrics.NewRegistry()
+	r := chi.NewRouter()
+	r.Use(handler.Instrument(metrics))
+	r.Get("/value/{type}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.Method(http.MethodGet, "/admin/metrics", handler.NewGetSelfMetrics(metrics))
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/value/gauge/metric1", nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	}
+	labels := model.Labels{"route": "/value/{type}/{name}", "method": http.MethodGet, "code": "404"}
+	assert.Equal(t, int64(2), metrics.Counter("http_requests", labels).Value())
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/metrics", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `http_requests_total{code="404",method="GET",route="/value/{type}/{name}"} 2`)
+	assert.Contains(t, rr.Body.String(), `http_request_duration_seconds_count{route="/value/{type}/{name}"} 2`)
+}
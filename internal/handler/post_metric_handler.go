@@ -36,7 +36,7 @@ func (h *PostMetric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mname := chi.URLParam(r, "name")
 	mvalue := chi.URLParam(r, "value")
 
-	if mtype != service.TypeCounter && mtype != service.TypeGauge {
+	if mtype != service.TypeCounter && mtype != service.TypeGauge && mtype != service.TypeHistogram {
 		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
 		return
 	}
@@ -55,7 +55,7 @@ func (h *PostMetric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			MType: mtype,
 			Delta: &delta,
 		}
-	case service.TypeGauge:
+	case service.TypeGauge, service.TypeHistogram:
 		value, err := strconv.ParseFloat(mvalue, 64)
 		if err != nil {
 			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
@@ -69,7 +69,7 @@ func (h *PostMetric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.service.SaveMetric(h.ctx, m); err != nil {
-		if errors.Is(err, service.ErrParseMetric) {
+		if isInvalidMetric(err) {
 			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
 			return
 		}
@@ -79,3 +79,8 @@ func (h *PostMetric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	writeResponse(w, http.StatusOK, fmt.Sprintf("metric %s of type %s with value %v has been set successfully", mname, mtype, mvalue))
 }
+
+// isInvalidMetric reports whether the error is caused by the metric itself rather than the storage.
+func isInvalidMetric(err error) bool {
+	return errors.Is(err, service.ErrParseMetric) || errors.Is(err, model.ErrHistogramBounds)
+}
@@ -40,6 +40,10 @@ func (h *PostMetricV2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if err := h.service.SaveMetric(h.ctx, req); err != nil {
 		h.logger.Error().Err(err).Msg("SaveMetric method error")
+		if isInvalidMetric(err) {
+			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+			return
+		}
 		writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
 		return
 	}
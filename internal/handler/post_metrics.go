@@ -10,7 +10,9 @@ import (
 	"github.com/rs/zerolog"
 
 	"github.com/v-starostin/go-metrics/internal/crypto"
+	"github.com/v-starostin/go-metrics/internal/keys"
 	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/selfmetrics"
 )
 
 // PostMetrics is a struct that handles HTTP request for posting the metrics.
@@ -19,15 +21,18 @@ type PostMetrics struct {
 	logger     *zerolog.Logger
 	service    Service
 	privateKey *rsa.PrivateKey
+	metrics    *selfmetrics.Registry
 }
 
 // NewPostMetrics creates a new handler.
-func NewPostMetrics(ctx context.Context, l *zerolog.Logger, srv Service, pk *rsa.PrivateKey) *PostMetrics {
+// Decrypt failures are counted in metrics when it is not nil.
+func NewPostMetrics(ctx context.Context, l *zerolog.Logger, srv Service, pk *rsa.PrivateKey, metrics *selfmetrics.Registry) *PostMetrics {
 	return &PostMetrics{
 		ctx:        ctx,
 		logger:     l,
 		service:    srv,
 		privateKey: pk,
+		metrics:    metrics,
 	}
 }
 
@@ -37,13 +42,25 @@ func (h *PostMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		h.logger.Error().Err(err).Msg("Invalid incoming data")
 		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
 	}
 
 	if h.privateKey != nil {
-		b, err = crypto.RSADecrypt(h.privateKey, b)
+		b, err = crypto.Decrypt(h.privateKey, b)
 		if err != nil {
+			if h.metrics != nil {
+				h.metrics.Counter("decrypt_failures", nil).Inc()
+			}
 			h.logger.Error().Err(err).Msg("Invalid incoming data")
 			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+			return
+		}
+		// the body is compressed before it is encrypted
+		b, err = gunzip(b)
+		if err != nil {
+			h.logger.Error().Err(err).Msg("Invalid incoming data")
+			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+			return
 		}
 	}
 
@@ -53,10 +70,14 @@ func (h *PostMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
 		return
 	}
-	h.logger.Info().Any("req", req).Msg("Decoded request body")
+	h.logger.Info().Str("agent", keys.FromContext(r.Context())).Any("req", req).Msg("Decoded request body")
 
 	if err := h.service.SaveMetrics(h.ctx, req); err != nil {
 		h.logger.Error().Err(err).Msg("SaveMetric method error")
+		if isInvalidMetric(err) {
+			writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+			return
+		}
 		writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
 		return
 	}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+	"github.com/v-starostin/go-metrics/proto/prompb"
+)
+
+// metricNameLabel is the label that holds the metric name in the remote write protocol.
+const metricNameLabel = "__name__"
+
+// PostRemoteWrite is a struct that handles Prometheus remote write requests.
+type PostRemoteWrite struct {
+	ctx     context.Context
+	logger  *zerolog.Logger
+	service Service
+}
+
+// NewPostRemoteWrite creates a new handler.
+func NewPostRemoteWrite(ctx context.Context, l *zerolog.Logger, srv Service) *PostRemoteWrite {
+	return &PostRemoteWrite{
+		ctx:     ctx,
+		logger:  l,
+		service: srv,
+	}
+}
+
+// ServeHTTP handles snappy-compressed protobuf WriteRequest payloads.
+// Every series is stored as a gauge holding its latest sample: the samples do not carry the metric type,
+// and the counters in them are already cumulative, so adding them up as counter deltas would be wrong.
+func (h *PostRemoteWrite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Invalid incoming data")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	b, err = snappy.Decode(nil, b)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Invalid snappy payload")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		h.logger.Error().Err(err).Msg("Invalid write request")
+		writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+		return
+	}
+
+	metrics := make([]model.Metric, 0, len(req.GetTimeseries()))
+	for _, ts := range req.GetTimeseries() {
+		m, ok := fromTimeSeries(ts)
+		if !ok {
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	h.logger.Info().Int("series", len(req.GetTimeseries())).Int("metrics", len(metrics)).Msg("Decoded remote write request")
+
+	if len(metrics) > 0 {
+		if err := h.service.SaveMetrics(h.ctx, metrics); err != nil {
+			h.logger.Error().Err(err).Msg("SaveMetrics method error")
+			if isInvalidMetric(err) {
+				writeResponse(w, http.StatusBadRequest, model.Error{Error: "Bad request"})
+				return
+			}
+			writeResponse(w, http.StatusInternalServerError, model.Error{Error: "Internal server error"})
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fromTimeSeries converts a series into a gauge with the value of its latest finite sample.
+// The NaN samples, including the stale markers Prometheus sends once a series is gone, and the infinite ones
+// are skipped, as they cannot be stored. It reports false for series without a name or finite samples,
+// and for the series named with service.ReservedPrefix.
+func fromTimeSeries(ts *prompb.TimeSeries) (model.Metric, bool) {
+	var latest *prompb.Sample
+	for _, s := range ts.GetSamples() {
+		if math.IsNaN(s.GetValue()) || math.IsInf(s.GetValue(), 0) {
+			continue
+		}
+		if latest == nil || s.GetTimestamp() >= latest.GetTimestamp() {
+			latest = s
+		}
+	}
+	if latest == nil {
+		return model.Metric{}, false
+	}
+
+	m := model.Metric{MType: service.TypeGauge}
+	for _, l := range ts.GetLabels() {
+		if l.GetName() == metricNameLabel {
+			m.ID = l.GetValue()
+			continue
+		}
+		if m.Labels == nil {
+			m.Labels = make(model.Labels)
+		}
+		m.Labels[l.GetName()] = l.GetValue()
+	}
+	// a series of the server metrics would get the whole request rejected by the service
+	if m.ID == "" || strings.HasPrefix(m.ID, service.ReservedPrefix) {
+		return model.Metric{}, false
+	}
+
+	v := latest.GetValue()
+	m.Value = &v
+	return m, true
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errStaleTimestamp = errors.New("timestamp is outside of the allowed window")
+	errReplayedNonce  = errors.New("nonce has already been used")
+)
+
+// ReplayGuard rejects the signed requests that are too old or have been seen before.
+// Nonces are remembered for as long as their timestamps are within the window.
+type ReplayGuard struct {
+	mu     sync.Mutex
+	window time.Duration
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+// NewReplayGuard creates a new ReplayGuard accepting timestamps up to window away from now.
+func NewReplayGuard(window time.Duration) *ReplayGuard {
+	return &ReplayGuard{
+		window: window,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Check reports an error when ts is outside of the window or nonce has been used already.
+func (g *ReplayGuard) Check(ts time.Time, nonce string, now time.Time) error {
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) {
+		return errStaleTimestamp
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.pruned) > g.window {
+		for n, expires := range g.nonces {
+			if now.After(expires) {
+				delete(g.nonces, n)
+			}
+		}
+		g.pruned = now
+	}
+
+	if _, ok := g.nonces[nonce]; ok {
+		return errReplayedNonce
+	}
+	// the nonce can't be replayed once ts is out of the window
+	g.nonces[nonce] = ts.Add(g.window)
+	return nil
+}
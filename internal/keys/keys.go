@@ -0,0 +1,160 @@
+// Package keys keeps the per-agent keys used to sign the requests.
+package keys
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown key")
+	ErrRevoked    = errors.New("key is revoked")
+	ErrNotValid   = errors.New("key is not valid at this time")
+)
+
+// Key is a signing key of an agent.
+// An agent may have several keys with overlapping validity windows, so a new key can be rolled
+// out to the agents while the old one is still accepted. Zero NotBefore or NotAfter means no bound.
+type Key struct {
+	ID        string    `json:"id"`
+	Secret    string    `json:"secret"`
+	Agent     string    `json:"agent"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	Revoked   bool      `json:"revoked"`
+}
+
+// Registry looks up the keys by ID.
+type Registry struct {
+	mu   sync.RWMutex
+	keys map[string]Key
+}
+
+// NewRegistry creates a new Registry holding keys.
+func NewRegistry(keys []Key) *Registry {
+	r := &Registry{}
+	r.Set(keys)
+	return r
+}
+
+// Set replaces the keys of the registry.
+func (r *Registry) Set(keys []Key) {
+	m := make(map[string]Key, len(keys))
+	for _, k := range keys {
+		m[k.ID] = k
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = m
+}
+
+// Len returns the number of keys in the registry.
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+// Lookup returns the key with the given ID if it is valid at now.
+func (r *Registry) Lookup(id string, now time.Time) (Key, error) {
+	r.mu.RLock()
+	k, ok := r.keys[id]
+	r.mu.RUnlock()
+
+	switch {
+	case !ok:
+		return Key{}, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	case k.Revoked:
+		return Key{}, fmt.Errorf("%w: %q", ErrRevoked, id)
+	case !k.NotBefore.IsZero() && now.Before(k.NotBefore), !k.NotAfter.IsZero() && now.After(k.NotAfter):
+		return Key{}, fmt.Errorf("%w: %q", ErrNotValid, id)
+	}
+	return k, nil
+}
+
+// Watch reloads the keys every interval until ctx is done, so revoked and rotated keys
+// are picked up without a restart. Failed reloads keep the current keys.
+func (r *Registry) Watch(ctx context.Context, l *zerolog.Logger, load func(ctx context.Context) ([]Key, error), interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			keys, err := load(ctx)
+			if err != nil {
+				l.Error().Err(err).Msg("Failed to reload keys")
+				continue
+			}
+			r.Set(keys)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// LoadFile reads the keys from a JSON file holding an array of keys.
+func LoadFile(path string) ([]Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.ID == "" || k.Secret == "" {
+			return nil, fmt.Errorf("key without id or secret in %s", path)
+		}
+	}
+	return keys, nil
+}
+
+// LoadDB reads the keys from the agent_keys table.
+func LoadDB(ctx context.Context, db *sql.DB) ([]Key, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, secret, agent, not_before, not_after, revoked FROM agent_keys")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]Key, 0)
+	for rows.Next() {
+		var k Key
+		var notBefore, notAfter sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Secret, &k.Agent, &notBefore, &notAfter, &k.Revoked); err != nil {
+			return nil, err
+		}
+		k.NotBefore = notBefore.Time
+		k.NotAfter = notAfter.Time
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+type agentKey struct{}
+
+// NewContext returns a copy of ctx carrying the identity of the agent that sent the request.
+func NewContext(ctx context.Context, agent string) context.Context {
+	return context.WithValue(ctx, agentKey{}, agent)
+}
+
+// FromContext returns the identity of the agent that sent the request, if known.
+func FromContext(ctx context.Context) string {
+	agent, _ := ctx.Value(agentKey{}).(string)
+	return agent
+}
@@ -0,0 +1,82 @@
+package keys_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/v-starostin/go-metrics/internal/keys"
+)
+
+func TestLookup(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := keys.NewRegistry([]keys.Key{
+		{ID: "old", Secret: "s1", Agent: "agent1", NotAfter: now.Add(time.Hour)},
+		{ID: "new", Secret: "s2", Agent: "agent1", NotBefore: now.Add(-time.Hour)},
+		{ID: "next", Secret: "s3", Agent: "agent1", NotBefore: now.Add(time.Hour)},
+		{ID: "revoked", Secret: "s4", Agent: "agent2", Revoked: true},
+	})
+
+	tests := []struct {
+		id  string
+		err error
+	}{
+		{id: "old"},
+		{id: "new"},
+		{id: "next", err: keys.ErrNotValid},
+		{id: "revoked", err: keys.ErrRevoked},
+		{id: "unknown", err: keys.ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			k, err := r.Lookup(tt.id, now)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.id, k.ID)
+		})
+	}
+
+	t.Run("expired after rotation", func(t *testing.T) {
+		_, err := r.Lookup("old", now.Add(2*time.Hour))
+		assert.True(t, errors.Is(err, keys.ErrNotValid), err)
+	})
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("good case", func(t *testing.T) {
+		path := filepath.Join(dir, "keys.json")
+		content := `[{"id":"k1","secret":"s1","agent":"agent1","notAfter":"2030-01-01T00:00:00Z"},{"id":"k2","secret":"s2","revoked":true}]`
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+		k, err := keys.LoadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, []keys.Key{
+			{ID: "k1", Secret: "s1", Agent: "agent1", NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{ID: "k2", Secret: "s2", Revoked: true},
+		}, k)
+	})
+
+	t.Run("key without secret", func(t *testing.T) {
+		path := filepath.Join(dir, "nosecret.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`[{"id":"k1"}]`), 0o600))
+
+		_, err := keys.LoadFile(path)
+		assert.Error(t, err)
+	})
+}
+
+func TestContext(t *testing.T) {
+	ctx := keys.NewContext(context.Background(), "agent1")
+	assert.Equal(t, "agent1", keys.FromContext(ctx))
+	assert.Equal(t, "", keys.FromContext(context.Background()))
+}
@@ -7,6 +7,8 @@ import (
 
 	mock "github.com/stretchr/testify/mock"
 	model "github.com/v-starostin/go-metrics/internal/model"
+
+	time "time"
 )
 
 // Repository is an autogenerated mock type for the Repository type
@@ -14,9 +16,9 @@ type Repository struct {
 	mock.Mock
 }
 
-// Load provides a mock function with given fields: ctx, mtype, mname
-func (_m *Repository) Load(ctx context.Context, mtype string, mname string) (*model.Metric, error) {
-	ret := _m.Called(ctx, mtype, mname)
+// Load provides a mock function with given fields: ctx, mtype, mname, labels
+func (_m *Repository) Load(ctx context.Context, mtype string, mname string, labels model.Labels) (*model.Metric, error) {
+	ret := _m.Called(ctx, mtype, mname, labels)
 
 	if len(ret) == 0 {
 		panic("no return value specified for Load")
@@ -24,19 +26,19 @@ func (_m *Repository) Load(ctx context.Context, mtype string, mname string) (*mo
 
 	var r0 *model.Metric
 	var r1 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, string) (*model.Metric, error)); ok {
-		return rf(ctx, mtype, mname)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels) (*model.Metric, error)); ok {
+		return rf(ctx, mtype, mname, labels)
 	}
-	if rf, ok := ret.Get(0).(func(context.Context, string, string) *model.Metric); ok {
-		r0 = rf(ctx, mtype, mname)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels) *model.Metric); ok {
+		r0 = rf(ctx, mtype, mname, labels)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*model.Metric)
 		}
 	}
 
-	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
-		r1 = rf(ctx, mtype, mname)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, model.Labels) error); ok {
+		r1 = rf(ctx, mtype, mname, labels)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -74,6 +76,66 @@ func (_m *Repository) LoadAll(ctx context.Context) (model.Data, error) {
 	return r0, r1
 }
 
+// LoadHistory provides a mock function with given fields: ctx, mtype, mname, labels, from, to
+func (_m *Repository) LoadHistory(ctx context.Context, mtype string, mname string, labels model.Labels, from time.Time, to time.Time) ([]model.Point, error) {
+	ret := _m.Called(ctx, mtype, mname, labels, from, to)
+
+	if len(ret) == 0 {
+		panic("no return value specified for LoadHistory")
+	}
+
+	var r0 []model.Point
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels, time.Time, time.Time) ([]model.Point, error)); ok {
+		return rf(ctx, mtype, mname, labels, from, to)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels, time.Time, time.Time) []model.Point); ok {
+		r0 = rf(ctx, mtype, mname, labels, from, to)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Point)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, model.Labels, time.Time, time.Time) error); ok {
+		r1 = rf(ctx, mtype, mname, labels, from, to)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// LoadMetrics provides a mock function with given fields: ctx, keys
+func (_m *Repository) LoadMetrics(ctx context.Context, keys []model.Metric) ([]model.MetricValue, error) {
+	ret := _m.Called(ctx, keys)
+
+	if len(ret) == 0 {
+		panic("no return value specified for LoadMetrics")
+	}
+
+	var r0 []model.MetricValue
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, []model.Metric) ([]model.MetricValue, error)); ok {
+		return rf(ctx, keys)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, []model.Metric) []model.MetricValue); ok {
+		r0 = rf(ctx, keys)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.MetricValue)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, []model.Metric) error); ok {
+		r1 = rf(ctx, keys)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // PingStorage provides a mock function with given fields: ctx
 func (_m *Repository) PingStorage(ctx context.Context) error {
 	ret := _m.Called(ctx)
@@ -3,11 +3,17 @@
 package mock
 
 import (
+	alert "github.com/v-starostin/go-metrics/internal/alert"
+
 	context "context"
 
 	mock "github.com/stretchr/testify/mock"
 
 	model "github.com/v-starostin/go-metrics/internal/model"
+
+	pubsub "github.com/v-starostin/go-metrics/internal/pubsub"
+
+	time "time"
 )
 
 // Service is an autogenerated mock type for the Service type
@@ -15,9 +21,89 @@ type Service struct {
 	mock.Mock
 }
 
-// GetMetric provides a mock function with given fields: ctx, mtype, mname
-func (_m *Service) GetMetric(ctx context.Context, mtype string, mname string) (*model.Metric, error) {
-	ret := _m.Called(ctx, mtype, mname)
+// FindMetrics provides a mock function with given fields: ctx, mtype, mname, matchers
+func (_m *Service) FindMetrics(ctx context.Context, mtype string, mname string, matchers []model.Matcher) ([]model.Metric, error) {
+	ret := _m.Called(ctx, mtype, mname, matchers)
+
+	if len(ret) == 0 {
+		panic("no return value specified for FindMetrics")
+	}
+
+	var r0 []model.Metric
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, []model.Matcher) ([]model.Metric, error)); ok {
+		return rf(ctx, mtype, mname, matchers)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, []model.Matcher) []model.Metric); ok {
+		r0 = rf(ctx, mtype, mname, matchers)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Metric)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, []model.Matcher) error); ok {
+		r1 = rf(ctx, mtype, mname, matchers)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetAlerts provides a mock function with given fields: ctx
+func (_m *Service) GetAlerts(ctx context.Context) []alert.Alert {
+	ret := _m.Called(ctx)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetAlerts")
+	}
+
+	var r0 []alert.Alert
+	if rf, ok := ret.Get(0).(func(context.Context) []alert.Alert); ok {
+		r0 = rf(ctx)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]alert.Alert)
+		}
+	}
+
+	return r0
+}
+
+// GetHistory provides a mock function with given fields: ctx, mtype, mname, labels, from, to, step
+func (_m *Service) GetHistory(ctx context.Context, mtype string, mname string, labels model.Labels, from time.Time, to time.Time, step time.Duration) ([]model.Point, error) {
+	ret := _m.Called(ctx, mtype, mname, labels, from, to, step)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetHistory")
+	}
+
+	var r0 []model.Point
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels, time.Time, time.Time, time.Duration) ([]model.Point, error)); ok {
+		return rf(ctx, mtype, mname, labels, from, to, step)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels, time.Time, time.Time, time.Duration) []model.Point); ok {
+		r0 = rf(ctx, mtype, mname, labels, from, to, step)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Point)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, model.Labels, time.Time, time.Time, time.Duration) error); ok {
+		r1 = rf(ctx, mtype, mname, labels, from, to, step)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMetric provides a mock function with given fields: ctx, mtype, mname, labels
+func (_m *Service) GetMetric(ctx context.Context, mtype string, mname string, labels model.Labels) (*model.Metric, error) {
+	ret := _m.Called(ctx, mtype, mname, labels)
 
 	if len(ret) == 0 {
 		panic("no return value specified for GetMetric")
@@ -25,19 +111,49 @@ func (_m *Service) GetMetric(ctx context.Context, mtype string, mname string) (*
 
 	var r0 *model.Metric
 	var r1 error
-	if rf, ok := ret.Get(0).(func(context.Context, string, string) (*model.Metric, error)); ok {
-		return rf(ctx, mtype, mname)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels) (*model.Metric, error)); ok {
+		return rf(ctx, mtype, mname, labels)
 	}
-	if rf, ok := ret.Get(0).(func(context.Context, string, string) *model.Metric); ok {
-		r0 = rf(ctx, mtype, mname)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string, model.Labels) *model.Metric); ok {
+		r0 = rf(ctx, mtype, mname, labels)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*model.Metric)
 		}
 	}
 
-	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
-		r1 = rf(ctx, mtype, mname)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string, model.Labels) error); ok {
+		r1 = rf(ctx, mtype, mname, labels)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetMetricValues provides a mock function with given fields: ctx, keys
+func (_m *Service) GetMetricValues(ctx context.Context, keys []model.Metric) ([]model.MetricValue, error) {
+	ret := _m.Called(ctx, keys)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetMetricValues")
+	}
+
+	var r0 []model.MetricValue
+	var r1 error
+	if rf, ok := ret.Get(0).(func(context.Context, []model.Metric) ([]model.MetricValue, error)); ok {
+		return rf(ctx, keys)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, []model.Metric) []model.MetricValue); ok {
+		r0 = rf(ctx, keys)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.MetricValue)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, []model.Metric) error); ok {
+		r1 = rf(ctx, keys)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -75,6 +191,43 @@ func (_m *Service) GetMetrics(ctx context.Context) (model.Data, error) {
 	return r0, r1
 }
 
+// ListMetrics provides a mock function with given fields: ctx, f
+func (_m *Service) ListMetrics(ctx context.Context, f model.Filter) ([]model.Metric, int, error) {
+	ret := _m.Called(ctx, f)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ListMetrics")
+	}
+
+	var r0 []model.Metric
+	var r1 int
+	var r2 error
+	if rf, ok := ret.Get(0).(func(context.Context, model.Filter) ([]model.Metric, int, error)); ok {
+		return rf(ctx, f)
+	}
+	if rf, ok := ret.Get(0).(func(context.Context, model.Filter) []model.Metric); ok {
+		r0 = rf(ctx, f)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]model.Metric)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(context.Context, model.Filter) int); ok {
+		r1 = rf(ctx, f)
+	} else {
+		r1 = ret.Get(1).(int)
+	}
+
+	if rf, ok := ret.Get(2).(func(context.Context, model.Filter) error); ok {
+		r2 = rf(ctx, f)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
 // PingStorage provides a mock function with given fields: ctx
 func (_m *Service) PingStorage(ctx context.Context) error {
 	ret := _m.Called(ctx)
@@ -147,6 +300,26 @@ func (_m *Service) SaveMetrics(ctx context.Context, m []model.Metric) error {
 	return r0
 }
 
+// Subscribe provides a mock function with given fields: f, size
+func (_m *Service) Subscribe(f model.Filter, size int) *pubsub.Subscription {
+	ret := _m.Called(f, size)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Subscribe")
+	}
+
+	var r0 *pubsub.Subscription
+	if rf, ok := ret.Get(0).(func(model.Filter, int) *pubsub.Subscription); ok {
+		r0 = rf(f, size)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*pubsub.Subscription)
+		}
+	}
+
+	return r0
+}
+
 // WriteToFile provides a mock function with given fields:
 func (_m *Service) WriteToFile() error {
 	ret := _m.Called()
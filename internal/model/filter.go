@@ -0,0 +1,37 @@
+package model
+
+import "regexp"
+
+// Filter selects metrics by type, name and labels, and a page of the selected ones.
+// Zero fields select everything, a zero Limit means no limit.
+type Filter struct {
+	Types    []string
+	Prefix   string
+	Regex    *regexp.Regexp
+	Matchers []Matcher
+	Offset   int
+	Limit    int
+}
+
+// Match reports whether the metric satisfies the filter, regardless of the page.
+func (f Filter) Match(m Metric) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			if t == m.MType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(m.ID) < len(f.Prefix) || m.ID[:len(f.Prefix)] != f.Prefix {
+		return false
+	}
+	if f.Regex != nil && !f.Regex.MatchString(m.ID) {
+		return false
+	}
+	return MatchLabels(f.Matchers, m.Labels)
+}
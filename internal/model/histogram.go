@@ -0,0 +1,123 @@
+package model
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+)
+
+// ErrHistogramBounds is returned when histograms with different bucket bounds are merged.
+var ErrHistogramBounds = errors.New("histogram bucket bounds mismatch")
+
+// ErrInvalidHistogram is returned when a histogram is malformed.
+var ErrInvalidHistogram = errors.New("invalid histogram")
+
+// DefaultBuckets are the upper bounds used when a histogram is created from a single observation.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram is a distribution of observed values over buckets.
+// Bounds holds the inclusive upper bounds of the buckets in increasing order,
+// Counts holds the number of observations per bucket with one extra bucket for values above the last bound.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"`
+	Sum    float64   `json:"sum"`
+	Count  uint64    `json:"count"`
+}
+
+// NewHistogram creates an empty histogram with the given bucket bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		Bounds: slices.Clone(bounds),
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds a single value to the histogram.
+// NaN and infinite values are skipped, they would make the sum non-finite for good.
+func (h *Histogram) Observe(v float64) {
+	if !isFinite(v) {
+		return
+	}
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+// Merge adds the observations of o to the histogram. Both histograms must have the same bounds.
+func (h *Histogram) Merge(o *Histogram) error {
+	if !slices.Equal(h.Bounds, o.Bounds) {
+		return ErrHistogramBounds
+	}
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Sum += o.Sum
+	h.Count += o.Count
+	return nil
+}
+
+// Validate checks that bounds are finite and increasing, the sum is finite and counts are consistent with them.
+func (h *Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 || !isFinite(h.Sum) {
+		return ErrInvalidHistogram
+	}
+	for i, b := range h.Bounds {
+		if !isFinite(b) || i > 0 && b <= h.Bounds[i-1] {
+			return ErrInvalidHistogram
+		}
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return ErrInvalidHistogram
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the histogram.
+func (h *Histogram) Clone() *Histogram {
+	return &Histogram{
+		Bounds: slices.Clone(h.Bounds),
+		Counts: slices.Clone(h.Counts),
+		Sum:    h.Sum,
+		Count:  h.Count,
+	}
+}
+
+// MergeHistogram applies an incoming histogram metric to the stored histogram and returns the result.
+// The incoming metric either carries a histogram with the same bounds or a single observation in Value.
+// The stored histogram is not modified.
+func MergeHistogram(stored *Histogram, m Metric) (*Histogram, error) {
+	var h *Histogram
+	switch {
+	case stored != nil:
+		h = stored.Clone()
+	case m.Histogram != nil:
+		h = NewHistogram(m.Histogram.Bounds)
+	default:
+		h = NewHistogram(DefaultBuckets)
+	}
+
+	if m.Histogram != nil {
+		if err := h.Merge(m.Histogram); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+	if m.Value != nil {
+		if !isFinite(*m.Value) {
+			return nil, ErrInvalidHistogram
+		}
+		h.Observe(*m.Value)
+	}
+	return h, nil
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
@@ -0,0 +1,94 @@
+package model_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	h := model.NewHistogram([]float64{1, 5})
+	h.Observe(0.5)
+	h.Observe(1)
+	h.Observe(3)
+	h.Observe(10)
+
+	assert.Equal(t, []uint64{2, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(4), h.Count)
+	assert.Equal(t, 14.5, h.Sum)
+	assert.NoError(t, h.Validate())
+
+	h.Observe(math.NaN())
+	h.Observe(math.Inf(1))
+	h.Observe(math.Inf(-1))
+	assert.Equal(t, []uint64{2, 1, 1}, h.Counts)
+	assert.Equal(t, 14.5, h.Sum)
+}
+
+func TestMergeHistogram(t *testing.T) {
+	stored := &model.Histogram{Bounds: []float64{1, 5}, Counts: []uint64{1, 0, 0}, Sum: 0.5, Count: 1}
+
+	t.Run("merge histograms", func(t *testing.T) {
+		m := model.Metric{ID: "latency", MType: "histogram", Histogram: &model.Histogram{
+			Bounds: []float64{1, 5}, Counts: []uint64{0, 2, 1}, Sum: 12, Count: 3,
+		}}
+		h, err := model.MergeHistogram(stored, m)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 2, 1}, h.Counts)
+		assert.Equal(t, uint64(4), h.Count)
+		assert.Equal(t, 12.5, h.Sum)
+		assert.Equal(t, []uint64{1, 0, 0}, stored.Counts)
+	})
+
+	t.Run("observe single value", func(t *testing.T) {
+		v := 2.0
+		h, err := model.MergeHistogram(stored, model.Metric{ID: "latency", MType: "histogram", Value: &v})
+		assert.NoError(t, err)
+		assert.Equal(t, []uint64{1, 1, 0}, h.Counts)
+	})
+
+	t.Run("first observation uses default buckets", func(t *testing.T) {
+		v := 0.2
+		h, err := model.MergeHistogram(nil, model.Metric{ID: "latency", MType: "histogram", Value: &v})
+		assert.NoError(t, err)
+		assert.Equal(t, model.DefaultBuckets, h.Bounds)
+		assert.Equal(t, uint64(1), h.Count)
+	})
+
+	t.Run("bounds mismatch", func(t *testing.T) {
+		m := model.Metric{ID: "latency", MType: "histogram", Histogram: &model.Histogram{
+			Bounds: []float64{1, 10}, Counts: []uint64{0, 1, 0}, Sum: 2, Count: 1,
+		}}
+		_, err := model.MergeHistogram(stored, m)
+		assert.ErrorIs(t, err, model.ErrHistogramBounds)
+	})
+
+	t.Run("non-finite value", func(t *testing.T) {
+		v := math.NaN()
+		_, err := model.MergeHistogram(stored, model.Metric{ID: "latency", MType: "histogram", Value: &v})
+		assert.ErrorIs(t, err, model.ErrInvalidHistogram)
+	})
+}
+
+func TestHistogramValidate(t *testing.T) {
+	tt := []struct {
+		name string
+		h    model.Histogram
+	}{
+		{"counts length", model.Histogram{Bounds: []float64{1}, Counts: []uint64{1}, Count: 1}},
+		{"unsorted bounds", model.Histogram{Bounds: []float64{5, 1}, Counts: []uint64{0, 0, 0}}},
+		{"count mismatch", model.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 1}},
+		{"NaN sum", model.Histogram{Bounds: []float64{1}, Counts: []uint64{0, 1}, Sum: math.NaN(), Count: 1}},
+		{"infinite sum", model.Histogram{Bounds: []float64{1}, Counts: []uint64{0, 1}, Sum: math.Inf(1), Count: 1}},
+		{"infinite bound", model.Histogram{Bounds: []float64{1, math.Inf(1)}, Counts: []uint64{0, 0, 0}}},
+	}
+
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			assert.ErrorIs(t, test.h.Validate(), model.ErrInvalidHistogram)
+		})
+	}
+}
@@ -10,7 +10,7 @@ const HTMLTemplateString = `
     <h1>Metrics</h1>
     <ul>
     {{range .}}{{range .}}
-        <li>ID: {{.ID}}, Value: {{.Value}}, Delta: {{.Delta}}</li>
+        <li>ID: {{.ID}}{{.Labels}}, Value: {{.Value}}, Delta: {{.Delta}}</li>
     {{end}}{{end}}
     </ul>
 </body>
@@ -0,0 +1,194 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Label matcher operators.
+const (
+	MatchEqual     = "="
+	MatchNotEqual  = "!="
+	MatchRegexp    = "=~"
+	MatchNotRegexp = "!~"
+)
+
+var (
+	ErrInvalidLabels = errors.New("invalid labels")
+	ErrInvalidID     = errors.New("invalid metric ID")
+	ErrParseMatcher  = errors.New("failed to parse label matcher")
+)
+
+var (
+	idRe        = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+	labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	matcherRe   = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*(?:,|$)`)
+)
+
+// Labels are the name/value pairs that, together with the ID and the type, identify a metric.
+type Labels map[string]string
+
+// String returns the canonical form of the labels: `{a="1",b="2"}` sorted by name,
+// or an empty string when there are no labels.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[name]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Validate checks that every label has a valid name.
+func (l Labels) Validate() error {
+	for name := range l {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("%w: bad label name %q", ErrInvalidLabels, name)
+		}
+	}
+	return nil
+}
+
+// ValidateID checks that the metric ID is not empty and consists of letters, digits and `_.:-` only.
+// It is required by the ingestion formats that carry labels next to the name, e.g. StatsD,
+// the JSON and URL routes accept any ID.
+func ValidateID(id string) error {
+	if !idRe.MatchString(id) {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return nil
+}
+
+// SeriesKey returns the key of the metric in Data: the ID followed by the canonical labels.
+// The key of a metric without labels is its ID. An ID containing `{` or `"` is quoted,
+// so that it cannot spell out the labels of another series.
+func SeriesKey(id string, l Labels) string {
+	if strings.ContainsAny(id, `{"`) {
+		id = strconv.Quote(id)
+	}
+	return id + l.String()
+}
+
+// Key returns the key of the metric in Data.
+func (m Metric) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// Matcher selects metrics by the value of a label.
+// A missing label is matched as an empty value.
+type Matcher struct {
+	Name  string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher creates a new Matcher. Regular expressions are anchored at both ends.
+func NewMatcher(name, op, value string) (Matcher, error) {
+	m := Matcher{Name: name, Op: op, Value: value}
+	switch op {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return Matcher{}, fmt.Errorf("%w: %w", ErrParseMatcher, err)
+		}
+		m.re = re
+	default:
+		return Matcher{}, fmt.Errorf("%w: unknown operator %q", ErrParseMatcher, op)
+	}
+	return m, nil
+}
+
+// ParseMatchers parses a list of matchers like `{host="a",env=~"prod|stage"}`. The braces are optional.
+func ParseMatchers(s string) ([]Matcher, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		s = s[1 : len(s)-1]
+	}
+
+	matchers := make([]Matcher, 0)
+	for strings.TrimSpace(s) != "" {
+		match := matcherRe.FindStringSubmatch(s)
+		if match == nil {
+			return nil, fmt.Errorf("%w: %q", ErrParseMatcher, s)
+		}
+		value, err := strconv.Unquote(match[3])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrParseMatcher, match[3])
+		}
+		m, err := NewMatcher(match[1], match[2], value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+		s = s[len(match[0]):]
+	}
+	return matchers, nil
+}
+
+// ParseLabels parses labels in their canonical form like `{host="a",env="prod"}`. The braces are optional.
+func ParseLabels(s string) (Labels, error) {
+	matchers, err := ParseMatchers(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+
+	l := make(Labels, len(matchers))
+	for _, m := range matchers {
+		if m.Op != MatchEqual {
+			return nil, fmt.Errorf("%w: unexpected operator %q of label %s", ErrInvalidLabels, m.Op, m.Name)
+		}
+		l[m.Name] = m.Value
+	}
+	return l, nil
+}
+
+// Matches reports whether the labels satisfy the matcher.
+func (m Matcher) Matches(l Labels) bool {
+	v := l[m.Name]
+	switch m.Op {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// MatchLabels reports whether the labels satisfy all the matchers.
+func MatchLabels(matchers []Matcher, l Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(l) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package model_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+func TestSeriesKey(t *testing.T) {
+	assert.Equal(t, "Alloc", model.SeriesKey("Alloc", nil))
+	assert.Equal(t, `Alloc{env="prod",host="a\"b"}`, model.SeriesKey("Alloc", model.Labels{"host": `a"b`, "env": "prod"}))
+
+	m := model.Metric{ID: "Alloc", Labels: model.Labels{"host": "a"}}
+	assert.Equal(t, `Alloc{host="a"}`, m.Key())
+}
+
+func TestValidateID(t *testing.T) {
+	for _, id := range []string{"Alloc", "http_requests_total", "latency.seconds", "cpu:usage-1"} {
+		assert.NoError(t, model.ValidateID(id), id)
+	}
+	for _, id := range []string{"", `Alloc{host="a"}`, "Alloc}", "Heap Alloc", "a\nb"} {
+		assert.ErrorIs(t, model.ValidateID(id), model.ErrInvalidID, id)
+	}
+
+}
+
+func TestSeriesKeyQuotedID(t *testing.T) {
+	// an ID spelling out labels is kept apart from the series with these labels
+	assert.NotEqual(t, model.SeriesKey("foo", model.Labels{"a": "b"}), model.SeriesKey(`foo{a="b"}`, nil))
+	assert.NotEqual(t, model.SeriesKey("foo", model.Labels{"a": "b"}), model.SeriesKey(`"foo"`, model.Labels{"a": "b"}))
+	assert.Equal(t, `"foo{a=\"b\"}"`, model.SeriesKey(`foo{a="b"}`, nil))
+	assert.Equal(t, "Heap Alloc", model.SeriesKey("Heap Alloc", nil))
+}
+
+func TestLabelsValidate(t *testing.T) {
+	assert.NoError(t, model.Labels{"host_1": "a", "_env": ""}.Validate())
+	assert.ErrorIs(t, model.Labels{"1host": "a"}.Validate(), model.ErrInvalidLabels)
+	assert.ErrorIs(t, model.Labels{"host-name": "a"}.Validate(), model.ErrInvalidLabels)
+}
+
+func TestParseMatchers(t *testing.T) {
+	matchers, err := model.ParseMatchers(`{host="a", env=~"prod|stage",dc!="eu",rack!~"r[0-9]+"}`)
+	require.NoError(t, err)
+	require.Len(t, matchers, 4)
+	assert.Equal(t, "host", matchers[0].Name)
+	assert.Equal(t, model.MatchEqual, matchers[0].Op)
+	assert.Equal(t, "a", matchers[0].Value)
+	assert.Equal(t, model.MatchRegexp, matchers[1].Op)
+	assert.Equal(t, model.MatchNotEqual, matchers[2].Op)
+	assert.Equal(t, model.MatchNotRegexp, matchers[3].Op)
+
+	matchers, err = model.ParseMatchers("")
+	require.NoError(t, err)
+	assert.Empty(t, matchers)
+
+	for _, s := range []string{`{host}`, `host="a" env="b"`, `host=a`, `env=~"("`, `1host="a"`} {
+		_, err := model.ParseMatchers(s)
+		assert.ErrorIs(t, err, model.ErrParseMatcher, s)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := model.ParseLabels(`{host="a",env="prod"}`)
+	require.NoError(t, err)
+	assert.Equal(t, model.Labels{"host": "a", "env": "prod"}, labels)
+
+	labels, err = model.ParseLabels("")
+	require.NoError(t, err)
+	assert.Nil(t, labels)
+
+	_, err = model.ParseLabels(`{host=~"a"}`)
+	assert.ErrorIs(t, err, model.ErrInvalidLabels)
+	_, err = model.ParseLabels(`{host}`)
+	assert.ErrorIs(t, err, model.ErrParseMatcher)
+}
+
+func TestMatchLabels(t *testing.T) {
+	labels := model.Labels{"host": "a", "env": "production"}
+
+	tt := []struct {
+		matchers string
+		expected bool
+	}{
+		{`host="a"`, true},
+		{`host="b"`, false},
+		{`host!="b"`, true},
+		{`env=~"prod"`, false},
+		{`env=~"prod.*"`, true},
+		{`env!~"stage|test"`, true},
+		{`dc=""`, true},
+		{`dc!=""`, false},
+		{`host="a",env=~"stage"`, false},
+	}
+
+	for _, test := range tt {
+		matchers, err := model.ParseMatchers(test.matchers)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, model.MatchLabels(matchers, labels), test.matchers)
+	}
+}
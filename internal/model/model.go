@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type AgentMetric struct {
 	MType string `json:"type"`
 	ID    string `json:"id"`
@@ -8,10 +10,26 @@ type AgentMetric struct {
 }
 
 type Metric struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
+	ID        string     `json:"id"`
+	MType     string     `json:"type"`
+	Delta     *int64     `json:"delta,omitempty"`
+	Value     *float64   `json:"value,omitempty"`
+	Histogram *Histogram `json:"histogram,omitempty"`
+	Labels    Labels     `json:"labels,omitempty"`
+}
+
+// MetricValue is a metric looked up by a batch read.
+// When the metric does not exist, Found is false and only the identity of the metric is set.
+type MetricValue struct {
+	Metric
+	Found bool `json:"found"`
+}
+
+// Point is a single sample of a metric in time.
+// For counters the value is the accumulated total at that moment.
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
 }
 
 type Error struct {
@@ -0,0 +1,89 @@
+// Package pubsub delivers the stored metric updates to subscribers.
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+// Subscription receives the published metrics satisfying its filter.
+// When its buffer is full, new metrics are dropped and counted instead of blocking the publisher.
+type Subscription struct {
+	bus     *Bus
+	filter  model.Filter
+	ch      chan model.Metric
+	dropped atomic.Int64
+}
+
+// C returns the channel delivering the metrics. It is closed when the subscription is closed.
+func (s *Subscription) C() <-chan model.Metric {
+	return s.ch
+}
+
+// Dropped returns the number of metrics dropped because the buffer was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Close unsubscribes from the bus.
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// Bus fans the published metrics out to the subscribers.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+// NewBus creates a new Bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe creates a subscription to the metrics satisfying the filter with a buffer of size metrics.
+// The page of the filter is ignored.
+func (b *Bus) Subscribe(f model.Filter, size int) *Subscription {
+	s := &Subscription{
+		bus:    b,
+		filter: f,
+		ch:     make(chan model.Metric, size),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Publish delivers the metrics to the subscribers without blocking.
+func (b *Bus) Publish(metrics ...model.Metric) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for s := range b.subs {
+		for _, m := range metrics {
+			if !s.filter.Match(m) {
+				continue
+			}
+			select {
+			case s.ch <- m:
+			default:
+				s.dropped.Add(1)
+			}
+		}
+	}
+}
+
+func (b *Bus) unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.ch)
+}
@@ -0,0 +1,54 @@
+package pubsub_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/pubsub"
+)
+
+func TestPublish(t *testing.T) {
+	v := 1.5
+	gauge := model.Metric{ID: "m1", MType: "gauge", Value: &v}
+	other := model.Metric{ID: "m2", MType: "gauge", Value: &v}
+
+	b := pubsub.NewBus()
+	all := b.Subscribe(model.Filter{}, 10)
+	m1 := b.Subscribe(model.Filter{Prefix: "m1"}, 10)
+
+	b.Publish(gauge, other)
+
+	assert.Equal(t, gauge, <-all.C())
+	assert.Equal(t, other, <-all.C())
+	assert.Equal(t, gauge, <-m1.C())
+	assert.Len(t, m1.C(), 0)
+}
+
+func TestPublishDrop(t *testing.T) {
+	v := 1.5
+	m := model.Metric{ID: "m1", MType: "gauge", Value: &v}
+
+	b := pubsub.NewBus()
+	s := b.Subscribe(model.Filter{}, 2)
+	b.Publish(m, m, m, m)
+
+	assert.Len(t, s.C(), 2)
+	assert.Equal(t, int64(2), s.Dropped())
+}
+
+func TestClose(t *testing.T) {
+	v := 1.5
+	m := model.Metric{ID: "m1", MType: "gauge", Value: &v}
+
+	b := pubsub.NewBus()
+	s := b.Subscribe(model.Filter{}, 1)
+	s.Close()
+	s.Close()
+	b.Publish(m)
+
+	_, ok := <-s.C()
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), s.Dropped())
+}
@@ -0,0 +1,282 @@
+package repository
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+var (
+	metricsBucket = []byte("metrics")
+	historyBucket = []byte("history")
+)
+
+// BoltStorage represents a storage in a bbolt key-value database file.
+// The metrics are kept as JSON in a bucket per type under their key, and the samples of gauges
+// and counters in a bucket per metric ordered by time, capped at HistorySize samples.
+type BoltStorage struct {
+	db     *bolt.DB
+	logger *zerolog.Logger
+}
+
+// NewBoltStorage opens the bbolt database at path, creating it when needed.
+func NewBoltStorage(logger *zerolog.Logger, path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(metricsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{
+		db:     db,
+		logger: logger,
+	}, nil
+}
+
+// Close closes the database.
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// Load retrieves a specific metric by its type, name and labels.
+func (s *BoltStorage) Load(_ context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error) {
+	var m *model.Metric
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = loadBolt(tx, mtype, model.SeriesKey(mname, labels))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadAll retrieves all metrics.
+func (s *BoltStorage) LoadAll(_ context.Context) (model.Data, error) {
+	result := make(model.Data)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metricsBucket).ForEachBucket(func(mtype []byte) error {
+			metrics := make(map[string]model.Metric)
+			result[string(mtype)] = metrics
+			return tx.Bucket(metricsBucket).Bucket(mtype).ForEach(func(k, v []byte) error {
+				var m model.Metric
+				if err := json.Unmarshal(v, &m); err != nil {
+					return err
+				}
+				metrics[string(k)] = m
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Msg("LoadAll method error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// LoadMetrics retrieves the metrics identified by the type, name and labels of keys, in the same order,
+// from a single snapshot.
+func (s *BoltStorage) LoadMetrics(_ context.Context, keys []model.Metric) ([]model.MetricValue, error) {
+	result := make([]model.MetricValue, len(keys))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for i, k := range keys {
+			m, err := loadBolt(tx, k.MType, k.Key())
+			if errors.Is(err, ErrNotFound) {
+				result[i] = model.MetricValue{Metric: model.Metric{ID: k.ID, MType: k.MType, Labels: k.Labels}}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result[i] = model.MetricValue{Metric: *m, Found: true}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// StoreMetric saves a single metric.
+func (s *BoltStorage) StoreMetric(ctx context.Context, m model.Metric) error {
+	return s.StoreMetrics(ctx, []model.Metric{m})
+}
+
+// StoreMetrics saves multiple metrics within a single transaction.
+func (s *BoltStorage) StoreMetrics(_ context.Context, metrics []model.Metric) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, m := range metrics {
+			if err := storeBolt(tx, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Error().Err(err).Msg("StoreMetrics: store data error")
+		return err
+	}
+	return nil
+}
+
+func storeBolt(tx *bolt.Tx, m model.Metric) error {
+	b, err := tx.Bucket(metricsBucket).CreateBucketIfNotExists([]byte(m.MType))
+	if err != nil {
+		return err
+	}
+	key := m.Key()
+	stored, err := loadBolt(tx, m.MType, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	switch m.MType {
+	case service.TypeGauge:
+		m = model.Metric{ID: m.ID, MType: m.MType, Value: m.Value, Labels: m.Labels}
+	case service.TypeCounter:
+		delta := *m.Delta
+		if stored != nil {
+			delta += *stored.Delta
+		}
+		m = model.Metric{ID: m.ID, MType: m.MType, Delta: &delta, Labels: m.Labels}
+	case service.TypeHistogram:
+		var current *model.Histogram
+		if stored != nil {
+			current = stored.Histogram
+		}
+		h, err := model.MergeHistogram(current, m)
+		if err != nil {
+			return err
+		}
+		m = model.Metric{ID: m.ID, MType: m.MType, Histogram: h, Labels: m.Labels}
+	}
+
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(key), v); err != nil {
+		return err
+	}
+	return recordBolt(tx, m)
+}
+
+// recordBolt appends the current value of a gauge or a counter to its history, dropping the oldest sample
+// once there are more than HistorySize.
+func recordBolt(tx *bolt.Tx, m model.Metric) error {
+	var v float64
+	switch m.MType {
+	case service.TypeGauge:
+		v = *m.Value
+	case service.TypeCounter:
+		v = float64(*m.Delta)
+	default:
+		return nil
+	}
+
+	b, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(m.MType + "/" + m.Key()))
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	// the sequence keeps the samples taken at the same time apart
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, math.Float64bits(v))
+	if err := b.Put(k, val); err != nil {
+		return err
+	}
+
+	if seq > HistorySize {
+		c := b.Cursor()
+		if first, _ := c.First(); first != nil {
+			return c.Delete()
+		}
+	}
+	return nil
+}
+
+// LoadHistory retrieves the samples of a metric received within [from, to].
+func (s *BoltStorage) LoadHistory(_ context.Context, mtype, mname string, labels model.Labels, from, to time.Time) ([]model.Point, error) {
+	key := model.SeriesKey(mname, labels)
+	result := make([]model.Point, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket).Bucket([]byte(mtype + "/" + key))
+		if b == nil {
+			_, err := loadBolt(tx, mtype, key)
+			return err
+		}
+
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, uint64(from.UnixNano()))
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+			if ts.After(to) {
+				break
+			}
+			result = append(result, model.Point{Timestamp: ts, Value: math.Float64frombits(binary.BigEndian.Uint64(v))})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// PingStorage checks the storage is open.
+func (s *BoltStorage) PingStorage(_ context.Context) error {
+	return s.db.View(func(*bolt.Tx) error { return nil })
+}
+
+func (s *BoltStorage) RestoreFromFile() error {
+	return errNotSupported
+}
+
+func (s *BoltStorage) WriteToFile() error {
+	return errNotSupported
+}
+
+func loadBolt(tx *bolt.Tx, mtype, key string) (*model.Metric, error) {
+	var v []byte
+	if b := tx.Bucket(metricsBucket).Bucket([]byte(mtype)); b != nil {
+		v = b.Get([]byte(key))
+	}
+	if v == nil {
+		return nil, fmt.Errorf("metric %s of type %s: %w", key, mtype, ErrNotFound)
+	}
+	var m model.Metric
+	if err := json.Unmarshal(v, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -3,7 +3,12 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 
@@ -13,43 +18,69 @@ import (
 
 var errNotSupported = errors.New("not supported when DB is enabled")
 
+// ErrNotFound is returned by every storage when the requested metric does not exist.
+var ErrNotFound = errors.New("metric not found")
+
 // Storage represents a storage
 type Storage struct {
-	db     *sql.DB
-	logger *zerolog.Logger
+	db      *sql.DB
+	logger  *zerolog.Logger
+	trimmer *historyTrimmer
 }
 
 // NewStorage creates a new Storage.
 func NewStorage(logger *zerolog.Logger, db *sql.DB) *Storage {
 	return &Storage{
-		logger: logger,
-		db:     db,
+		logger:  logger,
+		db:      db,
+		trimmer: newHistoryTrimmer(),
 	}
 }
 
-// Load retrieves a specific metric by its type and name from the database.
-func (s *Storage) Load(ctx context.Context, mtype, mname string) (*model.Metric, error) {
+// Load retrieves a specific metric by its type, name and labels from the database.
+func (s *Storage) Load(ctx context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error) {
 	var mID, mType string
 	var mValue sql.NullFloat64
 	var mDelta sql.NullInt64
+	var mHistogram, mLabels []byte
 
-	row := s.db.QueryRowContext(ctx, "SELECT id, type, value, delta FROM metrics WHERE type = $1 AND id = $2", mtype, mname)
-	if err := row.Scan(&mID, &mType, &mValue, &mDelta); err != nil {
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT id, type, value, delta, histogram, labels FROM metrics WHERE type = $1 AND id = $2 AND labels = $3",
+		mtype, mname, encodeLabels(labels),
+	)
+	err := row.Scan(&mID, &mType, &mValue, &mDelta, &mHistogram, &mLabels)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("metric %s of type %s: %w", model.SeriesKey(mname, labels), mtype, ErrNotFound)
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Load method error")
+		return nil, err
+	}
+	h, err := parseHistogram(mHistogram)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Load method error")
+		return nil, err
+	}
+	l, err := parseLabels(mLabels)
+	if err != nil {
 		s.logger.Error().Err(err).Msg("Load method error")
 		return nil, err
 	}
 
 	return &model.Metric{
-		MType: mType,
-		ID:    mID,
-		Value: parseValue(mValue),
-		Delta: parseDelta(mDelta),
+		MType:     mType,
+		ID:        mID,
+		Value:     parseValue(mValue),
+		Delta:     parseDelta(mDelta),
+		Histogram: h,
+		Labels:    l,
 	}, nil
 }
 
 // LoadAll retrieves all metrics from the database.
 func (s *Storage) LoadAll(ctx context.Context) (model.Data, error) {
-	rows, err := s.db.QueryContext(ctx, "SELECT id,type,value,delta FROM metrics")
+	rows, err := s.db.QueryContext(ctx, "SELECT id,type,value,delta,histogram,labels FROM metrics")
 	if err != nil {
 		s.logger.Error().Err(err).Msg("LoadAll: select statement error")
 		return nil, err
@@ -61,29 +92,36 @@ func (s *Storage) LoadAll(ctx context.Context) (model.Data, error) {
 		var mID, mType string
 		var mValue sql.NullFloat64
 		var mDelta sql.NullInt64
+		var mHistogram, mLabels []byte
 
-		if err := rows.Scan(&mID, &mType, &mValue, &mDelta); err != nil {
+		if err := rows.Scan(&mID, &mType, &mValue, &mDelta, &mHistogram, &mLabels); err != nil {
 			s.logger.Error().Err(err).Msg("LoadAll: scan rows error")
 			return nil, err
 		}
+		h, err := parseHistogram(mHistogram)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("LoadAll: parse histogram error")
+			return nil, err
+		}
+		l, err := parseLabels(mLabels)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("LoadAll: parse labels error")
+			return nil, err
+		}
+		m := model.Metric{
+			ID:        mID,
+			MType:     mType,
+			Delta:     parseDelta(mDelta),
+			Value:     parseValue(mValue),
+			Histogram: h,
+			Labels:    l,
+		}
 		_, ok := result[mType]
 		if !ok {
-			result[mType] = map[string]model.Metric{
-				mID: {
-					ID:    mID,
-					MType: mType,
-					Delta: parseDelta(mDelta),
-					Value: parseValue(mValue),
-				},
-			}
+			result[mType] = map[string]model.Metric{m.Key(): m}
 			continue
 		}
-		result[mType][mID] = model.Metric{
-			ID:    mID,
-			MType: mType,
-			Delta: parseDelta(mDelta),
-			Value: parseValue(mValue),
-		}
+		result[mType][m.Key()] = m
 	}
 	if err := rows.Err(); err != nil {
 		s.logger.Error().Err(err).Msg("LoadAll method error")
@@ -93,21 +131,116 @@ func (s *Storage) LoadAll(ctx context.Context) (model.Data, error) {
 	return result, nil
 }
 
-// StoreMetrics saves multiple metrics to the database.
-func (s *Storage) StoreMetrics(ctx context.Context, metrics []model.Metric) error {
-	tx, err := s.db.BeginTx(ctx, nil)
+// maxLoadKeys caps the keys looked up by a single query to stay within the limit of query parameters.
+const maxLoadKeys = 10000
+
+// LoadMetrics retrieves the metrics identified by the type, name and labels of keys, in the same order,
+// with a single query per maxLoadKeys keys.
+func (s *Storage) LoadMetrics(ctx context.Context, keys []model.Metric) ([]model.MetricValue, error) {
+	result := make([]model.MetricValue, len(keys))
+	for i, k := range keys {
+		result[i] = model.MetricValue{Metric: model.Metric{ID: k.ID, MType: k.MType, Labels: k.Labels}}
+	}
+
+	found := make(map[string]model.Metric, len(keys))
+	for chunk := keys; len(chunk) > 0; {
+		n := min(len(chunk), maxLoadKeys)
+		if err := s.loadMetrics(ctx, chunk[:n], found); err != nil {
+			return nil, err
+		}
+		chunk = chunk[n:]
+	}
+
+	for i, k := range keys {
+		if m, ok := found[k.MType+":"+k.Key()]; ok {
+			result[i] = model.MetricValue{Metric: m, Found: true}
+		}
+	}
+	return result, nil
+}
+
+// loadMetrics puts the stored metrics among keys into found by type and key.
+func (s *Storage) loadMetrics(ctx context.Context, keys []model.Metric, found map[string]model.Metric) error {
+	var query strings.Builder
+	query.WriteString("SELECT id, type, value, delta, histogram, labels FROM metrics WHERE (type, id, labels) IN (")
+	args := make([]any, 0, len(keys)*3)
+	for i, k := range keys {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		fmt.Fprintf(&query, "($%d, $%d, $%d::jsonb)", i*3+1, i*3+2, i*3+3)
+		args = append(args, k.MType, k.ID, encodeLabels(k.Labels))
+	}
+	query.WriteString(")")
+
+	rows, err := s.db.QueryContext(ctx, query.String(), args...)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("StoreMetrics: begin transaction error")
+		s.logger.Error().Err(err).Msg("LoadMetrics: select statement error")
 		return err
 	}
+	defer rows.Close()
 
-	for _, metric := range metrics {
-		err = store(ctx, tx, s.logger, metric)
+	for rows.Next() {
+		var mID, mType string
+		var mValue sql.NullFloat64
+		var mDelta sql.NullInt64
+		var mHistogram, mLabels []byte
+
+		if err := rows.Scan(&mID, &mType, &mValue, &mDelta, &mHistogram, &mLabels); err != nil {
+			s.logger.Error().Err(err).Msg("LoadMetrics: scan rows error")
+			return err
+		}
+		h, err := parseHistogram(mHistogram)
 		if err != nil {
-			s.logger.Error().Err(err).Msg("StoreMetrics: store data error")
-			tx.Rollback()
+			s.logger.Error().Err(err).Msg("LoadMetrics: parse histogram error")
 			return err
 		}
+		l, err := parseLabels(mLabels)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("LoadMetrics: parse labels error")
+			return err
+		}
+		m := model.Metric{
+			ID:        mID,
+			MType:     mType,
+			Delta:     parseDelta(mDelta),
+			Value:     parseValue(mValue),
+			Histogram: h,
+			Labels:    l,
+		}
+		found[mType+":"+m.Key()] = m
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error().Err(err).Msg("LoadMetrics method error")
+		return err
+	}
+	return nil
+}
+
+// maxUpsertRows caps the rows of a single upsert statement to stay within the limit of query parameters.
+const maxUpsertRows = 1000
+
+// StoreMetrics saves multiple metrics to the database within a single transaction.
+// The metrics with the same key are aggregated first, then all of them are upserted with multi-row
+// statements recording the new values in the history as well: counters are incremented in SQL,
+// gauges are overwritten and histograms are merged with the stored ones locked for update.
+func (s *Storage) StoreMetrics(ctx context.Context, metrics []model.Metric) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("StoreMetrics: begin transaction error")
+		return err
+	}
+
+	aggregated := aggregate(metrics)
+	if err := upsert(ctx, tx, aggregated); err != nil {
+		s.logger.Error().Err(err).Msg("StoreMetrics: store data error")
+		tx.Rollback()
+		return err
+	}
+	if err := trimHistory(ctx, tx, s.trimmer.due(aggregated)); err != nil {
+		s.logger.Error().Err(err).Msg("StoreMetrics: trim history error")
+		tx.Rollback()
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -118,81 +251,263 @@ func (s *Storage) StoreMetrics(ctx context.Context, metrics []model.Metric) erro
 	return nil
 }
 
-func store(ctx context.Context, tx *sql.Tx, logger *zerolog.Logger, m model.Metric) error {
-	logger.Info().Any("metric", m).Send()
+// aggregate merges the metrics with the same type and key, keeping the order of their first occurrence.
+// The deltas of counters are summed and the last value of gauges wins, histograms are kept as they are
+// to be merged with the stored ones.
+func aggregate(metrics []model.Metric) []model.Metric {
+	result := make([]model.Metric, 0, len(metrics))
+	index := make(map[string]int, len(metrics))
+	for _, m := range metrics {
+		if m.MType == service.TypeHistogram {
+			result = append(result, m)
+			continue
+		}
+		key := m.MType + ":" + m.Key()
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(result)
+			result = append(result, m)
+			continue
+		}
+		if m.MType == service.TypeCounter {
+			delta := *result[i].Delta + *m.Delta
+			m.Delta = &delta
+		}
+		result[i] = m
+	}
+	return result
+}
 
-	var mID, mType string
-	var mDelta sql.NullInt64
+// upsert stores the aggregated metrics. They are sorted by type and key first, so concurrent
+// transactions lock the rows in the same order and do not deadlock.
+func upsert(ctx context.Context, tx *sql.Tx, metrics []model.Metric) error {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].Key() < metrics[j].Key()
+	})
 
-	raw := tx.QueryRowContext(ctx, "SELECT id, type, delta FROM metrics WHERE id = $1 AND type = $2", m.ID, m.MType)
-	err := raw.Scan(&mID, &mType, &mDelta)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		logger.Error().Err(err).Msg("store: scan row error")
+	histograms, err := mergeHistograms(ctx, tx, metrics)
+	if err != nil {
 		return err
 	}
 
-	if m.MType == service.TypeCounter {
-		switch {
-		case mID != "":
-			_, err = tx.ExecContext(
-				ctx,
-				"UPDATE metrics SET delta = $1 WHERE id = $2 AND type = $3",
-				mDelta.Int64+*m.Delta, m.ID, m.MType,
-			)
-		default:
-			_, err = tx.ExecContext(
-				ctx,
-				"INSERT INTO metrics (id, type, delta) VALUES ($1,$2,$3)",
-				m.ID, m.MType, *m.Delta,
-			)
+	type row struct {
+		m         model.Metric
+		histogram []byte
+	}
+	rows := make([]row, 0, len(metrics))
+	for _, m := range metrics {
+		if m.MType != service.TypeHistogram {
+			rows = append(rows, row{m: m})
+			continue
+		}
+		key := m.Key()
+		h, ok := histograms[key]
+		if !ok {
+			// merged into the first occurrence
+			continue
 		}
+		delete(histograms, key)
+		b, err := json.Marshal(h)
 		if err != nil {
-			logger.Error().Err(err).Msg("store: error to store counter")
 			return err
 		}
+		rows = append(rows, row{m: model.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels}, histogram: b})
 	}
 
-	if m.MType == service.TypeGauge {
-		switch {
-		case mID != "":
-			_, err = tx.ExecContext(
-				ctx,
-				"UPDATE metrics SET value = $1 WHERE id = $2 AND type = $3",
-				m.Value, m.ID, m.MType,
-			)
-		default:
-			_, err = tx.ExecContext(
-				ctx,
-				"INSERT INTO metrics (id, type, value) VALUES ($1,$2,$3)",
-				m.ID, m.MType, *m.Value,
-			)
+	for len(rows) > 0 {
+		n := min(len(rows), maxUpsertRows)
+
+		var query strings.Builder
+		query.WriteString("WITH stored AS (INSERT INTO metrics (id, type, value, delta, histogram, labels) VALUES ")
+		args := make([]any, 0, n*6)
+		for i, r := range rows[:n] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d, $%d)", i*6+1, i*6+2, i*6+3, i*6+4, i*6+5, i*6+6)
+			var histogram any
+			if r.histogram != nil {
+				histogram = r.histogram
+			}
+			args = append(args, r.m.ID, r.m.MType, r.m.Value, r.m.Delta, histogram, encodeLabels(r.m.Labels))
 		}
-		if err != nil {
-			logger.Error().Err(err).Msg("store: error to store gauge")
+		query.WriteString(` ON CONFLICT (id, type, labels) DO UPDATE SET
+			value = EXCLUDED.value,
+			delta = metrics.delta + EXCLUDED.delta,
+			histogram = EXCLUDED.histogram
+			RETURNING id, type, value, delta, histogram, labels)
+			INSERT INTO metrics_history (id, type, value, labels)
+			SELECT id, type, COALESCE(value, delta), labels FROM stored WHERE histogram IS NULL`)
+
+		if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
 			return err
 		}
+		rows = rows[n:]
 	}
 
 	return nil
 }
 
-// StoreMetric saves a single metric to the database.
-func (s *Storage) StoreMetric(ctx context.Context, m model.Metric) error {
-	tx, err := s.db.BeginTx(ctx, nil)
+// trimHistory drops the oldest samples beyond HistorySize from the history of the series.
+func trimHistory(ctx context.Context, tx *sql.Tx, series []model.Metric) error {
+	for len(series) > 0 {
+		n := min(len(series), maxUpsertRows)
+
+		var keys strings.Builder
+		args := []any{HistorySize}
+		for i, m := range series[:n] {
+			if i > 0 {
+				keys.WriteString(", ")
+			}
+			fmt.Fprintf(&keys, "($%d, $%d, $%d::jsonb)", len(args)+1, len(args)+2, len(args)+3)
+			args = append(args, m.MType, m.ID, encodeLabels(m.Labels))
+		}
+		_, err := tx.ExecContext(
+			ctx,
+			`DELETE FROM metrics_history WHERE ctid IN (
+				SELECT ctid FROM (
+					SELECT ctid, row_number() OVER (PARTITION BY type, id, labels ORDER BY ts DESC) AS rn
+					FROM metrics_history WHERE (type, id, labels) IN (`+keys.String()+`)
+				) ranked WHERE rn > $1
+			)`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		series = series[n:]
+	}
+	return nil
+}
+
+// mergeHistograms merges the histogram metrics into the stored histograms and returns the results by metric key.
+// The missing rows are inserted empty first, so that every stored histogram, new or not, is locked for update
+// until the transaction ends and no concurrent merge is lost.
+func mergeHistograms(ctx context.Context, tx *sql.Tx, metrics []model.Metric) (map[string]*model.Histogram, error) {
+	var insert, keys strings.Builder
+	args := []any{service.TypeHistogram}
+	for _, m := range metrics {
+		if m.MType != service.TypeHistogram {
+			continue
+		}
+		if len(args) > 1 {
+			insert.WriteString(", ")
+			keys.WriteString(", ")
+		}
+		fmt.Fprintf(&insert, "($%d, $1, $%d::jsonb)", len(args)+1, len(args)+2)
+		fmt.Fprintf(&keys, "($%d, $%d::jsonb)", len(args)+1, len(args)+2)
+		args = append(args, m.ID, encodeLabels(m.Labels))
+	}
+	if len(args) == 1 {
+		return nil, nil
+	}
+
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO metrics (id, type, labels) VALUES "+insert.String()+" ON CONFLICT (id, type, labels) DO NOTHING",
+		args...,
+	)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Store: begin transaction error")
-		return err
+		return nil, err
 	}
-	if err := store(ctx, tx, s.logger, m); err != nil {
-		s.logger.Error().Err(err).Msg("Store: store data error")
-		tx.Rollback()
-		return err
+
+	rows, err := tx.QueryContext(
+		ctx,
+		"SELECT id, histogram, labels FROM metrics WHERE type = $1 AND (id, labels) IN ("+keys.String()+") ORDER BY id, labels FOR UPDATE",
+		args...,
+	)
+	if err != nil {
+		return nil, err
 	}
-	if err := tx.Commit(); err != nil {
-		s.logger.Error().Err(err).Msg("Store: commit transaction error")
-		return err
+	defer rows.Close()
+
+	result := make(map[string]*model.Histogram)
+	for rows.Next() {
+		var mID string
+		var mHistogram, mLabels []byte
+		if err := rows.Scan(&mID, &mHistogram, &mLabels); err != nil {
+			return nil, err
+		}
+		h, err := parseHistogram(mHistogram)
+		if err != nil {
+			return nil, err
+		}
+		l, err := parseLabels(mLabels)
+		if err != nil {
+			return nil, err
+		}
+		result[model.Metric{ID: mID, Labels: l}.Key()] = h
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, m := range metrics {
+		if m.MType != service.TypeHistogram {
+			continue
+		}
+		h, err := model.MergeHistogram(result[m.Key()], m)
+		if err != nil {
+			return nil, err
+		}
+		result[m.Key()] = h
+	}
+	return result, nil
+}
+
+// LoadHistory retrieves the samples of a metric received within [from, to] from the database.
+func (s *Storage) LoadHistory(ctx context.Context, mtype, mname string, labels model.Labels, from, to time.Time) ([]model.Point, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		// the history is trimmed once in a while, only the latest HistorySize samples are returned meanwhile
+		`SELECT ts, value FROM (
+			SELECT ts, value FROM metrics_history WHERE type = $1 AND id = $2 AND labels = $3 AND ts BETWEEN $4 AND $5
+			ORDER BY ts DESC LIMIT $6
+		) latest ORDER BY ts`,
+		mtype, mname, encodeLabels(labels), from, to, HistorySize,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("LoadHistory: select statement error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.Point, 0)
+	for rows.Next() {
+		var p model.Point
+		if err := rows.Scan(&p.Timestamp, &p.Value); err != nil {
+			s.logger.Error().Err(err).Msg("LoadHistory: scan rows error")
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error().Err(err).Msg("LoadHistory method error")
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		var exists int
+		row := s.db.QueryRowContext(ctx, "SELECT 1 FROM metrics WHERE type = $1 AND id = $2 AND labels = $3", mtype, mname, encodeLabels(labels))
+		err := row.Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("metric %s of type %s: %w", model.SeriesKey(mname, labels), mtype, ErrNotFound)
+		}
+		if err != nil {
+			s.logger.Error().Err(err).Msg("LoadHistory method error")
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// StoreMetric saves a single metric to the database.
+func (s *Storage) StoreMetric(ctx context.Context, m model.Metric) error {
+	return s.StoreMetrics(ctx, []model.Metric{m})
 }
 
 // PingStorage checks the connection to the storage.
@@ -214,6 +529,40 @@ func parseValue(v sql.NullFloat64) *float64 {
 	return nil
 }
 
+func parseHistogram(b []byte) (*model.Histogram, error) {
+	if b == nil {
+		return nil, nil
+	}
+	var h model.Histogram
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func parseLabels(b []byte) (model.Labels, error) {
+	var l model.Labels
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+	if len(l) == 0 {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// encodeLabels returns the JSONB representation of the labels, `{}` when there are none.
+func encodeLabels(l model.Labels) string {
+	if len(l) == 0 {
+		return "{}"
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
 func (s *Storage) RestoreFromFile() error {
 	return errNotSupported
 }
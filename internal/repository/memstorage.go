@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 
@@ -15,141 +17,400 @@ import (
 )
 
 // MemStorage represents an in-memory storage for metrics.
+// When a file is set, every stored batch is appended to a write-ahead log next to it
+// and WriteToFile compacts the log into a snapshot of all metrics in the file.
 type MemStorage struct {
 	mu              sync.RWMutex
 	logger          *zerolog.Logger
 	data            model.Data
-	interval        int
+	history         map[string]*ring
 	storageFileName string
+	wal             *wal
+	// snapshotMu serializes the snapshots
+	snapshotMu sync.Mutex
+	// stop ends the goroutine syncing the log, which closes done
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewMemStorage creates a new MemStorage
+// NewMemStorage creates a new MemStorage.
+// The log is synced on every write when interval is 0, and at most once per second otherwise.
+// Close must be called to stop syncing the log.
 func NewMemStorage(logger *zerolog.Logger, interval int, file string) *MemStorage {
-	return &MemStorage{
+	s := &MemStorage{
 		logger:          logger,
-		interval:        interval,
 		storageFileName: file,
 		data:            make(model.Data),
+		history:         make(map[string]*ring),
 	}
+	if file != "" {
+		s.wal = newWAL(file)
+		if interval == 0 {
+			s.wal.policy = FsyncAlways
+		}
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.syncWAL(fsyncInterval)
+	}
+	return s
 }
 
-// RestoreFromFile restores data from a file.
-func (s *MemStorage) RestoreFromFile() error {
-	_, err := os.Stat(s.storageFileName)
-	if errors.Is(err, os.ErrNotExist) {
-		return os.ErrNotExist
+// syncWAL syncs the writes left unsynced by FsyncInterval every interval until Close.
+func (s *MemStorage) syncWAL(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			err := s.wal.syncDirty()
+			s.mu.Unlock()
+			if err != nil {
+				s.logger.Error().Err(err).Msg("Failed to sync storage write-ahead log")
+			}
+		case <-s.stop:
+			return
+		}
 	}
-	if err != nil {
-		return err
+}
+
+// SetFsync sets the fsync policy of the write-ahead log: FsyncAlways, FsyncInterval or FsyncNever.
+func (s *MemStorage) SetFsync(policy string) error {
+	if policy != FsyncAlways && policy != FsyncInterval && policy != FsyncNever {
+		return fmt.Errorf("unknown fsync policy: %s", policy)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal != nil {
+		s.wal.policy = policy
 	}
+	return nil
+}
+
+// RestoreFromFile restores data from the snapshot in the file and then replays the write-ahead log over it.
+// A corrupt log record is dropped with the ones following it in its log, with a warning.
+// It returns os.ErrNotExist when there is neither.
+func (s *MemStorage) RestoreFromFile() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	b, err := os.ReadFile(s.storageFileName)
-	if err != nil {
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
+	snapshot := err == nil
+	if snapshot {
+		if err := json.Unmarshal(b, &s.data); err != nil {
+			return err
+		}
+	}
 
-	if err := json.Unmarshal(b, &s.data); err != nil {
+	if s.wal == nil {
+		if !snapshot {
+			return os.ErrNotExist
+		}
+		return nil
+	}
+	records := 0
+	err = s.wal.restore(func(metrics []model.Metric) {
+		records++
+		for _, m := range metrics {
+			s.set(m)
+		}
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		if !snapshot {
+			return os.ErrNotExist
+		}
+		err = nil
+	}
+	if errors.Is(err, errCorruptWAL) {
+		// the corrupt records are dropped, the storage holds everything else
+		s.logger.Warn().Err(err).Msg("Corrupt write-ahead log records are dropped")
+		err = nil
+	}
+	if err != nil {
 		return err
 	}
-	s.logger.Info().Msgf("RestoreFromFile: %+v", s.data)
+	s.logger.Info().Bool("snapshot", snapshot).Int("records", records).Msg("Storage restored")
 	return nil
 }
 
-// WriteToFile writes data to a file.
+// WriteToFile writes a snapshot of all metrics to the file and drops the write-ahead log it covers.
+// The snapshot replaces the file only once it is written in full.
 func (s *MemStorage) WriteToFile() error {
-	file, err := os.OpenFile(s.storageFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	s.mu.Lock()
+	data := copyData(s.data)
+	if s.wal != nil {
+		if err := s.wal.rotate(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	s.mu.Unlock()
+
+	b, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	s.logger.Info().Msg("File successfully opened")
+	if err := writeFileAtomic(s.storageFileName, b); err != nil {
+		return err
+	}
+	s.logger.Info().Msgf("%d bytes were written to the file", len(b))
+
+	if s.wal != nil {
+		return s.wal.removeOld()
+	}
+	return nil
+}
 
-	b, err := json.MarshalIndent(s.data, "", "  ")
+// Close stops syncing the write-ahead log, then syncs and closes it.
+func (s *MemStorage) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wal.close()
+}
+
+// writeFileAtomic writes b to a temporary file next to path, syncs it and renames it to path.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	s.logger.Info().Msgf("Data successfully marshalled: %v", string(b))
+	tmp := f.Name()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
 
-	n, err := file.Write(b)
+	// the rename is durable once the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
 	if err != nil {
 		return err
 	}
-	s.logger.Info().Msgf("%d bytes were written to the file", n)
-	return nil
+	defer dir.Close()
+	return dir.Sync()
 }
 
-// LoadAll retrieves all metrics from the in-memory storage.
+// LoadAll retrieves a copy of all metrics from the in-memory storage, so it can be read while metrics are stored.
 func (s *MemStorage) LoadAll(_ context.Context) (model.Data, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.data, nil
+	return copyData(s.data), nil
 }
 
-// Load retrieves a specific metric by its type and name.
-func (s *MemStorage) Load(_ context.Context, mtype, mname string) (*model.Metric, error) {
+// copyData returns a deep copy of data.
+func copyData(data model.Data) model.Data {
+	result := make(model.Data, len(data))
+	for mtype, metrics := range data {
+		result[mtype] = make(map[string]model.Metric, len(metrics))
+		for k, m := range metrics {
+			if m.Value != nil {
+				v := *m.Value
+				m.Value = &v
+			}
+			if m.Delta != nil {
+				d := *m.Delta
+				m.Delta = &d
+			}
+			if m.Histogram != nil {
+				m.Histogram = m.Histogram.Clone()
+			}
+			if m.Labels != nil {
+				labels := make(model.Labels, len(m.Labels))
+				for name, v := range m.Labels {
+					labels[name] = v
+				}
+				m.Labels = labels
+			}
+			result[mtype][k] = m
+		}
+	}
+	return result
+}
+
+// Load retrieves a specific metric by its type, name and labels.
+func (s *MemStorage) Load(_ context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	metrics, ok := s.data[mtype]
 	if !ok {
-		return nil, fmt.Errorf("metric type: %s does not exist", mtype)
+		return nil, fmt.Errorf("metric type %s: %w", mtype, ErrNotFound)
 	}
 
-	mvalue, ok := metrics[mname]
+	mvalue, ok := metrics[model.SeriesKey(mname, labels)]
 	if !ok {
-		return nil, fmt.Errorf("metric name: %s does not exist", mname)
+		return nil, fmt.Errorf("metric name %s: %w", model.SeriesKey(mname, labels), ErrNotFound)
 	}
 
 	return &mvalue, nil
 }
 
+// LoadMetrics retrieves the metrics identified by the type, name and labels of keys, in the same order.
+func (s *MemStorage) LoadMetrics(_ context.Context, keys []model.Metric) ([]model.MetricValue, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]model.MetricValue, len(keys))
+	for i, k := range keys {
+		m, ok := s.data[k.MType][k.Key()]
+		if !ok {
+			result[i] = model.MetricValue{Metric: model.Metric{ID: k.ID, MType: k.MType, Labels: k.Labels}}
+			continue
+		}
+		result[i] = model.MetricValue{Metric: m, Found: true}
+	}
+	return result, nil
+}
+
 // StoreMetric saves a single metric
-func (s *MemStorage) StoreMetric(_ context.Context, m model.Metric) error {
+func (s *MemStorage) StoreMetric(ctx context.Context, m model.Metric) error {
+	return s.StoreMetrics(ctx, []model.Metric{m})
+}
+
+// StoreMetrics saves multiple metrics.
+// The new values are computed first, so either all of the metrics are stored or none of them.
+func (s *MemStorage) StoreMetrics(_ context.Context, metrics []model.Metric) error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	compact := false
+	defer func() {
+		s.mu.Unlock()
+		if !compact {
+			return
+		}
+		if err := s.WriteToFile(); err != nil {
+			s.logger.Error().Err(err).Msg("Failed to compact storage write-ahead log")
+		}
+	}()
 
-	if s.interval == 0 {
-		defer func() {
-			if err := s.WriteToFile(); err != nil {
-				s.logger.Error().Err(err).Msg("Failed to write storage content to file")
-			}
-		}()
+	updated := make([]model.Metric, 0, len(metrics))
+	pending := make(map[string]model.Metric, len(metrics))
+	for _, m := range metrics {
+		key := m.MType + "/" + m.Key()
+		stored, ok := pending[key]
+		if !ok {
+			stored, ok = s.data[m.MType][m.Key()]
+		}
+		next, err := apply(stored, ok, m)
+		if err != nil {
+			return err
+		}
+		pending[key] = next
+		updated = append(updated, next)
+	}
+
+	// the batch is applied only once it is logged, so a failed write leaves no trace
+	if s.wal != nil {
+		if err := s.wal.append(updated); err != nil {
+			return err
+		}
+		compact = s.wal.size >= walCompactSize
+	}
+
+	for _, m := range updated {
+		s.set(m)
+		s.record(m)
 	}
+	s.logger.Info().Interface("Storage content", s.data).Send()
 
+	return nil
+}
+
+func (s *MemStorage) set(m model.Metric) {
 	metrics, ok := s.data[m.MType]
 	if !ok {
-		s.data[m.MType] = map[string]model.Metric{
-			m.ID: {ID: m.ID, MType: m.MType, Value: m.Value, Delta: m.Delta},
-		}
-		return nil
+		metrics = make(map[string]model.Metric)
+		s.data[m.MType] = metrics
 	}
+	metrics[m.Key()] = m
+}
 
+// apply returns the result of storing m over the stored metric, which is left intact.
+func apply(stored model.Metric, exists bool, m model.Metric) (model.Metric, error) {
 	switch m.MType {
 	case service.TypeGauge:
-		metrics[m.ID] = model.Metric{ID: m.ID, MType: m.MType, Value: m.Value}
+		return model.Metric{ID: m.ID, MType: m.MType, Value: m.Value, Labels: m.Labels}, nil
 	case service.TypeCounter:
-		metric, ok := metrics[m.ID]
-		if !ok {
-			metrics[m.ID] = model.Metric{ID: m.ID, MType: m.MType, Delta: m.Delta}
-			return nil
+		delta := *m.Delta
+		if exists {
+			delta += *stored.Delta
+		}
+		return model.Metric{ID: m.ID, MType: m.MType, Delta: &delta, Labels: m.Labels}, nil
+	case service.TypeHistogram:
+		h, err := model.MergeHistogram(stored.Histogram, m)
+		if err != nil {
+			return model.Metric{}, err
 		}
-		*metric.Delta += *m.Delta
-		metrics[m.ID] = model.Metric{ID: m.ID, MType: m.MType, Delta: metric.Delta}
+		return model.Metric{ID: m.ID, MType: m.MType, Histogram: h, Labels: m.Labels}, nil
 	}
-	s.logger.Info().Interface("Storage content", s.data).Send()
+	return m, nil
+}
 
-	return nil
+// record appends the current value of a gauge or a counter to its history.
+func (s *MemStorage) record(m model.Metric) {
+	var v float64
+	switch m.MType {
+	case service.TypeGauge:
+		v = *m.Value
+	case service.TypeCounter:
+		v = float64(*m.Delta)
+	default:
+		return
+	}
+
+	key := m.MType + "/" + m.Key()
+	r, ok := s.history[key]
+	if !ok {
+		r = newRing(HistorySize)
+		s.history[key] = r
+	}
+	r.add(model.Point{Timestamp: time.Now(), Value: v})
 }
 
-// StoreMetrics saves multiple metrics.
-func (s *MemStorage) StoreMetrics(ctx context.Context, metrics []model.Metric) error {
-	var err error
-	for _, metric := range metrics {
-		err = s.StoreMetric(ctx, metric)
-		if err != nil {
-			return err
+// LoadHistory retrieves the samples of a metric received within [from, to].
+func (s *MemStorage) LoadHistory(_ context.Context, mtype, mname string, labels model.Labels, from, to time.Time) ([]model.Point, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key := model.SeriesKey(mname, labels)
+	r, ok := s.history[mtype+"/"+key]
+	if !ok {
+		if _, ok := s.data[mtype][key]; ok {
+			return []model.Point{}, nil
 		}
+		return nil, fmt.Errorf("metric name %s: %w", key, ErrNotFound)
 	}
-	return nil
+	return r.between(from, to), nil
 }
 
 func (s *MemStorage) PingStorage(_ context.Context) error {
@@ -0,0 +1,218 @@
+package repository_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/repository"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+func newMemStorage(t *testing.T, file string) *repository.MemStorage {
+	t.Helper()
+	s := repository.NewMemStorage(&zerolog.Logger{}, 300, file)
+	require.NoError(t, s.SetFsync(repository.FsyncAlways))
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func storeCounter(t *testing.T, s *repository.MemStorage, id string, d int64) {
+	t.Helper()
+	require.NoError(t, s.StoreMetrics(context.Background(), []model.Metric{{ID: id, MType: service.TypeCounter, Delta: &d}}))
+}
+
+func loadCounter(t *testing.T, s *repository.MemStorage, id string) int64 {
+	t.Helper()
+	m, err := s.Load(context.Background(), service.TypeCounter, id, nil)
+	require.NoError(t, err)
+	return *m.Delta
+}
+
+func TestMemStorageRestoreWAL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := newMemStorage(t, file)
+	storeCounter(t, s, "c", 1)
+	storeCounter(t, s, "c", 2)
+	v := 1.5
+	require.NoError(t, s.StoreMetric(context.Background(), model.Metric{ID: "g", MType: service.TypeGauge, Value: &v}))
+	require.NoError(t, s.Close())
+
+	restored := newMemStorage(t, file)
+	require.NoError(t, restored.RestoreFromFile())
+	require.Equal(t, int64(3), loadCounter(t, restored, "c"))
+	m, err := restored.Load(context.Background(), service.TypeGauge, "g", nil)
+	require.NoError(t, err)
+	require.Equal(t, 1.5, *m.Value)
+}
+
+func TestMemStorageSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := newMemStorage(t, file)
+	storeCounter(t, s, "c", 1)
+	require.NoError(t, s.WriteToFile())
+	storeCounter(t, s, "c", 2)
+	storeCounter(t, s, "d", 5)
+	require.NoError(t, s.Close())
+
+	_, err := os.Stat(file)
+	require.NoError(t, err)
+	_, err = os.Stat(file + ".wal.old")
+	require.True(t, os.IsNotExist(err))
+
+	restored := newMemStorage(t, file)
+	require.NoError(t, restored.RestoreFromFile())
+	require.Equal(t, int64(3), loadCounter(t, restored, "c"))
+	require.Equal(t, int64(5), loadCounter(t, restored, "d"))
+
+	// the snapshot alone holds everything once the log is compacted
+	require.NoError(t, restored.WriteToFile())
+	info, err := os.Stat(file + ".wal")
+	if err == nil {
+		require.Zero(t, info.Size())
+	}
+}
+
+func TestMemStorageTornWAL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := newMemStorage(t, file)
+	storeCounter(t, s, "c", 1)
+	require.NoError(t, s.Close())
+
+	f, err := os.OpenFile(file+".wal", os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`[{"id":"c","type":"counter","del`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restored := newMemStorage(t, file)
+	require.NoError(t, restored.RestoreFromFile())
+	require.Equal(t, int64(1), loadCounter(t, restored, "c"))
+	storeCounter(t, restored, "c", 2)
+	require.NoError(t, restored.Close())
+
+	again := newMemStorage(t, file)
+	require.NoError(t, again.RestoreFromFile())
+	require.Equal(t, int64(3), loadCounter(t, again, "c"))
+}
+
+func TestMemStorageCorruptWAL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := newMemStorage(t, file)
+	storeCounter(t, s, "c", 1)
+	require.NoError(t, s.Close())
+
+	f, err := os.OpenFile(file+".wal", os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString("{corrupt}\n" + `[{"id":"c","type":"counter","delta":5}]` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the records up to the corrupt one are restored and the log is truncated to them
+	restored := newMemStorage(t, file)
+	require.NoError(t, restored.RestoreFromFile())
+	require.Equal(t, int64(1), loadCounter(t, restored, "c"))
+	storeCounter(t, restored, "c", 2)
+	require.NoError(t, restored.Close())
+
+	again := newMemStorage(t, file)
+	require.NoError(t, again.RestoreFromFile())
+	require.Equal(t, int64(3), loadCounter(t, again, "c"))
+}
+
+func TestMemStorageWithoutRestore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := newMemStorage(t, file)
+	require.ErrorIs(t, s.RestoreFromFile(), os.ErrNotExist)
+	storeCounter(t, s, "c", 1)
+	require.NoError(t, s.Close())
+
+	// the log of a storage that was not restored is discarded, so a crash before the next snapshot
+	// does not bring back the previous run
+	fresh := newMemStorage(t, file)
+	storeCounter(t, fresh, "d", 2)
+	require.NoError(t, fresh.Close())
+
+	crashed := newMemStorage(t, file)
+	require.NoError(t, crashed.RestoreFromFile())
+	_, err := crashed.Load(context.Background(), service.TypeCounter, "c", nil)
+	require.ErrorIs(t, err, repository.ErrNotFound)
+	require.Equal(t, int64(2), loadCounter(t, crashed, "d"))
+	require.NoError(t, crashed.Close())
+
+	// the snapshot of a storage that was not restored replaces the stale log
+	fresh = newMemStorage(t, file)
+	storeCounter(t, fresh, "e", 3)
+	require.NoError(t, fresh.WriteToFile())
+	require.NoError(t, fresh.Close())
+
+	restored := newMemStorage(t, file)
+	require.NoError(t, restored.RestoreFromFile())
+	_, err = restored.Load(context.Background(), service.TypeCounter, "d", nil)
+	require.ErrorIs(t, err, repository.ErrNotFound)
+	require.Equal(t, int64(3), loadCounter(t, restored, "e"))
+}
+
+func TestMemStorageIntervalSync(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+
+	s := newMemStorage(t, file)
+	require.NoError(t, s.SetFsync(repository.FsyncInterval))
+	// only the first write of the burst is synced on write, the rest by the ticker or Close
+	for i := 0; i < 10; i++ {
+		storeCounter(t, s, "c", 1)
+	}
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Close())
+
+	restored := newMemStorage(t, file)
+	require.NoError(t, restored.RestoreFromFile())
+	require.Equal(t, int64(10), loadCounter(t, restored, "c"))
+}
+
+func TestMemStorageSetFsync(t *testing.T) {
+	s := repository.NewMemStorage(&zerolog.Logger{}, 300, filepath.Join(t.TempDir(), "metrics.json"))
+	require.NoError(t, s.SetFsync(repository.FsyncNever))
+	require.Error(t, s.SetFsync("sometimes"))
+}
+
+func TestMemStorageLoadAllCopy(t *testing.T) {
+	ctx := context.Background()
+	s := newMemStorage(t, "")
+	storeCounter(t, s, "c", 1)
+
+	data, err := s.LoadAll(ctx)
+	require.NoError(t, err)
+	*data[service.TypeCounter]["c"].Delta = 10
+	delete(data[service.TypeCounter], "c")
+	require.Equal(t, int64(1), loadCounter(t, s, "c"))
+
+	// the copy is read while metrics are stored, which the race detector reports on a shared map
+	done := make(chan error)
+	go func() {
+		d := int64(1)
+		var err error
+		for i := 0; i < 100 && err == nil; i++ {
+			err = s.StoreMetrics(ctx, []model.Metric{{ID: "c", MType: service.TypeCounter, Delta: &d}})
+		}
+		done <- err
+	}()
+	for i := 0; i < 100; i++ {
+		data, err := s.LoadAll(ctx)
+		require.NoError(t, err)
+		for _, m := range data[service.TypeCounter] {
+			require.NotNil(t, m.Delta)
+		}
+	}
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,39 @@
+package repository_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v-starostin/go-metrics/internal/repository"
+	"github.com/v-starostin/go-metrics/internal/repository/repositorytest"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+func TestMemStorage(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) service.Repository {
+		s := repository.NewMemStorage(&zerolog.Logger{}, 300, filepath.Join(t.TempDir(), "metrics.json"))
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) service.Repository {
+		s, err := repository.NewSQLiteStorage(&zerolog.Logger{}, filepath.Join(t.TempDir(), "metrics.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestBoltStorage(t *testing.T) {
+	repositorytest.Run(t, func(t *testing.T) service.Repository {
+		s, err := repository.NewBoltStorage(&zerolog.Logger{}, filepath.Join(t.TempDir(), "metrics.bolt"))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
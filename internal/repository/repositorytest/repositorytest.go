@@ -0,0 +1,334 @@
+// Package repositorytest provides the conformance tests shared by the implementations of service.Repository.
+package repositorytest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/repository"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// Factory returns an empty repository for a single test. Its resources are released with t.Cleanup.
+type Factory func(t *testing.T) service.Repository
+
+// Run runs the conformance tests against the repositories created by newRepo.
+func Run(t *testing.T, newRepo Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, r service.Repository)
+	}{
+		{name: "CounterAccumulation", fn: testCounterAccumulation},
+		{name: "GaugeOverwrite", fn: testGaugeOverwrite},
+		{name: "HistogramMerge", fn: testHistogramMerge},
+		{name: "Labels", fn: testLabels},
+		{name: "StoreMetrics", fn: testStoreMetrics},
+		{name: "LoadMetrics", fn: testLoadMetrics},
+		{name: "LoadAll", fn: testLoadAll},
+		{name: "LoadHistory", fn: testLoadHistory},
+		{name: "LabelledHistory", fn: testLabelledHistory},
+		{name: "HistoryRetention", fn: testHistoryRetention},
+		{name: "MissingMetric", fn: testMissingMetric},
+		{name: "BatchAtomicity", fn: testBatchAtomicity},
+		{name: "ConcurrentWrites", fn: testConcurrentWrites},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepo(t))
+		})
+	}
+}
+
+func gauge(id string, v float64, labels model.Labels) model.Metric {
+	return model.Metric{ID: id, MType: service.TypeGauge, Value: &v, Labels: labels}
+}
+
+func counter(id string, d int64, labels model.Labels) model.Metric {
+	return model.Metric{ID: id, MType: service.TypeCounter, Delta: &d, Labels: labels}
+}
+
+func histogram(id string, v float64) model.Metric {
+	return model.Metric{ID: id, MType: service.TypeHistogram, Value: &v}
+}
+
+func testCounterAccumulation(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 2, nil)))
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 3, nil)))
+	require.NoError(t, r.StoreMetric(ctx, counter("c", -1, nil)))
+
+	m, err := r.Load(ctx, service.TypeCounter, "c", nil)
+	require.NoError(t, err)
+	require.Equal(t, "c", m.ID)
+	require.Equal(t, service.TypeCounter, m.MType)
+	require.Equal(t, int64(4), *m.Delta)
+	require.Nil(t, m.Value)
+}
+
+func testGaugeOverwrite(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	require.NoError(t, r.StoreMetric(ctx, gauge("g", 1.5, nil)))
+	require.NoError(t, r.StoreMetric(ctx, gauge("g", -2.5, nil)))
+
+	m, err := r.Load(ctx, service.TypeGauge, "g", nil)
+	require.NoError(t, err)
+	require.Equal(t, "g", m.ID)
+	require.Equal(t, service.TypeGauge, m.MType)
+	require.Equal(t, -2.5, *m.Value)
+	require.Nil(t, m.Delta)
+}
+
+func testHistogramMerge(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	require.NoError(t, r.StoreMetric(ctx, histogram("h", 0.2)))
+	require.NoError(t, r.StoreMetric(ctx, histogram("h", 7)))
+
+	m, err := r.Load(ctx, service.TypeHistogram, "h", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), m.Histogram.Count)
+	require.Equal(t, 7.2, m.Histogram.Sum)
+}
+
+func testLabels(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	a, b := model.Labels{"host": "a"}, model.Labels{"host": "b"}
+
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 1, a)))
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 2, b)))
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 4, a)))
+
+	m, err := r.Load(ctx, service.TypeCounter, "c", a)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), *m.Delta)
+	require.Equal(t, a, m.Labels)
+
+	m, err = r.Load(ctx, service.TypeCounter, "c", b)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), *m.Delta)
+
+	_, err = r.Load(ctx, service.TypeCounter, "c", nil)
+	require.Error(t, err)
+}
+
+func testStoreMetrics(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	require.NoError(t, r.StoreMetrics(ctx, []model.Metric{
+		counter("c", 1, nil),
+		gauge("g", 1, nil),
+		counter("c", 2, nil),
+		gauge("g", 3, nil),
+	}))
+
+	m, err := r.Load(ctx, service.TypeCounter, "c", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), *m.Delta)
+
+	m, err = r.Load(ctx, service.TypeGauge, "g", nil)
+	require.NoError(t, err)
+	require.Equal(t, 3.0, *m.Value)
+}
+
+func testLoadMetrics(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	labels := model.Labels{"host": "a"}
+	require.NoError(t, r.StoreMetrics(ctx, []model.Metric{counter("c", 1, nil), gauge("g", 1.5, nil), gauge("g", 2.5, labels)}))
+
+	values, err := r.LoadMetrics(ctx, []model.Metric{
+		{ID: "g", MType: service.TypeGauge},
+		{ID: "x", MType: service.TypeGauge},
+		{ID: "c", MType: service.TypeCounter},
+		{ID: "g", MType: service.TypeGauge, Labels: labels},
+		{ID: "g", MType: service.TypeGauge, Labels: model.Labels{"host": "b"}},
+		{ID: "g", MType: service.TypeGauge},
+	})
+	require.NoError(t, err)
+	require.Len(t, values, 6)
+
+	require.True(t, values[0].Found)
+	require.Equal(t, 1.5, *values[0].Value)
+	require.False(t, values[1].Found)
+	require.Equal(t, "x", values[1].ID)
+	require.True(t, values[2].Found)
+	require.Equal(t, int64(1), *values[2].Delta)
+	require.True(t, values[3].Found)
+	require.Equal(t, 2.5, *values[3].Value)
+	require.Equal(t, labels, values[3].Labels)
+	require.False(t, values[4].Found)
+	require.True(t, values[5].Found)
+	require.Equal(t, 1.5, *values[5].Value)
+}
+
+func testLoadAll(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	labels := model.Labels{"host": "a"}
+	require.NoError(t, r.StoreMetrics(ctx, []model.Metric{counter("c", 1, labels), gauge("g", 1.5, nil)}))
+
+	data, err := r.LoadAll(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1.5, *data[service.TypeGauge]["g"].Value)
+	c := data[service.TypeCounter][model.SeriesKey("c", labels)]
+	require.Equal(t, int64(1), *c.Delta)
+	require.Equal(t, labels, c.Labels)
+}
+
+func testLoadHistory(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	from := time.Now().Add(-time.Second)
+
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 1, nil)))
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 2, nil)))
+	require.NoError(t, r.StoreMetric(ctx, gauge("g", 1.5, nil)))
+
+	points, err := r.LoadHistory(ctx, service.TypeCounter, "c", nil, from, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	require.Equal(t, 1.0, points[0].Value)
+	require.Equal(t, 3.0, points[1].Value)
+
+	points, err = r.LoadHistory(ctx, service.TypeGauge, "g", nil, from.Add(-time.Hour), from)
+	require.NoError(t, err)
+	require.Empty(t, points)
+
+	_, err = r.LoadHistory(ctx, service.TypeGauge, "x", nil, from, time.Now())
+	require.Error(t, err)
+}
+
+func testLabelledHistory(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	from := time.Now().Add(-time.Second)
+	a, b := model.Labels{"host": "a"}, model.Labels{"host": "b"}
+
+	require.NoError(t, r.StoreMetric(ctx, gauge("g", 1, a)))
+	require.NoError(t, r.StoreMetric(ctx, gauge("g", 2, b)))
+	require.NoError(t, r.StoreMetric(ctx, gauge("g", 3, a)))
+
+	points, err := r.LoadHistory(ctx, service.TypeGauge, "g", a, from, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	require.Equal(t, 1.0, points[0].Value)
+	require.Equal(t, 3.0, points[1].Value)
+
+	points, err = r.LoadHistory(ctx, service.TypeGauge, "g", b, from, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	require.Equal(t, 2.0, points[0].Value)
+
+	_, err = r.LoadHistory(ctx, service.TypeGauge, "g", nil, from, time.Now().Add(time.Second))
+	require.ErrorIs(t, err, repository.ErrNotFound)
+}
+
+// testHistoryRetention checks that only the latest repository.HistorySize samples of a metric are kept.
+func testHistoryRetention(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	from := time.Now().Add(-time.Second)
+
+	for i := 0; i < repository.HistorySize+2; i++ {
+		require.NoError(t, r.StoreMetric(ctx, counter("c", 1, nil)))
+	}
+
+	points, err := r.LoadHistory(ctx, service.TypeCounter, "c", nil, from, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, points, repository.HistorySize)
+	require.Equal(t, 3.0, points[0].Value)
+	require.Equal(t, float64(repository.HistorySize+2), points[len(points)-1].Value)
+}
+
+func testMissingMetric(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	_, err := r.Load(ctx, service.TypeGauge, "g", nil)
+	require.ErrorIs(t, err, repository.ErrNotFound)
+
+	require.NoError(t, r.StoreMetric(ctx, gauge("g", 1, model.Labels{"host": "a"})))
+	_, err = r.Load(ctx, service.TypeCounter, "g", model.Labels{"host": "a"})
+	require.ErrorIs(t, err, repository.ErrNotFound)
+	_, err = r.Load(ctx, service.TypeGauge, "g", nil)
+	require.ErrorIs(t, err, repository.ErrNotFound)
+
+	_, err = r.LoadHistory(ctx, service.TypeGauge, "x", nil, time.Now().Add(-time.Hour), time.Now())
+	require.ErrorIs(t, err, repository.ErrNotFound)
+}
+
+// testBatchAtomicity checks that a batch failing on one of its metrics leaves the storage unchanged.
+func testBatchAtomicity(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	stored := model.NewHistogram([]float64{1, 2})
+	stored.Observe(1.5)
+	require.NoError(t, r.StoreMetric(ctx, model.Metric{ID: "h", MType: service.TypeHistogram, Histogram: stored}))
+	require.NoError(t, r.StoreMetric(ctx, counter("c", 1, nil)))
+
+	other := model.NewHistogram([]float64{5})
+	other.Observe(1)
+	err := r.StoreMetrics(ctx, []model.Metric{
+		counter("c", 10, nil),
+		gauge("g", 1, nil),
+		{ID: "h", MType: service.TypeHistogram, Histogram: other},
+	})
+	require.ErrorIs(t, err, model.ErrHistogramBounds)
+
+	m, err := r.Load(ctx, service.TypeCounter, "c", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), *m.Delta)
+
+	_, err = r.Load(ctx, service.TypeGauge, "g", nil)
+	require.ErrorIs(t, err, repository.ErrNotFound)
+
+	m, err = r.Load(ctx, service.TypeHistogram, "h", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), m.Histogram.Count)
+}
+
+func testConcurrentWrites(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	const writers, batches = 10, 20
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, writers*batches)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < batches; j++ {
+				errs <- r.StoreMetrics(ctx, []model.Metric{
+					counter("c", 1, nil),
+					counter("c", 2, model.Labels{"host": "a"}),
+					gauge("g", float64(i), nil),
+					histogram("h", 1),
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	m, err := r.Load(ctx, service.TypeCounter, "c", nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(writers*batches), *m.Delta)
+
+	m, err = r.Load(ctx, service.TypeCounter, "c", model.Labels{"host": "a"})
+	require.NoError(t, err)
+	require.Equal(t, int64(writers*batches*2), *m.Delta)
+
+	m, err = r.Load(ctx, service.TypeGauge, "g", nil)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, *m.Value, 0.0)
+	require.Less(t, *m.Value, float64(writers))
+
+	m, err = r.Load(ctx, service.TypeHistogram, "h", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(writers*batches), m.Histogram.Count)
+}
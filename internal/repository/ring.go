@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+// HistorySize is the number of the latest samples every storage keeps per metric.
+const HistorySize = 4096
+
+// ring is a buffer of up to size points that overwrites the oldest ones when full.
+// It grows as points are added, so the series with a short history take little memory.
+type ring struct {
+	points []model.Point
+	size   int
+	next   int
+}
+
+func newRing(size int) *ring {
+	return &ring{size: size}
+}
+
+func (r *ring) add(p model.Point) {
+	if len(r.points) < r.size {
+		r.points = append(r.points, p)
+		return
+	}
+	r.points[r.next] = p
+	r.next = (r.next + 1) % r.size
+}
+
+// between returns the points within [from, to] in chronological order.
+func (r *ring) between(from, to time.Time) []model.Point {
+	// next is the oldest point once the ring is full and has wrapped
+	ordered := r.points
+	if r.next > 0 {
+		ordered = append(r.points[r.next:len(r.points):len(r.points)], r.points[:r.next]...)
+	}
+
+	result := make([]model.Point, 0)
+	for _, p := range ordered {
+		if p.Timestamp.Before(from) || p.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
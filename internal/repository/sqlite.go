@@ -0,0 +1,385 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS metrics (
+    id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    labels TEXT NOT NULL DEFAULT '{}',
+    delta INTEGER,
+    value REAL,
+    histogram TEXT,
+    PRIMARY KEY (id, type, labels)
+);
+CREATE TABLE IF NOT EXISTS metrics_history (
+    id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    labels TEXT NOT NULL DEFAULT '{}',
+    value REAL NOT NULL,
+    ts INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_history_type_id_labels_ts_idx ON metrics_history (type, id, labels, ts);
+`
+
+// SQLiteStorage represents a storage in a SQLite database file.
+type SQLiteStorage struct {
+	db      *sql.DB
+	logger  *zerolog.Logger
+	trimmer *historyTrimmer
+}
+
+// NewSQLiteStorage opens the SQLite database at path, creating it and its tables when needed.
+func NewSQLiteStorage(logger *zerolog.Logger, path string) (*SQLiteStorage, error) {
+	// writers take the lock when the transaction begins and wait for each other instead of failing
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStorage{
+		db:      db,
+		logger:  logger,
+		trimmer: newHistoryTrimmer(),
+	}, nil
+}
+
+// Close closes the database.
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+// Load retrieves a specific metric by its type, name and labels from the database.
+func (s *SQLiteStorage) Load(ctx context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error) {
+	row := s.db.QueryRowContext(
+		ctx,
+		"SELECT id, type, value, delta, histogram, labels FROM metrics WHERE type = ? AND id = ? AND labels = ?",
+		mtype, mname, encodeLabels(labels),
+	)
+	m, err := scanSQLiteMetric(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("metric %s of type %s: %w", model.SeriesKey(mname, labels), mtype, ErrNotFound)
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Load method error")
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadAll retrieves all metrics from the database.
+func (s *SQLiteStorage) LoadAll(ctx context.Context) (model.Data, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, type, value, delta, histogram, labels FROM metrics")
+	if err != nil {
+		s.logger.Error().Err(err).Msg("LoadAll: select statement error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(model.Data)
+	for rows.Next() {
+		m, err := scanSQLiteMetric(rows)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("LoadAll: scan rows error")
+			return nil, err
+		}
+		if _, ok := result[m.MType]; !ok {
+			result[m.MType] = make(map[string]model.Metric)
+		}
+		result[m.MType][m.Key()] = *m
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error().Err(err).Msg("LoadAll method error")
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// maxSQLiteKeys caps the keys looked up by a single query to stay within the limit of query parameters.
+const maxSQLiteKeys = 10000
+
+// LoadMetrics retrieves the metrics identified by the type, name and labels of keys, in the same order,
+// with a single query per maxSQLiteKeys keys.
+func (s *SQLiteStorage) LoadMetrics(ctx context.Context, keys []model.Metric) ([]model.MetricValue, error) {
+	result := make([]model.MetricValue, len(keys))
+	for i, k := range keys {
+		result[i] = model.MetricValue{Metric: model.Metric{ID: k.ID, MType: k.MType, Labels: k.Labels}}
+	}
+
+	found := make(map[string]model.Metric, len(keys))
+	for chunk := keys; len(chunk) > 0; {
+		n := min(len(chunk), maxSQLiteKeys)
+		if err := s.loadMetrics(ctx, chunk[:n], found); err != nil {
+			return nil, err
+		}
+		chunk = chunk[n:]
+	}
+
+	for i, k := range keys {
+		if m, ok := found[k.MType+":"+k.Key()]; ok {
+			result[i] = model.MetricValue{Metric: m, Found: true}
+		}
+	}
+	return result, nil
+}
+
+// loadMetrics puts the stored metrics among keys into found by type and key.
+func (s *SQLiteStorage) loadMetrics(ctx context.Context, keys []model.Metric, found map[string]model.Metric) error {
+	var query strings.Builder
+	query.WriteString("SELECT id, type, value, delta, histogram, labels FROM metrics WHERE (type, id, labels) IN (VALUES ")
+	args := make([]any, 0, len(keys)*3)
+	for i, k := range keys {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(?, ?, ?)")
+		args = append(args, k.MType, k.ID, encodeLabels(k.Labels))
+	}
+	query.WriteString(")")
+
+	rows, err := s.db.QueryContext(ctx, query.String(), args...)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("LoadMetrics: select statement error")
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := scanSQLiteMetric(rows)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("LoadMetrics: scan rows error")
+			return err
+		}
+		found[m.MType+":"+m.Key()] = *m
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error().Err(err).Msg("LoadMetrics method error")
+		return err
+	}
+	return nil
+}
+
+// StoreMetric saves a single metric to the database.
+func (s *SQLiteStorage) StoreMetric(ctx context.Context, m model.Metric) error {
+	return s.StoreMetrics(ctx, []model.Metric{m})
+}
+
+// StoreMetrics saves multiple metrics to the database within a single transaction.
+func (s *SQLiteStorage) StoreMetrics(ctx context.Context, metrics []model.Metric) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("StoreMetrics: begin transaction error")
+		return err
+	}
+
+	for _, m := range metrics {
+		if err := storeSQLite(ctx, tx, m); err != nil {
+			s.logger.Error().Err(err).Msg("StoreMetrics: store data error")
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, m := range s.trimmer.due(metrics) {
+		if err := trimSQLite(ctx, tx, m); err != nil {
+			s.logger.Error().Err(err).Msg("StoreMetrics: trim history error")
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.logger.Error().Err(err).Msg("StoreMetrics: commit transaction error")
+		return err
+	}
+	return nil
+}
+
+func storeSQLite(ctx context.Context, tx *sql.Tx, m model.Metric) error {
+	labels := encodeLabels(m.Labels)
+
+	switch m.MType {
+	case service.TypeCounter:
+		var total int64
+		row := tx.QueryRowContext(
+			ctx,
+			`INSERT INTO metrics (id, type, delta, labels) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id, type, labels) DO UPDATE SET delta = metrics.delta + excluded.delta
+			RETURNING delta`,
+			m.ID, m.MType, *m.Delta, labels,
+		)
+		if err := row.Scan(&total); err != nil {
+			return err
+		}
+		return recordSQLite(ctx, tx, m, float64(total))
+	case service.TypeGauge:
+		_, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO metrics (id, type, value, labels) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id, type, labels) DO UPDATE SET value = excluded.value`,
+			m.ID, m.MType, *m.Value, labels,
+		)
+		if err != nil {
+			return err
+		}
+		return recordSQLite(ctx, tx, m, *m.Value)
+	case service.TypeHistogram:
+		var stored sql.NullString
+		row := tx.QueryRowContext(ctx, "SELECT histogram FROM metrics WHERE id = ? AND type = ? AND labels = ?", m.ID, m.MType, labels)
+		if err := row.Scan(&stored); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		var current *model.Histogram
+		if stored.Valid {
+			var err error
+			if current, err = parseHistogram([]byte(stored.String)); err != nil {
+				return err
+			}
+		}
+		h, err := model.MergeHistogram(current, m)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(
+			ctx,
+			`INSERT INTO metrics (id, type, histogram, labels) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id, type, labels) DO UPDATE SET histogram = excluded.histogram`,
+			m.ID, m.MType, string(b), labels,
+		)
+		return err
+	}
+	return nil
+}
+
+// recordSQLite appends the current value of a gauge or a counter to its history.
+func recordSQLite(ctx context.Context, tx *sql.Tx, m model.Metric, v float64) error {
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO metrics_history (id, type, value, labels, ts) VALUES (?, ?, ?, ?, ?)",
+		m.ID, m.MType, v, encodeLabels(m.Labels), time.Now().UnixNano(),
+	)
+	return err
+}
+
+// trimSQLite drops the oldest samples beyond HistorySize from the history of a gauge or a counter.
+func trimSQLite(ctx context.Context, tx *sql.Tx, m model.Metric) error {
+	labels := encodeLabels(m.Labels)
+	_, err := tx.ExecContext(
+		ctx,
+		`DELETE FROM metrics_history WHERE type = ? AND id = ? AND labels = ? AND rowid NOT IN (
+			SELECT rowid FROM metrics_history WHERE type = ? AND id = ? AND labels = ? ORDER BY ts DESC, rowid DESC LIMIT ?
+		)`,
+		m.MType, m.ID, labels, m.MType, m.ID, labels, HistorySize,
+	)
+	return err
+}
+
+// LoadHistory retrieves the samples of a metric received within [from, to] from the database.
+func (s *SQLiteStorage) LoadHistory(ctx context.Context, mtype, mname string, labels model.Labels, from, to time.Time) ([]model.Point, error) {
+	rows, err := s.db.QueryContext(
+		ctx,
+		// the history is trimmed once in a while, only the latest HistorySize samples are returned meanwhile
+		`SELECT ts, value FROM (
+			SELECT ts, value, rowid AS seq FROM metrics_history WHERE type = ? AND id = ? AND labels = ? AND ts BETWEEN ? AND ?
+			ORDER BY ts DESC, rowid DESC LIMIT ?
+		) ORDER BY ts, seq`,
+		mtype, mname, encodeLabels(labels), from.UnixNano(), to.UnixNano(), HistorySize,
+	)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("LoadHistory: select statement error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.Point, 0)
+	for rows.Next() {
+		var ts int64
+		var v float64
+		if err := rows.Scan(&ts, &v); err != nil {
+			s.logger.Error().Err(err).Msg("LoadHistory: scan rows error")
+			return nil, err
+		}
+		result = append(result, model.Point{Timestamp: time.Unix(0, ts), Value: v})
+	}
+	if err := rows.Err(); err != nil {
+		s.logger.Error().Err(err).Msg("LoadHistory method error")
+		return nil, err
+	}
+
+	if len(result) == 0 {
+		if _, err := s.Load(ctx, mtype, mname, labels); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// PingStorage checks the connection to the storage.
+func (s *SQLiteStorage) PingStorage(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLiteStorage) RestoreFromFile() error {
+	return errNotSupported
+}
+
+func (s *SQLiteStorage) WriteToFile() error {
+	return errNotSupported
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSQLiteMetric(row scanner) (*model.Metric, error) {
+	var mID, mType, mLabels string
+	var mValue sql.NullFloat64
+	var mDelta sql.NullInt64
+	var mHistogram sql.NullString
+
+	if err := row.Scan(&mID, &mType, &mValue, &mDelta, &mHistogram, &mLabels); err != nil {
+		return nil, err
+	}
+	var h *model.Histogram
+	if mHistogram.Valid {
+		var err error
+		if h, err = parseHistogram([]byte(mHistogram.String)); err != nil {
+			return nil, err
+		}
+	}
+	l, err := parseLabels([]byte(mLabels))
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.Metric{
+		ID:        mID,
+		MType:     mType,
+		Value:     parseValue(mValue),
+		Delta:     parseDelta(mDelta),
+		Histogram: h,
+		Labels:    l,
+	}, nil
+}
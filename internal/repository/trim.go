@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"sync"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// historyTrimEvery is the number of samples recorded for a series between trims of its history,
+// so the databases trim the history of a series once in a while instead of on every write.
+// The history exceeds HistorySize by less than that in between, LoadHistory caps it.
+const historyTrimEvery = HistorySize / 4
+
+// historyTrimmer counts the samples recorded per series since their history was trimmed.
+type historyTrimmer struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newHistoryTrimmer() *historyTrimmer {
+	return &historyTrimmer{counts: make(map[string]int)}
+}
+
+// due counts a sample for every gauge and counter of metrics and returns the ones whose history is to be trimmed.
+func (t *historyTrimmer) due(metrics []model.Metric) []model.Metric {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var result []model.Metric
+	for _, m := range metrics {
+		if m.MType == service.TypeHistogram {
+			continue
+		}
+		key := m.MType + "/" + m.Key()
+		t.counts[key]++
+		if t.counts[key] >= historyTrimEvery {
+			delete(t.counts, key)
+			result = append(result, m)
+		}
+	}
+	return result
+}
@@ -0,0 +1,270 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+)
+
+// Fsync policies of the write-ahead log.
+const (
+	// FsyncAlways syncs the log after every write.
+	FsyncAlways = "always"
+	// FsyncInterval syncs the log at most once per fsyncInterval, the writes since the last sync
+	// are synced by syncDirty.
+	FsyncInterval = "interval"
+	// FsyncNever leaves syncing the log to the operating system.
+	FsyncNever = "never"
+)
+
+const (
+	walSuffix     = ".wal"
+	oldWALSuffix  = ".wal.old"
+	fsyncInterval = time.Second
+	// walCompactSize is the size of the log that triggers a snapshot.
+	walCompactSize = 16 << 20
+)
+
+// wal is an append-only log of the stored metrics.
+// Every record is a line with the JSON array of the metrics stored by a batch, holding their new values,
+// so replaying the records over the snapshot they were written after restores the latest values.
+// The records are dropped only by removeOld, once the snapshot covering them is written.
+type wal struct {
+	path   string
+	policy string
+	f      *os.File
+	size   int64
+	synced time.Time
+	// dirty is set when records are written after the last sync
+	dirty bool
+	// stale is set until the logs left by the previous run are restored or discarded
+	stale bool
+}
+
+func newWAL(path string) *wal {
+	return &wal{path: path, policy: FsyncInterval, stale: true}
+}
+
+// discardStale removes the logs left by a previous run that was not restored, so that they are not
+// replayed after a crash along with the records of this run.
+func (w *wal) discardStale() error {
+	if !w.stale {
+		return nil
+	}
+	for _, suffix := range []string{oldWALSuffix, walSuffix} {
+		if err := os.Remove(w.path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.stale = false
+	return nil
+}
+
+// open opens the log for appending, discarding the logs of the previous run unless they were restored.
+func (w *wal) open() error {
+	if err := w.discardStale(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path+walSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	return nil
+}
+
+// append writes a record of the metrics and syncs it according to the policy.
+func (w *wal) append(metrics []model.Metric) error {
+	b, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if w.f == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.f.Write(b); err != nil {
+		// a partial record would hide the records written after it
+		return errors.Join(err, w.f.Truncate(w.size))
+	}
+	w.size += int64(len(b))
+
+	switch w.policy {
+	case FsyncAlways:
+		return w.f.Sync()
+	case FsyncInterval:
+		if time.Since(w.synced) >= fsyncInterval {
+			return w.sync()
+		}
+		w.dirty = true
+	}
+	return nil
+}
+
+// syncDirty syncs the records written since the last sync, so a burst of writes followed by silence
+// is not left unsynced with FsyncInterval.
+func (w *wal) syncDirty() error {
+	if !w.dirty {
+		return nil
+	}
+	return w.sync()
+}
+
+// rotate moves the log aside for a snapshot, a new log is started on the next write.
+// When the log moved aside by a failed snapshot is still there, the log is appended to it.
+func (w *wal) rotate() error {
+	if err := w.discardStale(); err != nil {
+		return err
+	}
+	if w.f != nil {
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+
+	_, err := os.Stat(w.path + oldWALSuffix)
+	if os.IsNotExist(err) {
+		err = os.Rename(w.path+walSuffix, w.path+oldWALSuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(w.path + walSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(w.path+oldWALSuffix, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.path + walSuffix)
+}
+
+// removeOld removes the log moved aside once the snapshot covering it is written.
+func (w *wal) removeOld() error {
+	if err := os.Remove(w.path + oldWALSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// errCorruptWAL is returned when a complete record of the log cannot be decoded.
+var errCorruptWAL = errors.New("corrupt write-ahead log record")
+
+// restore replays the log moved aside, if any, and then the log, calling fn for every record.
+// A record cut short by a crash or corrupt ends its log, which is truncated to the records before it.
+// The records hold the new values of the metrics, so the ones of the next log are replayed anyway.
+// The corrupt records are reported with errCorruptWAL once everything else is replayed.
+// It returns os.ErrNotExist when there is no log.
+func (w *wal) restore(fn func([]model.Metric)) error {
+	// the logs are kept even when they cannot be read, they might be restored later
+	w.stale = false
+
+	found := false
+	var corrupt []error
+	for _, path := range []string{w.path + oldWALSuffix, w.path + walSuffix} {
+		valid, err := replayWAL(path, fn)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if errors.Is(err, errCorruptWAL) {
+			corrupt = append(corrupt, err)
+		} else if err != nil {
+			return err
+		}
+		found = true
+		if err := os.Truncate(path, valid); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return os.ErrNotExist
+	}
+	return errors.Join(corrupt...)
+}
+
+func (w *wal) sync() error {
+	if w.f == nil {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.synced = time.Now()
+	w.dirty = false
+	return nil
+}
+
+func (w *wal) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := errors.Join(w.sync(), w.f.Close())
+	w.f = nil
+	return err
+}
+
+// replayWAL calls fn for every complete record of the log at path and returns the size of these records.
+func replayWAL(path string, fn func([]model.Metric)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var valid int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a partial record without the line end was cut short
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var metrics []model.Metric
+		if err := json.Unmarshal(bytes.TrimSpace(line), &metrics); err != nil {
+			return valid, fmt.Errorf("%w at offset %d of %s: %v", errCorruptWAL, valid, path, err)
+		}
+		fn(metrics)
+		valid += int64(len(line))
+	}
+}
@@ -0,0 +1,131 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/v-starostin/go-metrics/internal/crypto"
+	"github.com/v-starostin/go-metrics/internal/keys"
+)
+
+// Signature metadata keys.
+const (
+	// HashHeader carries the HMAC signature of a request.
+	HashHeader = "hashsha256"
+	// TimestampHeader carries the unix time the request was signed at.
+	TimestampHeader = "hashtimestamp"
+	// NonceHeader carries a random value unique to the request.
+	NonceHeader = "hashnonce"
+	// KeyIDHeader carries the ID of the key the request is signed with.
+	KeyIDHeader = "keyid"
+)
+
+// Sign returns the hex encoded HMAC-SHA256 of the deterministically marshalled message,
+// signed along with timestamp and nonce when they are set.
+func Sign(m proto.Message, key, timestamp, nonce string) (string, error) {
+	b, err := marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(crypto.Signature(key, timestamp, nonce, b)), nil
+}
+
+func marshal(m proto.Message) ([]byte, error) {
+	return proto.MarshalOptions{Deterministic: true}.Marshal(m)
+}
+
+// LogRequests logs every handled call along with its status and duration.
+func LogRequests(l *zerolog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		res, err := handler(ctx, req)
+		l.Info().
+			Str("method", info.FullMethod).
+			Str("elapsed", time.Since(start).String()).
+			Str("status", status.Code(err).String()).
+			Msg("Request handled")
+		return res, err
+	}
+}
+
+// Verifier checks the request signatures, it is implemented by handler.HashChecker.
+type Verifier interface {
+	Verify(hash, keyID, timestamp, nonce string, body []byte, strict bool) (string, error)
+}
+
+// CheckHash verifies the signature of the marshalled request with v, the same way the HTTP middleware does.
+// In strict mode the calls of the given methods must be signed along with a timestamp and nonce,
+// and failures get Unauthenticated. Other unsigned calls are passed through and failures get InvalidArgument.
+// The agent the key belongs to is put into the context.
+func CheckHash(v Verifier, strict bool, methods ...string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		strict := strict && slices.Contains(methods, info.FullMethod)
+		md, _ := metadata.FromIncomingContext(ctx)
+		hash := first(md, HashHeader)
+		if hash == "" && !strict {
+			return handler(ctx, req)
+		}
+
+		m, ok := req.(proto.Message)
+		if !ok {
+			return nil, status.Error(codes.Internal, "Internal Server Error")
+		}
+		b, err := marshal(m)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Internal Server Error")
+		}
+
+		agent, err := v.Verify(hash, first(md, KeyIDHeader), first(md, TimestampHeader), first(md, NonceHeader), b, strict)
+		if err != nil {
+			code := codes.InvalidArgument
+			if strict {
+				code = codes.Unauthenticated
+			}
+			return nil, status.Error(code, err.Error())
+		}
+		if agent != "" {
+			ctx = keys.NewContext(ctx, agent)
+		}
+		return handler(ctx, req)
+	}
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// RealIPHeader is the metadata key carrying the address of the host that sent the request.
+const RealIPHeader = "x-real-ip"
+
+// TrustedSubnet rejects the calls of the given methods whose x-real-ip is not within subnet.
+// All calls are passed through when subnet is nil.
+func TrustedSubnet(subnet *net.IPNet, methods ...string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if subnet == nil || !slices.Contains(methods, info.FullMethod) {
+			return handler(ctx, req)
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get(RealIPHeader)
+		if len(values) == 0 {
+			return nil, status.Error(codes.PermissionDenied, "Forbidden")
+		}
+		ip := net.ParseIP(values[0])
+		if ip == nil || !subnet.Contains(ip) {
+			return nil, status.Error(codes.PermissionDenied, "Forbidden")
+		}
+		return handler(ctx, req)
+	}
+}
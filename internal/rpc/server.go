@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/v-starostin/go-metrics/internal/keys"
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+	pb "github.com/v-starostin/go-metrics/proto"
+)
+
+// Service defines methods for saving and retrieving metrics.
+type Service interface {
+	SaveMetrics(ctx context.Context, m []model.Metric) error
+	GetMetric(ctx context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error)
+}
+
+// MetricsServer implements the gRPC MetricsService.
+type MetricsServer struct {
+	pb.UnimplementedMetricsServiceServer
+	logger  *zerolog.Logger
+	service Service
+}
+
+// NewMetricsServer creates a new MetricsServer.
+func NewMetricsServer(l *zerolog.Logger, srv Service) *MetricsServer {
+	return &MetricsServer{
+		logger:  l,
+		service: srv,
+	}
+}
+
+// Update stores a batch of metrics.
+func (s *MetricsServer) Update(ctx context.Context, req *pb.UpdateRequest) (*pb.UpdateResponse, error) {
+	metrics := make([]model.Metric, 0, len(req.GetMetrics()))
+	for _, m := range req.GetMetrics() {
+		if m.GetType() != service.TypeCounter && m.GetType() != service.TypeGauge && m.GetType() != service.TypeHistogram {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown metric type: %s", m.GetType())
+		}
+		metrics = append(metrics, FromProto(m))
+	}
+	s.logger.Info().Str("agent", keys.FromContext(ctx)).Any("req", metrics).Msg("Decoded request body")
+
+	if err := s.service.SaveMetrics(ctx, metrics); err != nil {
+		s.logger.Error().Err(err).Msg("SaveMetrics method error")
+		if errors.Is(err, service.ErrParseMetric) || errors.Is(err, model.ErrHistogramBounds) {
+			return nil, status.Error(codes.InvalidArgument, "Bad request")
+		}
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+
+	return &pb.UpdateResponse{Metrics: req.GetMetrics()}, nil
+}
+
+// Get retrieves a specific metric by its type and name.
+func (s *MetricsServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	m, err := s.service.GetMetric(ctx, req.GetType(), req.GetId(), req.GetLabels())
+	if err != nil {
+		s.logger.Error().Err(err).Msg("GetMetric method error")
+		return nil, status.Error(codes.NotFound, "Not found")
+	}
+
+	return &pb.GetResponse{Metric: ToProto(*m)}, nil
+}
+
+// FromProto converts a protobuf metric to the model representation.
+func FromProto(m *pb.Metric) model.Metric {
+	metric := model.Metric{
+		ID:     m.GetId(),
+		MType:  m.GetType(),
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.GetLabels(),
+	}
+	if h := m.GetHistogram(); h != nil {
+		metric.Histogram = &model.Histogram{
+			Bounds: h.GetBounds(),
+			Counts: h.GetCounts(),
+			Sum:    h.GetSum(),
+			Count:  h.GetCount(),
+		}
+	}
+	return metric
+}
+
+// ToProto converts a metric to its protobuf representation.
+func ToProto(m model.Metric) *pb.Metric {
+	metric := &pb.Metric{
+		Id:     m.ID,
+		Type:   m.MType,
+		Delta:  m.Delta,
+		Value:  m.Value,
+		Labels: m.Labels,
+	}
+	if m.Histogram != nil {
+		metric.Histogram = &pb.Histogram{
+			Bounds: m.Histogram.Bounds,
+			Counts: m.Histogram.Counts,
+			Sum:    m.Histogram.Sum,
+			Count:  m.Histogram.Count,
+		}
+	}
+	return metric
+}
@@ -0,0 +1,236 @@
+package rpc_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/v-starostin/go-metrics/internal/handler"
+	"github.com/v-starostin/go-metrics/internal/keys"
+	"github.com/v-starostin/go-metrics/internal/mock"
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/rpc"
+	pb "github.com/v-starostin/go-metrics/proto"
+)
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	f, i := 1.25, int64(3)
+	req := &pb.UpdateRequest{Metrics: []*pb.Metric{
+		{Id: "metric1", Type: "gauge", Value: &f},
+		{Id: "metric2", Type: "counter", Delta: &i},
+	}}
+	metrics := []model.Metric{
+		{ID: "metric1", MType: "gauge", Value: &f},
+		{ID: "metric2", MType: "counter", Delta: &i},
+	}
+
+	t.Run("good case", func(t *testing.T) {
+		srv := &mock.Service{}
+		s := rpc.NewMetricsServer(&zerolog.Logger{}, srv)
+		srv.On("SaveMetrics", ctx, metrics).Once().Return(nil)
+
+		res, err := s.Update(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, req.GetMetrics(), res.GetMetrics())
+	})
+
+	t.Run("unknown metric type", func(t *testing.T) {
+		srv := &mock.Service{}
+		s := rpc.NewMetricsServer(&zerolog.Logger{}, srv)
+
+		_, err := s.Update(ctx, &pb.UpdateRequest{Metrics: []*pb.Metric{{Id: "metric1", Type: "gauges", Value: &f}}})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("service error", func(t *testing.T) {
+		srv := &mock.Service{}
+		s := rpc.NewMetricsServer(&zerolog.Logger{}, srv)
+		srv.On("SaveMetrics", ctx, metrics).Once().Return(errors.New("err"))
+
+		_, err := s.Update(ctx, req)
+		assert.Equal(t, codes.Internal, status.Code(err))
+	})
+}
+
+func TestGet(t *testing.T) {
+	ctx := context.Background()
+	f := 1.25
+
+	t.Run("good case", func(t *testing.T) {
+		srv := &mock.Service{}
+		s := rpc.NewMetricsServer(&zerolog.Logger{}, srv)
+		srv.On("GetMetric", ctx, "gauge", "metric1", model.Labels(nil)).Once().Return(&model.Metric{ID: "metric1", MType: "gauge", Value: &f}, nil)
+
+		res, err := s.Get(ctx, &pb.GetRequest{Id: "metric1", Type: "gauge"})
+		assert.NoError(t, err)
+		assert.Equal(t, "metric1", res.GetMetric().GetId())
+		assert.Equal(t, f, res.GetMetric().GetValue())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		srv := &mock.Service{}
+		s := rpc.NewMetricsServer(&zerolog.Logger{}, srv)
+		srv.On("GetMetric", ctx, "gauge", "metric2", model.Labels(nil)).Once().Return(nil, errors.New("err"))
+
+		_, err := s.Get(ctx, &pb.GetRequest{Id: "metric2", Type: "gauge"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
+
+func TestCheckHash(t *testing.T) {
+	f := 1.25
+	req := &pb.UpdateRequest{Metrics: []*pb.Metric{{Id: "metric1", Type: "gauge", Value: &f}}}
+	next := func(ctx context.Context, req any) (any, error) {
+		return &pb.UpdateResponse{}, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: pb.MetricsService_Update_FullMethodName}
+
+	t.Run("no hash metadata", func(t *testing.T) {
+		_, err := rpc.CheckHash(handler.NewHashChecker("key", nil, nil, nil), false)(context.Background(), req, info, next)
+		assert.NoError(t, err)
+	})
+
+	t.Run("hash metadata exists", func(t *testing.T) {
+		hash, err := rpc.Sign(req, "key", "", "")
+		assert.NoError(t, err)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpc.HashHeader, hash))
+		_, err = rpc.CheckHash(handler.NewHashChecker("key", nil, nil, nil), false)(ctx, req, info, next)
+		assert.NoError(t, err)
+	})
+
+	t.Run("hash metadata exists, but hash values are not equal", func(t *testing.T) {
+		hash, err := rpc.Sign(req, "key2", "", "")
+		assert.NoError(t, err)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpc.HashHeader, hash))
+		_, err = rpc.CheckHash(handler.NewHashChecker("key", nil, nil, nil), false)(ctx, req, info, next)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	ks := keys.NewRegistry([]keys.Key{
+		{ID: "k1", Secret: "secret1", Agent: "agent1"},
+		{ID: "k2", Secret: "secret2", Revoked: true},
+	})
+
+	t.Run("agent key", func(t *testing.T) {
+		hash, err := rpc.Sign(req, "secret1", "", "")
+		assert.NoError(t, err)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpc.HashHeader, hash, rpc.KeyIDHeader, "k1"))
+		var agent string
+		_, err = rpc.CheckHash(handler.NewHashChecker("key", ks, nil, nil), false)(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			agent = keys.FromContext(ctx)
+			return &pb.UpdateResponse{}, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "agent1", agent)
+	})
+
+	t.Run("revoked agent key", func(t *testing.T) {
+		hash, err := rpc.Sign(req, "secret2", "", "")
+		assert.NoError(t, err)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpc.HashHeader, hash, rpc.KeyIDHeader, "k2"))
+		_, err = rpc.CheckHash(handler.NewHashChecker("key", ks, nil, nil), false)(ctx, req, info, next)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("empty key without shared key", func(t *testing.T) {
+		hash, err := rpc.Sign(req, "", "", "")
+		assert.NoError(t, err)
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpc.HashHeader, hash))
+		_, err = rpc.CheckHash(handler.NewHashChecker("", ks, nil, nil), false)(ctx, req, info, next)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestCheckHashStrict(t *testing.T) {
+	f := 1.25
+	req := &pb.UpdateRequest{Metrics: []*pb.Metric{{Id: "metric1", Type: "gauge", Value: &f}}}
+	next := func(ctx context.Context, req any) (any, error) {
+		return &pb.UpdateResponse{}, nil
+	}
+	update := &grpc.UnaryServerInfo{FullMethod: pb.MetricsService_Update_FullMethodName}
+	get := &grpc.UnaryServerInfo{FullMethod: pb.MetricsService_Get_FullMethodName}
+	// a registry-only server, there is no shared key
+	ks := keys.NewRegistry([]keys.Key{{ID: "k1", Secret: "secret1", Agent: "agent1"}})
+	checker := handler.NewHashChecker("", ks, handler.NewReplayGuard(time.Minute), nil)
+	interceptor := rpc.CheckHash(checker, true, pb.MetricsService_Update_FullMethodName)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		name      string
+		keyID     string
+		secret    string
+		timestamp string
+		nonce     string
+		code      codes.Code
+	}{
+		{name: "signed", keyID: "k1", secret: "secret1", timestamp: now, nonce: "n1", code: codes.OK},
+		{name: "replayed nonce", keyID: "k1", secret: "secret1", timestamp: now, nonce: "n1", code: codes.Unauthenticated},
+		{name: "no nonce", keyID: "k1", secret: "secret1", code: codes.Unauthenticated},
+		{name: "no key ID", secret: "", timestamp: now, nonce: "n2", code: codes.Unauthenticated},
+		{name: "unsigned", code: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := metadata.Pairs(rpc.TimestampHeader, tt.timestamp, rpc.NonceHeader, tt.nonce)
+			if tt.keyID != "" {
+				md.Set(rpc.KeyIDHeader, tt.keyID)
+			}
+			if tt.name != "unsigned" {
+				hash, err := rpc.Sign(req, tt.secret, tt.timestamp, tt.nonce)
+				assert.NoError(t, err)
+				md.Set(rpc.HashHeader, hash)
+			}
+			_, err := interceptor(metadata.NewIncomingContext(context.Background(), md), req, update, next)
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+
+	t.Run("unsigned read", func(t *testing.T) {
+		_, err := interceptor(context.Background(), &pb.GetRequest{Id: "metric1", Type: "gauge"}, get, next)
+		assert.NoError(t, err)
+	})
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	handler := func(ctx context.Context, req any) (any, error) {
+		return &pb.UpdateResponse{}, nil
+	}
+	update := &grpc.UnaryServerInfo{FullMethod: pb.MetricsService_Update_FullMethodName}
+	get := &grpc.UnaryServerInfo{FullMethod: pb.MetricsService_Get_FullMethodName}
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	assert.NoError(t, err)
+	interceptor := rpc.TrustedSubnet(subnet, pb.MetricsService_Update_FullMethodName)
+
+	t.Run("IP within subnet", func(t *testing.T) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpc.RealIPHeader, "192.168.1.10"))
+		_, err := interceptor(ctx, nil, update, handler)
+		assert.NoError(t, err)
+	})
+
+	t.Run("IP outside subnet", func(t *testing.T) {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(rpc.RealIPHeader, "10.0.0.1"))
+		_, err := interceptor(ctx, nil, update, handler)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("no IP metadata", func(t *testing.T) {
+		_, err := interceptor(context.Background(), nil, update, handler)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	})
+
+	t.Run("method is not restricted", func(t *testing.T) {
+		_, err := interceptor(context.Background(), nil, get, handler)
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,217 @@
+// Package selfmetrics collects the metrics of the server itself.
+package selfmetrics
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// Prefix is prepended to the names of the server metrics stored in the repository.
+// The service rejects the client metrics starting with it.
+const Prefix = service.ReservedPrefix
+
+// Counter is a monotonically increasing counter safe for concurrent use.
+type Counter struct {
+	name    string
+	labels  model.Labels
+	v       atomic.Int64
+	flushed atomic.Int64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n int64) {
+	c.v.Add(n)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+// Histogram is a histogram safe for concurrent use.
+type Histogram struct {
+	name   string
+	labels model.Labels
+
+	mu      sync.Mutex
+	total   *model.Histogram
+	pending *model.Histogram
+}
+
+// Observe adds a single value to the histogram.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.total.Observe(v)
+	h.pending.Observe(v)
+}
+
+// Registry holds the counters and histograms by name and labels.
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[string]*Counter
+	histograms map[string]*Histogram
+}
+
+// NewRegistry creates a new Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   make(map[string]*Counter),
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// Counter returns the counter with the given name and labels, creating it on first use.
+func (r *Registry) Counter(name string, labels model.Labels) *Counter {
+	key := model.SeriesKey(name, labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.counters[key]
+	if !ok {
+		c = &Counter{name: name, labels: labels}
+		r.counters[key] = c
+	}
+	return c
+}
+
+// Histogram returns the histogram with the given name and labels, creating it with bounds on first use.
+func (r *Registry) Histogram(name string, labels model.Labels, bounds []float64) *Histogram {
+	key := model.SeriesKey(name, labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.histograms[key]
+	if !ok {
+		h = &Histogram{
+			name:    name,
+			labels:  labels,
+			total:   model.NewHistogram(bounds),
+			pending: model.NewHistogram(bounds),
+		}
+		r.histograms[key] = h
+	}
+	return h
+}
+
+// Snapshot returns the current values of all metrics.
+func (r *Registry) Snapshot() model.Data {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := model.Data{
+		service.TypeCounter:   make(map[string]model.Metric, len(r.counters)),
+		service.TypeHistogram: make(map[string]model.Metric, len(r.histograms)),
+	}
+	for key, c := range r.counters {
+		v := c.Value()
+		data[service.TypeCounter][key] = model.Metric{ID: c.name, MType: service.TypeCounter, Labels: c.labels, Delta: &v}
+	}
+	for key, h := range r.histograms {
+		h.mu.Lock()
+		data[service.TypeHistogram][key] = model.Metric{ID: h.name, MType: service.TypeHistogram, Labels: h.labels, Histogram: h.total.Clone()}
+		h.mu.Unlock()
+	}
+	return data
+}
+
+// Flush returns the changes since the previous flush, with names prefixed by prefix.
+// Counters carry their increments and histograms the observations made since then,
+// so they can be saved like the metrics sent by agents.
+func (r *Registry) Flush(prefix string) []model.Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metrics := make([]model.Metric, 0, len(r.counters)+len(r.histograms))
+	for _, c := range r.counters {
+		v := c.Value()
+		delta := v - c.flushed.Swap(v)
+		if delta == 0 {
+			continue
+		}
+		metrics = append(metrics, model.Metric{ID: prefix + c.name, MType: service.TypeCounter, Labels: c.labels, Delta: &delta})
+	}
+	for _, h := range r.histograms {
+		h.mu.Lock()
+		pending := h.pending
+		h.pending = model.NewHistogram(pending.Bounds)
+		h.mu.Unlock()
+		if pending.Count == 0 {
+			continue
+		}
+		metrics = append(metrics, model.Metric{ID: prefix + h.name, MType: service.TypeHistogram, Labels: h.labels, Histogram: pending})
+	}
+	return metrics
+}
+
+// Requeue puts back the changes of a failed flush with the given prefix, so they are flushed
+// along with the next ones.
+func (r *Registry) Requeue(prefix string, metrics []model.Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range metrics {
+		key := model.SeriesKey(strings.TrimPrefix(m.ID, prefix), m.Labels)
+		switch m.MType {
+		case service.TypeCounter:
+			if c, ok := r.counters[key]; ok {
+				c.flushed.Add(-*m.Delta)
+			}
+		case service.TypeHistogram:
+			if h, ok := r.histograms[key]; ok {
+				h.mu.Lock()
+				// the bounds of a histogram never change
+				h.pending.Merge(m.Histogram)
+				h.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Saver stores the flushed metrics.
+type Saver interface {
+	SaveServerMetrics(ctx context.Context, m []model.Metric) error
+}
+
+// Run saves the metrics of the registry under Prefix every interval until ctx is done,
+// then saves them one last time.
+func Run(ctx context.Context, l *zerolog.Logger, r *Registry, srv Saver, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			flush(ctx, l, r, srv)
+		case <-ctx.Done():
+			flush(context.Background(), l, r, srv)
+			return
+		}
+	}
+}
+
+func flush(ctx context.Context, l *zerolog.Logger, r *Registry, srv Saver) {
+	metrics := r.Flush(Prefix)
+	if len(metrics) == 0 {
+		return
+	}
+	if err := srv.SaveServerMetrics(ctx, metrics); err != nil {
+		l.Error().Err(err).Msg("Failed to save server metrics, they are kept for the next flush")
+		r.Requeue(Prefix, metrics)
+	}
+}
@@ -0,0 +1,147 @@
+package selfmetrics_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/selfmetrics"
+)
+
+func TestRegistry(t *testing.T) {
+	r := selfmetrics.NewRegistry()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Counter("requests", model.Labels{"route": "/"}).Inc()
+			r.Histogram("duration", nil, []float64{1}).Observe(0.5)
+		}()
+	}
+	wg.Wait()
+	r.Counter("requests", model.Labels{"route": "/ping"}).Inc()
+
+	assert.Equal(t, int64(10), r.Counter("requests", model.Labels{"route": "/"}).Value())
+
+	data := r.Snapshot()
+	assert.Len(t, data["counter"], 2)
+	h := data["histogram"][model.SeriesKey("duration", nil)].Histogram
+	assert.Equal(t, uint64(10), h.Count)
+	assert.Equal(t, []uint64{10, 0}, h.Counts)
+}
+
+func TestFlush(t *testing.T) {
+	r := selfmetrics.NewRegistry()
+	c := r.Counter("requests", nil)
+	c.Inc()
+	c.Inc()
+	r.Histogram("duration", nil, []float64{1}).Observe(2)
+	r.Counter("idle", nil)
+
+	metrics := r.Flush("prefix_")
+	assert.Len(t, metrics, 2)
+	for _, m := range metrics {
+		switch m.MType {
+		case "counter":
+			assert.Equal(t, "prefix_requests", m.ID)
+			assert.Equal(t, int64(2), *m.Delta)
+		case "histogram":
+			assert.Equal(t, "prefix_duration", m.ID)
+			assert.Equal(t, []uint64{0, 1}, m.Histogram.Counts)
+		}
+	}
+
+	// only the changes since the previous flush are returned
+	assert.Empty(t, r.Flush("prefix_"))
+	c.Inc()
+	metrics = r.Flush("prefix_")
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, int64(1), *metrics[0].Delta)
+
+	// the snapshot keeps the totals
+	v := r.Snapshot()["counter"][model.SeriesKey("requests", nil)].Delta
+	assert.Equal(t, int64(3), *v)
+}
+
+type saver struct {
+	mu      sync.Mutex
+	metrics []model.Metric
+}
+
+func (s *saver) SaveServerMetrics(_ context.Context, m []model.Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics = append(s.metrics, m...)
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	r := selfmetrics.NewRegistry()
+	r.Counter("requests", nil).Inc()
+	s := &saver{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		selfmetrics.Run(ctx, &zerolog.Logger{}, r, s, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	assert.Len(t, s.metrics, 1)
+	assert.Equal(t, selfmetrics.Prefix+"requests", s.metrics[0].ID)
+}
+
+func TestRequeue(t *testing.T) {
+	r := selfmetrics.NewRegistry()
+	c := r.Counter("requests", nil)
+	c.Add(2)
+	h := r.Histogram("duration", nil, []float64{1})
+	h.Observe(2)
+	failed := r.Flush("prefix_")
+
+	c.Inc()
+	h.Observe(0.5)
+	r.Requeue("prefix_", failed)
+
+	metrics := r.Flush("prefix_")
+	assert.Len(t, metrics, 2)
+	for _, m := range metrics {
+		switch m.MType {
+		case "counter":
+			assert.Equal(t, int64(3), *m.Delta)
+		case "histogram":
+			assert.Equal(t, []uint64{1, 1}, m.Histogram.Counts)
+		}
+	}
+	assert.Empty(t, r.Flush("prefix_"))
+}
+
+type failingSaver struct{}
+
+func (failingSaver) SaveServerMetrics(context.Context, []model.Metric) error {
+	return errors.New("storage is down")
+}
+
+func TestRunSaveFailure(t *testing.T) {
+	r := selfmetrics.NewRegistry()
+	r.Counter("requests", nil).Inc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	selfmetrics.Run(ctx, &zerolog.Logger{}, r, failingSaver{}, time.Hour)
+
+	// the increments are not lost with the failed flush
+	metrics := r.Flush(selfmetrics.Prefix)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, int64(1), *metrics[0].Delta)
+}
@@ -3,17 +3,24 @@ package service
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 
+	"github.com/v-starostin/go-metrics/internal/alert"
 	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/pubsub"
 )
 
 const (
-	TypeCounter = "counter"
-	TypeGauge   = "gauge"
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
 )
 
 const (
@@ -25,12 +32,20 @@ const (
 
 var ErrParseMetric = errors.New("failed to parse metric: wrong type")
 
+// ReservedPrefix starts the IDs of the metrics of the server itself, which clients can't write.
+const ReservedPrefix = "gometrics_server_"
+
+// ErrReservedID is returned for the client metrics whose ID starts with ReservedPrefix.
+var ErrReservedID = fmt.Errorf("%w: %s prefix is reserved", ErrParseMetric, ReservedPrefix)
+
 // Repository defines methods for loading, storing, and managing metrics.
 type Repository interface {
-	Load(ctx context.Context, mtype, mname string) (*model.Metric, error)
+	Load(ctx context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error)
 	LoadAll(ctx context.Context) (model.Data, error)
+	LoadMetrics(ctx context.Context, keys []model.Metric) ([]model.MetricValue, error)
 	StoreMetric(ctx context.Context, m model.Metric) error
 	StoreMetrics(ctx context.Context, m []model.Metric) error
+	LoadHistory(ctx context.Context, mtype, mname string, labels model.Labels, from, to time.Time) ([]model.Point, error)
 	PingStorage(ctx context.Context) error
 	RestoreFromFile() error
 	WriteToFile() error
@@ -38,29 +53,52 @@ type Repository interface {
 
 // Service represents a service for managing metrics.
 type Service struct {
-	logger *zerolog.Logger
-	repo   Repository
+	logger  *zerolog.Logger
+	repo    Repository
+	alerts  *alert.Evaluator
+	retries Counter
+	bus     *pubsub.Bus
+	// backoff holds the intervals between the retries
+	backoff []time.Duration
+}
+
+// Counter counts events.
+type Counter interface {
+	Inc()
 }
 
 // New creates a new Service with the provided logger and repository.
 func New(l *zerolog.Logger, repo Repository) *Service {
 	return &Service{
-		logger: l,
-		repo:   repo,
+		logger:  l,
+		repo:    repo,
+		alerts:  alert.NewEvaluator(nil),
+		bus:     pubsub.NewBus(),
+		backoff: []time.Duration{firstRetry, secondRetry, thirdRetry},
 	}
 }
 
-// GetMetric retrieves a specific metric by its type and name.
-func (s *Service) GetMetric(ctx context.Context, mtype, mname string) (*model.Metric, error) {
+// SetBackoff sets the intervals between the retries, one per retry.
+func (s *Service) SetBackoff(intervals ...time.Duration) {
+	s.backoff = intervals
+}
+
+// SetRetryCounter sets the counter of the storage operations retried by Retry.
+func (s *Service) SetRetryCounter(c Counter) {
+	s.retries = c
+}
+
+// GetMetric retrieves a specific metric by its type, name and labels.
+func (s *Service) GetMetric(ctx context.Context, mtype, mname string, labels model.Labels) (*model.Metric, error) {
 	var m *model.Metric
 	var err error
 	err = s.Retry(ctx, maxRetries, func(ctx context.Context) error {
-		m, err = s.repo.Load(ctx, mtype, mname)
+		m, err = s.repo.Load(ctx, mtype, mname, labels)
 		if err != nil {
 			return err
 		}
 		return nil
-	}, firstRetry, secondRetry, thirdRetry)
+	}, s.backoff...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load metric %s: %w", mname, err)
 	}
@@ -78,13 +116,118 @@ func (s *Service) GetMetrics(ctx context.Context) (model.Data, error) {
 			return err
 		}
 		return nil
-	}, firstRetry, secondRetry, thirdRetry)
+	}, s.backoff...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load metrics: %w", err)
 	}
 	return m, nil
 }
 
+// FindMetrics retrieves the metrics of the given type and name whose labels satisfy all the matchers,
+// ordered by their keys.
+func (s *Service) FindMetrics(ctx context.Context, mtype, mname string, matchers []model.Matcher) ([]model.Metric, error) {
+	data, err := s.GetMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]model.Metric, 0)
+	for _, m := range data[mtype] {
+		if m.ID == mname && model.MatchLabels(matchers, m.Labels) {
+			result = append(result, m)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key() < result[j].Key()
+	})
+	return result, nil
+}
+
+// GetMetricValues retrieves the metrics identified by the type, name and labels of keys at once.
+// The result holds an item per key in the same order, marked as not found when the metric does not exist.
+func (s *Service) GetMetricValues(ctx context.Context, keys []model.Metric) ([]model.MetricValue, error) {
+	for _, k := range keys {
+		if k.ID == "" || (k.MType != TypeGauge && k.MType != TypeCounter && k.MType != TypeHistogram) {
+			return nil, ErrParseMetric
+		}
+	}
+
+	var values []model.MetricValue
+	var err error
+	err = s.Retry(ctx, maxRetries, func(ctx context.Context) error {
+		values, err = s.repo.LoadMetrics(ctx, keys)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, s.backoff...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metrics: %w", err)
+	}
+
+	return values, nil
+}
+
+// ListMetrics retrieves a page of the metrics satisfying the filter along with the number of all of them.
+// The metrics are ordered by type, then name, then labels, so pages are stable between requests.
+func (s *Service) ListMetrics(ctx context.Context, f model.Filter) ([]model.Metric, int, error) {
+	data, err := s.GetMetrics(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]model.Metric, 0)
+	for _, metrics := range data {
+		for _, m := range metrics {
+			if f.Match(m) {
+				result = append(result, m)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MType != result[j].MType {
+			return result[i].MType < result[j].MType
+		}
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Labels.String() < result[j].Labels.String()
+	})
+
+	total := len(result)
+	if f.Offset >= total {
+		return []model.Metric{}, total, nil
+	}
+	result = result[f.Offset:]
+	if f.Limit > 0 && f.Limit < len(result) {
+		result = result[:f.Limit]
+	}
+	return result, total, nil
+}
+
+// GetHistory retrieves the samples of a metric received within [from, to].
+// When step is positive, the samples are downsampled into windows of that size:
+// gauges are averaged and counters keep the last value of each window.
+func (s *Service) GetHistory(ctx context.Context, mtype, mname string, labels model.Labels, from, to time.Time, step time.Duration) ([]model.Point, error) {
+	var points []model.Point
+	var err error
+	err = s.Retry(ctx, maxRetries, func(ctx context.Context) error {
+		points, err = s.repo.LoadHistory(ctx, mtype, mname, labels, from, to)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, s.backoff...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history of metric %s: %w", mname, err)
+	}
+
+	if step <= 0 {
+		return points, nil
+	}
+	return downsample(points, mtype, from, step), nil
+}
+
 // SaveMetric saves a single metric.
 func (s *Service) SaveMetric(ctx context.Context, m model.Metric) error {
 	logger := s.logger.With().
@@ -92,34 +235,66 @@ func (s *Service) SaveMetric(ctx context.Context, m model.Metric) error {
 		Str("name", m.ID).
 		Logger()
 
+	if err := validateClient(m); err != nil {
+		return err
+	}
+
 	err := s.Retry(ctx, maxRetries, func(ctx context.Context) error {
 		if err := s.repo.StoreMetric(ctx, m); err != nil {
 			return err
 		}
 		return nil
-	}, firstRetry, secondRetry, thirdRetry)
+	}, s.backoff...)
 	if err != nil {
 		return fmt.Errorf("failed to store data: %w", err)
 	}
 	logger.Info().Msg("Metric is stored")
+	s.bus.Publish(m)
 	return nil
 }
 
 // SaveMetrics saves multiple metrics.
 func (s *Service) SaveMetrics(ctx context.Context, m []model.Metric) error {
+	for _, metric := range m {
+		if err := validateClient(metric); err != nil {
+			return err
+		}
+	}
+	return s.saveMetrics(ctx, m)
+}
+
+// SaveServerMetrics saves the metrics of the server itself, whose IDs start with ReservedPrefix.
+func (s *Service) SaveServerMetrics(ctx context.Context, m []model.Metric) error {
+	for _, metric := range m {
+		if err := validate(metric); err != nil {
+			return err
+		}
+	}
+	return s.saveMetrics(ctx, m)
+}
+
+func (s *Service) saveMetrics(ctx context.Context, m []model.Metric) error {
 	err := s.Retry(ctx, maxRetries, func(ctx context.Context) error {
 		if err := s.repo.StoreMetrics(ctx, m); err != nil {
 			return err
 		}
 		return nil
-	}, firstRetry, secondRetry, thirdRetry)
+	}, s.backoff...)
 	if err != nil {
 		return fmt.Errorf("failed to store data: %w", err)
 	}
 	s.logger.Info().Msg("Metric is stored")
+	s.bus.Publish(m...)
 	return nil
 }
 
+// Subscribe subscribes to the stored metric updates satisfying the filter, with a buffer of size updates.
+// Updates are delivered as they are received, i.e. counters carry the increment.
+// The subscription must be closed once it is not needed.
+func (s *Service) Subscribe(f model.Filter, size int) *pubsub.Subscription {
+	return s.bus.Subscribe(f, size)
+}
+
 // PingStorage checks the connection to the storage.
 func (s *Service) PingStorage(ctx context.Context) error {
 	return s.repo.PingStorage(ctx)
@@ -135,20 +310,170 @@ func (s *Service) RestoreFromFile() error {
 	return s.repo.RestoreFromFile()
 }
 
+// RunAlerts evaluates the alerting rules against the stored metrics every interval until ctx is done.
+// Alert state changes are delivered by the notifier when it is not nil.
+func (s *Service) RunAlerts(ctx context.Context, rules []alert.Rule, n *alert.Notifier, interval time.Duration) {
+	s.alerts.SetRules(rules)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := s.EvaluateAlerts(ctx, time.Now())
+			if err != nil {
+				s.logger.Error().Err(err).Msg("Failed to evaluate alerts")
+				continue
+			}
+			if n != nil {
+				s.NotifyAlerts(ctx, n, changed)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// EvaluateAlerts evaluates the alerting rules once and returns the alerts whose state has changed.
+func (s *Service) EvaluateAlerts(ctx context.Context, now time.Time) ([]alert.Alert, error) {
+	data, err := s.repo.LoadAll(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metrics: %w", err)
+	}
+
+	changed := s.alerts.Eval(now, data)
+	for _, a := range changed {
+		s.logger.Info().
+			Str("rule", a.Rule).
+			Str("state", a.State).
+			Float64("value", a.Value).
+			Msg("Alert state changed")
+	}
+	return changed, nil
+}
+
+// NotifyAlerts delivers the alerts to every receiver of the notifier,
+// retrying failed deliveries with the same intervals as storage operations.
+func (s *Service) NotifyAlerts(ctx context.Context, n *alert.Notifier, alerts []alert.Alert) {
+	alerts = n.Dedup(time.Now(), alerts)
+	if len(alerts) == 0 {
+		return
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, r := range n.Receivers() {
+		wg.Add(1)
+		go func(r alert.Receiver) {
+			defer wg.Done()
+			// the deliveries are not storage operations, so their retries are not counted
+			err := s.retry(ctx, nil, maxRetries, func(ctx context.Context) error {
+				return n.Send(ctx, r, alerts)
+			}, s.backoff...)
+			if err != nil {
+				s.logger.Error().Err(err).Str("receiver", r.URL).Msg("Failed to deliver alerts")
+				return
+			}
+			s.logger.Info().Str("receiver", r.URL).Int("count", len(alerts)).Msg("Alerts are delivered")
+		}(r)
+	}
+	wg.Wait()
+}
+
+// GetAlerts returns the pending and firing alerts.
+func (s *Service) GetAlerts(_ context.Context) []alert.Alert {
+	return s.alerts.Active()
+}
+
 // Retry attempts to execute the given function up to a specified number of retries.
+// Errors caused by invalid metrics are returned immediately.
+// Every retry is counted by the counter set with SetRetryCounter.
 func (s *Service) Retry(ctx context.Context, maxRetries int, fn func(context.Context) error, intervals ...time.Duration) error {
+	return s.retry(ctx, s.retries, maxRetries, fn, intervals...)
+}
+
+// retry is Retry that counts the retries with c, if it is not nil.
+func (s *Service) retry(ctx context.Context, c Counter, maxRetries int, fn func(context.Context) error, intervals ...time.Duration) error {
 	var err error
 	err = fn(ctx)
-	if err == nil {
-		return nil
+	if err == nil || isPermanent(err) {
+		return err
 	}
 	for i := 0; i < maxRetries; i++ {
 		s.logger.Info().Msgf("Retrying... (Attempt %d)", i+1)
+		if c != nil {
+			c.Inc()
+		}
 		time.Sleep(intervals[i])
-		if err = fn(ctx); err == nil {
-			return nil
+		if err = fn(ctx); err == nil || isPermanent(err) {
+			return err
 		}
 	}
 	s.logger.Error().Msg("Retrying... Failed")
 	return err
 }
+
+// validate checks that the metric has valid labels, a known type and carries the value required by it.
+// validateClient also rejects the IDs reserved for the server metrics, so clients can't forge them.
+func validateClient(m model.Metric) error {
+	if strings.HasPrefix(m.ID, ReservedPrefix) {
+		return ErrReservedID
+	}
+	return validate(m)
+}
+
+func validate(m model.Metric) error {
+	if m.Labels.Validate() != nil {
+		return ErrParseMetric
+	}
+	switch m.MType {
+	case TypeGauge:
+		if m.Value == nil {
+			return ErrParseMetric
+		}
+	case TypeCounter:
+		if m.Delta == nil {
+			return ErrParseMetric
+		}
+	case TypeHistogram:
+		if m.Histogram == nil && m.Value == nil {
+			return ErrParseMetric
+		}
+		if m.Histogram != nil && m.Histogram.Validate() != nil {
+			return ErrParseMetric
+		}
+		// a non-finite observation would make the sum of the stored histogram non-finite
+		if m.Value != nil && (math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0)) {
+			return ErrParseMetric
+		}
+	default:
+		return ErrParseMetric
+	}
+	return nil
+}
+
+func isPermanent(err error) bool {
+	return errors.Is(err, ErrParseMetric) || errors.Is(err, model.ErrHistogramBounds)
+}
+
+func downsample(points []model.Point, mtype string, from time.Time, step time.Duration) []model.Point {
+	result := make([]model.Point, 0)
+	var sum float64
+	var n int
+	for i, p := range points {
+		window := from.Add(p.Timestamp.Sub(from) / step * step)
+		sum += p.Value
+		n++
+		if i+1 < len(points) && from.Add(points[i+1].Timestamp.Sub(from)/step*step).Equal(window) {
+			continue
+		}
+
+		v := p.Value
+		if mtype == TypeGauge {
+			v = sum / float64(n)
+		}
+		result = append(result, model.Point{Timestamp: window, Value: v})
+		sum, n = 0, 0
+	}
+	return result
+}
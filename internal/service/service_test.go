@@ -2,12 +2,20 @@ package service_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/suite"
 
+	"github.com/v-starostin/go-metrics/internal/alert"
 	"github.com/v-starostin/go-metrics/internal/mock"
 	"github.com/v-starostin/go-metrics/internal/model"
 	"github.com/v-starostin/go-metrics/internal/service"
@@ -22,6 +30,8 @@ type serviceTestSuite struct {
 func (suite *serviceTestSuite) SetupTest() {
 	repo := &mock.Repository{}
 	srv := service.New(&zerolog.Logger{}, repo)
+	// the retries are not waited for
+	srv.SetBackoff(0, 0, 0)
 	suite.repo = repo
 	suite.service = srv
 }
@@ -57,9 +67,9 @@ func (suite *serviceTestSuite) TestMetric() {
 
 	for _, test := range tt {
 		suite.Run(test.name, func() {
-			mockCall := suite.repo.On("Load", ctx, test.metric.MType, test.metric.ID).Return(test.metric, test.err)
+			mockCall := suite.repo.On("Load", ctx, test.metric.MType, test.metric.ID, test.metric.Labels).Return(test.metric, test.err)
 
-			got, err := suite.service.GetMetric(ctx, test.metric.MType, test.metric.ID)
+			got, err := suite.service.GetMetric(ctx, test.metric.MType, test.metric.ID, test.metric.Labels)
 			if err != nil {
 				suite.EqualError(err, test.expectedErr)
 			} else {
@@ -119,6 +129,7 @@ func (suite *serviceTestSuite) TestServiceSave() {
 	ctx := context.Background()
 	f1, i := new(float64), new(int64)
 	*f1, *i = 2.0, 2
+	inf := math.Inf(1)
 	tt := []struct {
 		name     string
 		m        model.Metric
@@ -161,6 +172,104 @@ func (suite *serviceTestSuite) TestServiceSave() {
 			err:      errors.New("err"),
 			expected: "failed to store data: err",
 		},
+		{
+			name: "good case (histogram observation)",
+			m: model.Metric{
+				MType: service.TypeHistogram,
+				ID:    "metric1",
+				Value: f1,
+			},
+		},
+		{
+			name: "good case (histogram)",
+			m: model.Metric{
+				MType:     service.TypeHistogram,
+				ID:        "metric1",
+				Histogram: &model.Histogram{Bounds: []float64{1, 5}, Counts: []uint64{0, 1, 0}, Sum: 2, Count: 1},
+			},
+		},
+		{
+			name: "histogram bounds mismatch is not retried",
+			m: model.Metric{
+				MType: service.TypeHistogram,
+				ID:    "metric1",
+				Value: f1,
+			},
+			err:      model.ErrHistogramBounds,
+			expected: "failed to store data: histogram bucket bounds mismatch",
+		},
+		{
+			name: "invalid histogram",
+			m: model.Metric{
+				MType:     service.TypeHistogram,
+				ID:        "metric1",
+				Histogram: &model.Histogram{Bounds: []float64{1, 5}, Counts: []uint64{0, 1}, Sum: 2, Count: 1},
+			},
+			expected: "failed to parse metric: wrong type",
+		},
+		{
+			name: "non-finite histogram observation",
+			m: model.Metric{
+				MType: service.TypeHistogram,
+				ID:    "metric1",
+				Value: &inf,
+			},
+			expected: "failed to parse metric: wrong type",
+		},
+		{
+			name: "unknown metric type",
+			m: model.Metric{
+				MType: "gauges",
+				ID:    "metric1",
+				Value: f1,
+			},
+			expected: "failed to parse metric: wrong type",
+		},
+		{
+			name: "gauge without value",
+			m: model.Metric{
+				MType: service.TypeGauge,
+				ID:    "metric1",
+				Delta: i,
+			},
+			expected: "failed to parse metric: wrong type",
+		},
+		{
+			name: "good case (labels)",
+			m: model.Metric{
+				MType:  service.TypeGauge,
+				ID:     "metric1",
+				Value:  f1,
+				Labels: model.Labels{"host": "a"},
+			},
+		},
+		{
+			name: "invalid label name",
+			m: model.Metric{
+				MType:  service.TypeGauge,
+				ID:     "metric1",
+				Value:  f1,
+				Labels: model.Labels{"host-name": "a"},
+			},
+			expected: "failed to parse metric: wrong type",
+		},
+		{
+			name: "any metric ID is accepted",
+			m: model.Metric{
+				MType: service.TypeGauge,
+				ID:    `Heap Alloc{host="a"}`,
+				Value: f1,
+			},
+		},
+		{
+			name: "reserved metric ID",
+			m: model.Metric{
+				MType: service.TypeGauge,
+				ID:    service.ReservedPrefix + "requests",
+				Value: f1,
+			},
+			expected: "failed to parse metric: wrong type: gometrics_server_ prefix is reserved",
+		},
 	}
 
 	for _, test := range tt {
@@ -232,6 +341,22 @@ func (suite *serviceTestSuite) TestServiceSave2() {
 			err:      errors.New("err"),
 			expected: "failed to store data: err",
 		},
+		{
+			name: "reserved metric ID",
+			m: []model.Metric{
+				{
+					MType: service.TypeCounter,
+					ID:    "metric1",
+					Delta: i,
+				},
+				{
+					MType: service.TypeCounter,
+					ID:    service.ReservedPrefix + "requests",
+					Delta: i,
+				},
+			},
+			expected: "failed to parse metric: wrong type: gometrics_server_ prefix is reserved",
+		},
 	}
 
 	for _, test := range tt {
@@ -248,3 +373,270 @@ func (suite *serviceTestSuite) TestServiceSave2() {
 		})
 	}
 }
+
+func (suite *serviceTestSuite) TestSaveServerMetrics() {
+	ctx := context.Background()
+	i := int64(2)
+	m := []model.Metric{{MType: service.TypeCounter, ID: service.ReservedPrefix + "requests", Delta: &i}}
+	suite.repo.On("StoreMetrics", ctx, m).Once().Return(nil)
+
+	suite.NoError(suite.service.SaveServerMetrics(ctx, m))
+	suite.repo.AssertExpectations(suite.T())
+}
+
+func (suite *serviceTestSuite) TestSubscribe() {
+	ctx := context.Background()
+	f1, i := new(float64), new(int64)
+	*f1, *i = 2.0, 2
+	gauge := model.Metric{MType: service.TypeGauge, ID: "metric1", Value: f1}
+	counter := model.Metric{MType: service.TypeCounter, ID: "metric2", Delta: i}
+
+	sub := suite.service.Subscribe(model.Filter{Types: []string{service.TypeGauge}}, 10)
+	defer sub.Close()
+
+	suite.repo.On("StoreMetric", ctx, gauge).Once().Return(nil)
+	suite.repo.On("StoreMetrics", ctx, []model.Metric{gauge, counter}).Once().Return(nil)
+
+	suite.NoError(suite.service.SaveMetric(ctx, gauge))
+	suite.NoError(suite.service.SaveMetrics(ctx, []model.Metric{gauge, counter}))
+	suite.Error(suite.service.SaveMetric(ctx, model.Metric{MType: service.TypeGauge, ID: "metric3"}))
+
+	suite.Equal(gauge, <-sub.C())
+	suite.Equal(gauge, <-sub.C())
+	suite.Len(sub.C(), 0)
+}
+
+func (suite *serviceTestSuite) TestHistory() {
+	ctx := context.Background()
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	points := []model.Point{
+		{Timestamp: from.Add(10 * time.Second), Value: 1},
+		{Timestamp: from.Add(20 * time.Second), Value: 3},
+		{Timestamp: from.Add(70 * time.Second), Value: 5},
+		{Timestamp: from.Add(190 * time.Second), Value: 7},
+	}
+
+	tt := []struct {
+		name        string
+		mtype       string
+		step        time.Duration
+		err         error
+		expected    []model.Point
+		expectedErr string
+	}{
+		{
+			name:     "raw points",
+			mtype:    service.TypeGauge,
+			expected: points,
+		},
+		{
+			name:  "gauge is averaged",
+			mtype: service.TypeGauge,
+			step:  time.Minute,
+			expected: []model.Point{
+				{Timestamp: from, Value: 2},
+				{Timestamp: from.Add(time.Minute), Value: 5},
+				{Timestamp: from.Add(3 * time.Minute), Value: 7},
+			},
+		},
+		{
+			name:  "counter keeps the last value",
+			mtype: service.TypeCounter,
+			step:  time.Minute,
+			expected: []model.Point{
+				{Timestamp: from, Value: 3},
+				{Timestamp: from.Add(time.Minute), Value: 5},
+				{Timestamp: from.Add(3 * time.Minute), Value: 7},
+			},
+		},
+		{
+			name:        "bad case",
+			mtype:       service.TypeGauge,
+			err:         errors.New("err"),
+			expectedErr: "failed to load history of metric metric1: err",
+		},
+	}
+
+	for _, test := range tt {
+		suite.Run(test.name, func() {
+			mockCall := suite.repo.On("LoadHistory", ctx, test.mtype, "metric1", model.Labels(nil), from, to).Return(points, test.err)
+
+			got, err := suite.service.GetHistory(ctx, test.mtype, "metric1", nil, from, to, test.step)
+			if test.expectedErr != "" {
+				suite.EqualError(err, test.expectedErr)
+			} else {
+				suite.NoError(err)
+				suite.Equal(test.expected, got)
+			}
+			mockCall.Unset()
+		})
+	}
+}
+
+func (suite *serviceTestSuite) TestAlerts() {
+	ctx := context.Background()
+	rule, err := alert.ParseRule("gauge HeapAlloc > 100")
+	suite.Require().NoError(err)
+
+	v := 150.0
+	data := model.Data{"gauge": {"HeapAlloc": {ID: "HeapAlloc", MType: "gauge", Value: &v}}}
+	mockCall := suite.repo.On("LoadAll", ctx).Return(data, nil)
+	defer mockCall.Unset()
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	suite.service.RunAlerts(ctx, []alert.Rule{rule}, nil, time.Hour)
+
+	changed, err := suite.service.EvaluateAlerts(context.Background(), time.Now())
+	suite.NoError(err)
+	suite.Len(changed, 1)
+	suite.Equal(alert.StateFiring, changed[0].State)
+
+	alerts := suite.service.GetAlerts(ctx)
+	suite.Len(alerts, 1)
+	suite.Equal("HeapAlloc", alerts[0].Metric)
+}
+
+func (suite *serviceTestSuite) TestNotifyAlerts() {
+	c := &retryCounter{}
+	suite.service.SetRetryCounter(c)
+
+	var calls atomic.Int32
+	var received alert.Notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		suite.NoError(json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	n := alert.NewNotifier(srv.Client(), []alert.Receiver{{URL: srv.URL}}, time.Minute)
+	alerts := []alert.Alert{{Rule: "gauge HeapAlloc > 1", Metric: "HeapAlloc", State: alert.StateFiring}}
+
+	suite.service.NotifyAlerts(context.Background(), n, alerts)
+	suite.Equal(int32(2), calls.Load())
+	suite.Equal(alert.StateFiring, received.Status)
+	// the retried delivery is not a storage retry
+	suite.Equal(int64(0), c.n.Load())
+
+	suite.service.NotifyAlerts(context.Background(), n, alerts)
+	suite.Equal(int32(2), calls.Load())
+}
+
+func (suite *serviceTestSuite) TestFindMetrics() {
+	ctx := context.Background()
+	f := 1.0
+	a := model.Metric{ID: "metric1", MType: "gauge", Value: &f, Labels: model.Labels{"host": "a", "env": "prod"}}
+	b := model.Metric{ID: "metric1", MType: "gauge", Value: &f, Labels: model.Labels{"host": "b", "env": "prod"}}
+	c := model.Metric{ID: "metric1", MType: "gauge", Value: &f}
+	d := model.Metric{ID: "metric2", MType: "gauge", Value: &f, Labels: model.Labels{"host": "a"}}
+	data := model.Data{"gauge": {b.Key(): b, a.Key(): a, c.Key(): c, d.Key(): d}}
+	mockCall := suite.repo.On("LoadAll", ctx).Return(data, nil)
+	defer mockCall.Unset()
+
+	matchers, err := model.ParseMatchers(`{env="prod"}`)
+	suite.Require().NoError(err)
+	got, err := suite.service.FindMetrics(ctx, "gauge", "metric1", matchers)
+	suite.NoError(err)
+	suite.Equal([]model.Metric{a, b}, got)
+
+	got, err = suite.service.FindMetrics(ctx, "gauge", "metric1", nil)
+	suite.NoError(err)
+	suite.Equal([]model.Metric{c, a, b}, got)
+
+	got, err = suite.service.FindMetrics(ctx, "counter", "metric1", nil)
+	suite.NoError(err)
+	suite.Empty(got)
+}
+
+func (suite *serviceTestSuite) TestListMetrics() {
+	ctx := context.Background()
+	f := 1.0
+	d := int64(1)
+	a := model.Metric{ID: "cpu_usage", MType: "gauge", Value: &f, Labels: model.Labels{"host": "a"}}
+	b := model.Metric{ID: "cpu_usage", MType: "gauge", Value: &f, Labels: model.Labels{"host": "b"}}
+	c := model.Metric{ID: "cpu_time", MType: "gauge", Value: &f}
+	e := model.Metric{ID: "cpu_count", MType: "counter", Delta: &d}
+	g := model.Metric{ID: "mem_usage", MType: "gauge", Value: &f}
+	data := model.Data{
+		"gauge":   {a.Key(): a, b.Key(): b, c.Key(): c, g.Key(): g},
+		"counter": {e.Key(): e},
+	}
+	mockCall := suite.repo.On("LoadAll", ctx).Return(data, nil)
+	defer mockCall.Unset()
+
+	got, total, err := suite.service.ListMetrics(ctx, model.Filter{})
+	suite.NoError(err)
+	suite.Equal(5, total)
+	suite.Equal([]model.Metric{e, c, a, b, g}, got)
+
+	got, total, err = suite.service.ListMetrics(ctx, model.Filter{Types: []string{"gauge"}, Prefix: "cpu_", Offset: 1, Limit: 1})
+	suite.NoError(err)
+	suite.Equal(3, total)
+	suite.Equal([]model.Metric{a}, got)
+
+	matchers, err := model.ParseMatchers(`{host="b"}`)
+	suite.Require().NoError(err)
+	got, total, err = suite.service.ListMetrics(ctx, model.Filter{Regex: regexp.MustCompile("^cpu_.*$"), Matchers: matchers})
+	suite.NoError(err)
+	suite.Equal(1, total)
+	suite.Equal([]model.Metric{b}, got)
+
+	got, total, err = suite.service.ListMetrics(ctx, model.Filter{Offset: 10})
+	suite.NoError(err)
+	suite.Equal(5, total)
+	suite.Empty(got)
+}
+
+func (suite *serviceTestSuite) TestGetMetricValues() {
+	ctx := context.Background()
+	f := 1.0
+	keys := []model.Metric{{ID: "metric1", MType: "gauge"}, {ID: "metric2", MType: "gauge"}}
+	values := []model.MetricValue{
+		{Metric: model.Metric{ID: "metric1", MType: "gauge", Value: &f}, Found: true},
+		{Metric: model.Metric{ID: "metric2", MType: "gauge"}},
+	}
+	mockCall := suite.repo.On("LoadMetrics", ctx, keys).Return(values, nil)
+	defer mockCall.Unset()
+
+	got, err := suite.service.GetMetricValues(ctx, keys)
+	suite.NoError(err)
+	suite.Equal(values, got)
+
+	_, err = suite.service.GetMetricValues(ctx, []model.Metric{{ID: "metric1", MType: "gauges"}})
+	suite.ErrorIs(err, service.ErrParseMetric)
+}
+
+type retryCounter struct {
+	n atomic.Int64
+}
+
+func (c *retryCounter) Inc() {
+	c.n.Add(1)
+}
+
+func (suite *serviceTestSuite) TestRetryCounter() {
+	c := &retryCounter{}
+	suite.service.SetRetryCounter(c)
+
+	calls := 0
+	err := suite.service.Retry(context.Background(), 3, func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("err")
+		}
+		return nil
+	}, time.Millisecond, time.Millisecond, time.Millisecond)
+	suite.NoError(err)
+	suite.Equal(int64(2), c.n.Load())
+
+	err = suite.service.Retry(context.Background(), 3, func(ctx context.Context) error {
+		return service.ErrParseMetric
+	}, time.Millisecond, time.Millisecond, time.Millisecond)
+	suite.ErrorIs(err, service.ErrParseMetric)
+	suite.Equal(int64(2), c.n.Load())
+}
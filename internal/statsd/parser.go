@@ -0,0 +1,103 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// StatsD metric types.
+const (
+	TypeCounter   = "c"
+	TypeGauge     = "g"
+	TypeTimer     = "ms"
+	TypeHistogram = "h"
+)
+
+var ErrParseLine = errors.New("failed to parse statsd line")
+
+// Sample is a single value received in the StatsD line protocol.
+type Sample struct {
+	Name string
+	Type string
+	// Value of the sample. For counters it is already divided by the sample rate.
+	Value float64
+	// Relative is set for gauges sent as `+N` or `-N`, which change the current value.
+	Relative bool
+	Labels   model.Labels
+}
+
+// ParseLine parses a line like `name:1|c`, `name:3.2|g`, `name:12|ms|@0.5` or `name:1|c|#host:a`.
+// DogStatsD tags become labels, tags with names that are not valid label names are ignored.
+func ParseLine(line string) (Sample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Sample{}, fmt.Errorf("%w: %q", ErrParseLine, line)
+	}
+	if model.ValidateID(name) != nil {
+		return Sample{}, fmt.Errorf("%w: %q: bad name", ErrParseLine, line)
+	}
+	// the service would reject the whole flushed batch along with it
+	if strings.HasPrefix(name, service.ReservedPrefix) {
+		return Sample{}, fmt.Errorf("%w: %q: reserved name", ErrParseLine, line)
+	}
+
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 {
+		return Sample{}, fmt.Errorf("%w: %q", ErrParseLine, line)
+	}
+
+	s := Sample{Name: name, Type: parts[1]}
+	switch s.Type {
+	case TypeCounter, TypeGauge, TypeTimer, TypeHistogram:
+	default:
+		return Sample{}, fmt.Errorf("%w: %q: unknown type", ErrParseLine, line)
+	}
+
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Sample{}, fmt.Errorf("%w: %q: bad value", ErrParseLine, line)
+	}
+	s.Value = value
+	s.Relative = s.Type == TypeGauge && (parts[0][0] == '+' || parts[0][0] == '-')
+
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			rate, err := strconv.ParseFloat(part[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Sample{}, fmt.Errorf("%w: %q: bad sample rate", ErrParseLine, line)
+			}
+			if s.Type == TypeCounter {
+				s.Value /= rate
+				if math.IsInf(s.Value, 0) {
+					return Sample{}, fmt.Errorf("%w: %q: bad value", ErrParseLine, line)
+				}
+			}
+		case strings.HasPrefix(part, "#"):
+			s.Labels = parseTags(part[1:])
+		}
+	}
+
+	return s, nil
+}
+
+func parseTags(s string) model.Labels {
+	labels := make(model.Labels)
+	for _, tag := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(tag, ":")
+		if (model.Labels{name: value}).Validate() != nil {
+			continue
+		}
+		labels[name] = value
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
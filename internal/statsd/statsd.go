@@ -0,0 +1,248 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/service"
+)
+
+// maxPacketSize is the largest UDP payload read at once.
+const maxPacketSize = 65535
+
+// Saver stores the aggregated metrics.
+type Saver interface {
+	SaveMetrics(ctx context.Context, m []model.Metric) error
+}
+
+// Aggregator accumulates StatsD samples between flushes.
+// Counters are summed, gauges keep the last value and timers and histograms are
+// observed into histograms, timers being converted from milliseconds to seconds.
+type Aggregator struct {
+	mu         sync.Mutex
+	counters   map[string]*counter
+	gauges     map[string]model.Metric
+	histograms map[string]model.Metric
+}
+
+type counter struct {
+	metric model.Metric
+	sum    float64
+}
+
+// NewAggregator creates a new Aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		counters:   make(map[string]*counter),
+		gauges:     make(map[string]model.Metric),
+		histograms: make(map[string]model.Metric),
+	}
+}
+
+// Add accumulates a sample.
+func (a *Aggregator) Add(s Sample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := model.SeriesKey(s.Name, s.Labels)
+	switch s.Type {
+	case TypeCounter:
+		c, ok := a.counters[key]
+		if !ok {
+			c = &counter{metric: model.Metric{ID: s.Name, MType: service.TypeCounter, Labels: s.Labels}}
+			a.counters[key] = c
+		}
+		c.sum += s.Value
+	case TypeGauge:
+		m, ok := a.gauges[key]
+		if !ok {
+			m = model.Metric{ID: s.Name, MType: service.TypeGauge, Labels: s.Labels, Value: new(float64)}
+		}
+		if s.Relative {
+			*m.Value += s.Value
+		} else {
+			*m.Value = s.Value
+		}
+		a.gauges[key] = m
+	case TypeTimer, TypeHistogram:
+		m, ok := a.histograms[key]
+		if !ok {
+			m = model.Metric{ID: s.Name, MType: service.TypeHistogram, Labels: s.Labels, Histogram: model.NewHistogram(model.DefaultBuckets)}
+			a.histograms[key] = m
+		}
+		v := s.Value
+		if s.Type == TypeTimer {
+			v /= 1000
+		}
+		m.Histogram.Observe(v)
+	}
+}
+
+// Flush returns the accumulated metrics and resets the counters and histograms.
+// Gauges are kept, so relative changes apply to the last flushed value.
+func (a *Aggregator) Flush() []model.Metric {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	metrics := make([]model.Metric, 0, len(a.counters)+len(a.gauges)+len(a.histograms))
+	for _, c := range a.counters {
+		delta := int64(math.Round(c.sum))
+		m := c.metric
+		m.Delta = &delta
+		metrics = append(metrics, m)
+	}
+	for _, m := range a.gauges {
+		v := *m.Value
+		m.Value = &v
+		metrics = append(metrics, m)
+	}
+	for _, m := range a.histograms {
+		metrics = append(metrics, m)
+	}
+
+	a.counters = make(map[string]*counter)
+	a.histograms = make(map[string]model.Metric)
+	return metrics
+}
+
+// Requeue puts back the metrics of a failed flush, so they are flushed along with the next samples.
+// Gauges are kept by Flush already, the ones set since then are newer and are left as they are.
+func (a *Aggregator) Requeue(metrics []model.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, m := range metrics {
+		key := m.Key()
+		switch m.MType {
+		case service.TypeCounter:
+			c, ok := a.counters[key]
+			if !ok {
+				c = &counter{metric: model.Metric{ID: m.ID, MType: m.MType, Labels: m.Labels}}
+				a.counters[key] = c
+			}
+			c.sum += float64(*m.Delta)
+		case service.TypeHistogram:
+			stored, ok := a.histograms[key]
+			if !ok {
+				a.histograms[key] = m
+				continue
+			}
+			// the bounds of the StatsD histograms are always the same
+			stored.Histogram.Merge(m.Histogram)
+		}
+	}
+}
+
+// Listener receives StatsD packets over UDP and periodically saves the aggregated metrics.
+type Listener struct {
+	logger     *zerolog.Logger
+	service    Saver
+	address    string
+	interval   time.Duration
+	aggregator *Aggregator
+	conn       net.PacketConn
+}
+
+// NewListener creates a new Listener.
+func NewListener(l *zerolog.Logger, srv Saver, address string, interval time.Duration) *Listener {
+	return &Listener{
+		logger:     l,
+		service:    srv,
+		address:    address,
+		interval:   interval,
+		aggregator: NewAggregator(),
+	}
+}
+
+// Listen binds the UDP socket.
+func (l *Listener) Listen() error {
+	conn, err := net.ListenPacket("udp", l.address)
+	if err != nil {
+		return err
+	}
+	l.conn = conn
+	return nil
+}
+
+// Addr returns the address the listener is bound to.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Serve reads packets until ctx is done, then closes the socket and flushes the remaining metrics.
+func (l *Listener) Serve(ctx context.Context) {
+	l.logger.Info().Msgf("StatsD listener is listening on %s", l.Addr())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.read()
+	}()
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.flush(ctx)
+		case <-ctx.Done():
+			l.conn.Close()
+			<-done
+			l.flush(context.Background())
+			return
+		}
+	}
+}
+
+func (l *Listener) read() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				l.logger.Error().Err(err).Msg("StatsD read error")
+			}
+			return
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			s, err := ParseLine(line)
+			if err != nil {
+				l.logger.Error().Err(err).Msg("Invalid StatsD line")
+				continue
+			}
+			l.aggregator.Add(s)
+		}
+	}
+}
+
+func (l *Listener) flush(ctx context.Context) {
+	metrics := l.aggregator.Flush()
+	if len(metrics) == 0 {
+		return
+	}
+	if err := l.service.SaveMetrics(ctx, metrics); err != nil {
+		// the metrics rejected by the storage would fail every next flush as well
+		if errors.Is(err, service.ErrParseMetric) || errors.Is(err, model.ErrHistogramBounds) {
+			l.logger.Error().Err(err).Msg("Failed to save StatsD metrics")
+			return
+		}
+		l.logger.Error().Err(err).Msg("Failed to save StatsD metrics, they are kept for the next flush")
+		l.aggregator.Requeue(metrics)
+		return
+	}
+	l.logger.Info().Int("count", len(metrics)).Msg("StatsD metrics are flushed")
+}
@@ -0,0 +1,185 @@
+package statsd_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/v-starostin/go-metrics/internal/model"
+	"github.com/v-starostin/go-metrics/internal/statsd"
+)
+
+func TestParseLine(t *testing.T) {
+	tt := []struct {
+		line     string
+		expected statsd.Sample
+	}{
+		{"requests:1|c", statsd.Sample{Name: "requests", Type: "c", Value: 1}},
+		{"requests:1|c|@0.5", statsd.Sample{Name: "requests", Type: "c", Value: 2}},
+		{"temperature:3.2|g", statsd.Sample{Name: "temperature", Type: "g", Value: 3.2}},
+		{"temperature:-1|g", statsd.Sample{Name: "temperature", Type: "g", Value: -1, Relative: true}},
+		{"latency:12|ms|@0.1", statsd.Sample{Name: "latency", Type: "ms", Value: 12}},
+		{"size:512|h", statsd.Sample{Name: "size", Type: "h", Value: 512}},
+		{"requests:1|c|#host:a,bad-tag:x,env", statsd.Sample{Name: "requests", Type: "c", Value: 1, Labels: model.Labels{"host": "a", "env": ""}}},
+	}
+
+	for _, test := range tt {
+		t.Run(test.line, func(t *testing.T) {
+			s, err := statsd.ParseLine(test.line)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, s)
+		})
+	}
+
+	for _, line := range []string{"requests", ":1|c", "requests:1", "requests:x|c", "requests:1|s", "requests:1|c|@2", "requests{a=b}:1|c",
+		"requests:NaN|c", "requests:Inf|c", "temperature:+Inf|g", "temperature:-inf|g", "latency:nan|ms", "requests:1e308|c|@0.001",
+		"gometrics_server_requests:1|c",
+	} {
+		_, err := statsd.ParseLine(line)
+		assert.ErrorIs(t, err, statsd.ErrParseLine, line)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := statsd.NewAggregator()
+	for _, line := range []string{"requests:1|c", "requests:2|c", "temperature:10|g", "temperature:+5|g", "latency:250|ms", "latency:0.5|h"} {
+		s, err := statsd.ParseLine(line)
+		require.NoError(t, err)
+		a.Add(s)
+	}
+
+	metrics := byID(a.Flush())
+	require.Len(t, metrics, 3)
+	assert.Equal(t, int64(3), *metrics["requests"].Delta)
+	assert.Equal(t, 15.0, *metrics["temperature"].Value)
+	assert.Equal(t, uint64(2), metrics["latency"].Histogram.Count)
+	assert.Equal(t, 0.75, metrics["latency"].Histogram.Sum)
+
+	s, err := statsd.ParseLine("temperature:-3|g")
+	require.NoError(t, err)
+	a.Add(s)
+
+	metrics = byID(a.Flush())
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 12.0, *metrics["temperature"].Value)
+}
+
+func TestAggregatorRequeue(t *testing.T) {
+	a := statsd.NewAggregator()
+	for _, line := range []string{"requests:1|c", "temperature:10|g", "latency:250|ms"} {
+		s, err := statsd.ParseLine(line)
+		require.NoError(t, err)
+		a.Add(s)
+	}
+	failed := a.Flush()
+
+	for _, line := range []string{"requests:2|c", "latency:500|ms"} {
+		s, err := statsd.ParseLine(line)
+		require.NoError(t, err)
+		a.Add(s)
+	}
+	a.Requeue(failed)
+
+	metrics := byID(a.Flush())
+	require.Len(t, metrics, 3)
+	assert.Equal(t, int64(3), *metrics["requests"].Delta)
+	assert.Equal(t, 10.0, *metrics["temperature"].Value)
+	assert.Equal(t, uint64(2), metrics["latency"].Histogram.Count)
+	assert.Equal(t, 0.75, metrics["latency"].Histogram.Sum)
+}
+
+type saver struct {
+	mu      sync.Mutex
+	metrics []model.Metric
+	// fail is the number of the first calls that fail
+	fail int
+}
+
+func (s *saver) SaveMetrics(_ context.Context, m []model.Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("storage is unavailable")
+	}
+	s.metrics = append(s.metrics, m...)
+	return nil
+}
+
+func TestListener(t *testing.T) {
+	l := zerolog.Nop()
+	srv := &saver{}
+	listener := statsd.NewListener(&l, srv, "127.0.0.1:0", time.Hour)
+	require.NoError(t, listener.Listen())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		listener.Serve(ctx)
+		close(done)
+	}()
+
+	conn, err := net.Dial("udp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("requests:1|c\nrequests:4|c\ntemperature:3.5|g\nbroken\ngometrics_server_requests:1|c"))
+	require.NoError(t, err)
+
+	// UDP delivery is asynchronous, wait until the packet is read before shutting down
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	metrics := byID(srv.metrics)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, int64(5), *metrics["requests"].Delta)
+	assert.Equal(t, 3.5, *metrics["temperature"].Value)
+}
+
+func TestListenerFailedFlush(t *testing.T) {
+	l := zerolog.Nop()
+	srv := &saver{fail: 1}
+	listener := statsd.NewListener(&l, srv, "127.0.0.1:0", 50*time.Millisecond)
+	require.NoError(t, listener.Listen())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		listener.Serve(ctx)
+		close(done)
+	}()
+
+	conn, err := net.Dial("udp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("requests:2|c"))
+	require.NoError(t, err)
+
+	// the first flush fails, the batch is saved by one of the next ones
+	require.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.metrics) > 0
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	metrics := byID(srv.metrics)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(2), *metrics["requests"].Delta)
+}
+
+func byID(metrics []model.Metric) map[string]model.Metric {
+	result := make(map[string]model.Metric)
+	for _, m := range metrics {
+		result[m.ID] = m
+	}
+	return result
+}